@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	"shakilakhtar/go-microservices-platform/dataaccess/migrate"
+)
+
+const dbUsage = `usage: platform db <command> [flags] [arguments]
+
+commands:
+  migrate up                apply all pending migrations (default)
+  migrate down [steps]      roll back the last steps migrations, 1 by default
+  migrate to <version>      migrate up or down to version, 0 rolls back everything
+  migrate status            list migrations and whether they are applied
+  export [table]            write the rows of a table, or of -query, as CSV or NDJSON
+  import <table> [file]     load CSV or NDJSON rows into a table, from stdin without file
+  reencrypt <table> <col>.. move encrypted columns to the primary key of the keyring
+`
+
+func runDB(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(dbUsage)
+	}
+	switch args[0] {
+	case "migrate":
+		return runMigrate(ctx, args[1:])
+	case "export":
+		return runExport(ctx, args[1:])
+	case "import":
+		return runImport(ctx, args[1:])
+	case "reencrypt":
+		return runReEncrypt(ctx, args[1:])
+	default:
+		return errors.New(dbUsage)
+	}
+}
+
+// dbFlags are shared by the db commands
+type dbFlags struct {
+	configDir  *string
+	dataSource *string
+}
+
+func newDBFlags(name string) (*flag.FlagSet, dbFlags) {
+	flags := flag.NewFlagSet("platform db "+name, flag.ContinueOnError)
+	return flags, dbFlags{
+		configDir:  flags.String("config", "config", "directory containing "+dataaccess.DB_CONFIG_FILE+", used unless a database service is bound"),
+		dataSource: flags.String("datasource", dataaccess.DEFAULT_DATASOURCE, "name of the data source to use"),
+	}
+}
+
+func (f dbFlags) connect(ctx context.Context) (*dataaccess.DataSource, error) {
+	if _, err := dataaccess.LoadDBConfiguration(*f.configDir); err != nil {
+		return nil, err
+	}
+	return dataaccess.Connect(ctx, *f.dataSource)
+}
+
+func runMigrate(ctx context.Context, args []string) error {
+	flags, db := newDBFlags("migrate")
+	dir := flags.String("dir", "migrations", "directory containing the migration files")
+	table := flags.String("table", migrate.DEFAULT_TABLE, "migration ledger table")
+	lockTimeout := flags.Duration("lock-timeout", migrate.DEFAULT_LOCK_TIMEOUT, "how long to wait for another instance to finish migrating")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	migrations, err := migrate.FromDir(*dir)
+	if err != nil {
+		return err
+	}
+	ds, err := db.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer dataaccess.Shutdown()
+
+	migrator, err := migrate.New(ds.DB().DB(), ds.Dialect(), migrations)
+	if err != nil {
+		return err
+	}
+	migrator.Table = *table
+	migrator.LockTimeout = *lockTimeout
+
+	var changed []*migrate.Migration
+	switch command := flags.Arg(0); command {
+	case "", "up":
+		changed, err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if flags.NArg() > 1 {
+			if steps, err = strconv.Atoi(flags.Arg(1)); err != nil {
+				return fmt.Errorf("invalid number of steps %q", flags.Arg(1))
+			}
+		}
+		changed, err = migrator.Down(ctx, steps)
+	case "to":
+		version, parseErr := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid version %q", flags.Arg(1))
+		}
+		changed, err = migrator.To(ctx, version)
+	case "status":
+		return printStatus(ctx, migrator)
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", command, dbUsage)
+	}
+
+	for _, m := range changed {
+		fmt.Printf("%d_%s\n", m.Version, m.Name)
+	}
+	return err
+}
+
+func printStatus(ctx context.Context, migrator *migrate.Migrator) error {
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+	for _, s := range status {
+		state := "pending"
+		switch {
+		case s.Missing:
+			state = "applied, missing"
+		case s.Modified:
+			state = "applied, modified"
+		case s.Applied:
+			state = "applied"
+		}
+		appliedAt := ""
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+	}
+	return w.Flush()
+}
+
+func runExport(ctx context.Context, args []string) error {
+	flags, db := newDBFlags("export")
+	format := flags.String("format", dataaccess.FORMAT_CSV, "output format, csv or ndjson")
+	query := flags.String("query", "", "query whose rows are exported instead of a table")
+	out := flags.String("out", "", "file the rows are written to, stdout unless set")
+	null := flags.String("null", "", "CSV field written for NULL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	table := flags.Arg(0)
+	if (table == "") == (*query == "") {
+		return fmt.Errorf("export needs either a table or -query\n%s", dbUsage)
+	}
+
+	ds, err := db.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer dataaccess.Shutdown()
+
+	var (
+		w    io.Writer = os.Stdout
+		file *os.File
+	)
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	options := dataaccess.ExportOptions{Format: *format, Null: *null}
+	var rows int64
+	if table != "" {
+		rows, err = ds.SQL().ExportTable(ctx, w, table, options)
+	} else {
+		rows, err = ds.SQL().Export(ctx, w, options, *query)
+	}
+	if err != nil {
+		return err
+	}
+	// a failing close can lose the end of the file
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "exported %d rows\n", rows)
+	return nil
+}
+
+func runImport(ctx context.Context, args []string) error {
+	flags, db := newDBFlags("import")
+	format := flags.String("format", "", "input format, csv or ndjson, taken from the file extension unless set")
+	mapping := flags.String("map", "", "column mapping, e.g. order_id=id,note=- maps order_id to id and skips note")
+	batchSize := flags.Int("batch-size", dataaccess.DEFAULT_BULK_BATCH_SIZE, "rows per INSERT statement")
+	upsert := flags.String("upsert", "", "comma separated conflict columns, switches to upserting")
+	update := flags.String("update", "", "comma separated columns updated on conflict, with -upsert")
+	null := flags.String("null", "", "CSV field read as NULL")
+	dryRun := flags.Bool("dry-run", false, "import every row in a transaction that is rolled back")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	table, path := flags.Arg(0), flags.Arg(1)
+	if table == "" {
+		return fmt.Errorf("import needs a table\n%s", dbUsage)
+	}
+
+	options := dataaccess.ImportOptions{
+		Format:          *format,
+		Table:           table,
+		Columns:         map[string]string{},
+		BatchSize:       *batchSize,
+		ConflictColumns: splitList(*upsert),
+		UpdateColumns:   splitList(*update),
+		Null:            *null,
+		DryRun:          *dryRun,
+	}
+	for _, pair := range splitList(*mapping) {
+		from := strings.SplitN(pair, "=", 2)
+		if len(from) != 2 {
+			return fmt.Errorf("invalid column mapping %q", pair)
+		}
+		options.Columns[from[0]] = from[1]
+	}
+	if options.Format == "" {
+		options.Format = dataaccess.FORMAT_CSV
+		if ext := filepath.Ext(path); ext == ".ndjson" || ext == ".jsonl" {
+			options.Format = dataaccess.FORMAT_NDJSON
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	if path != "" && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	ds, err := db.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer dataaccess.Shutdown()
+
+	result, err := ds.SQL().Import(ctx, r, options)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("checked %d rows\n", result.Rows)
+		return nil
+	}
+	fmt.Printf("read %d rows, wrote %d\n", result.Rows, result.Written)
+	return nil
+}
+
+func runReEncrypt(ctx context.Context, args []string) error {
+	flags, db := newDBFlags("reencrypt")
+	key := flags.String("key", "id", "primary key column of the table")
+	batchSize := flags.Int("batch-size", dataaccess.DEFAULT_REENCRYPT_BATCH_SIZE, "rows per transaction")
+	indexes := flags.String("index", "", "comma separated blind index columns of the encrypted columns, e.g. email=email_index")
+	every := flags.Duration("every", 0, "keep running and re-encrypt at this interval until interrupted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return fmt.Errorf("reencrypt needs a table and its encrypted columns\n%s", dbUsage)
+	}
+	blindIndexes := map[string]string{}
+	for _, index := range splitList(*indexes) {
+		parts := strings.SplitN(index, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("the blind index %q is not of the form column=index_column", index)
+		}
+		blindIndexes[parts[0]] = parts[1]
+	}
+
+	ds, err := db.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer dataaccess.Shutdown()
+	keyring, err := dataaccess.KeyringFromConfiguration()
+	if err != nil {
+		return err
+	}
+	dataaccess.SetKeyring(keyring)
+
+	options := dataaccess.ReEncryptOptions{
+		Table:        flags.Arg(0),
+		Columns:      flags.Args()[1:],
+		BlindIndexes: blindIndexes,
+		Key:          *key,
+		BatchSize:    *batchSize,
+	}
+	if *every > 0 {
+		job := dataaccess.NewReEncryption(ds, options)
+		job.Interval = *every
+		if err := job.Run(ctx); err != context.Canceled {
+			return err
+		}
+		return nil
+	}
+	rows, err := ds.SQL().ReEncrypt(ctx, options)
+	fmt.Printf("re-encrypted %d rows\n", rows)
+	return err
+}
+
+// splitList splits a comma separated list, ignoring blanks
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
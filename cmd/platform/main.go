@@ -0,0 +1,50 @@
+// Command platform bundles operational tasks for services built on the platform.
+//
+//	platform db migrate [flags] up | down [steps] | to <version> | status
+//	platform db export [flags] [table]
+//	platform db import [flags] <table> [file]
+//	platform db reencrypt [flags] <table> <column>...
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const usage = `usage: platform <command> [arguments]
+
+commands:
+  db migrate    apply, roll back or list schema migrations
+  db export     write the rows of a table or query as CSV or NDJSON
+  db import     load CSV or NDJSON rows into a table
+  db reencrypt  move encrypted columns to the primary key of the keyring
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// interrupting aborts a running command, e.g. a connect that is still retrying
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "db":
+		err = runDB(ctx, os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,151 @@
+package dataaccess
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/security/uaa"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// identityKey is the gorm setting carrying the identity written to the audit columns
+	identityKey = "dataaccess:identity"
+)
+
+type (
+	// Audit adds audit columns to a model that embeds it. The timestamps are set by gorm, the
+	// identities by the audit callbacks from the identity of the request, see IdentityFromContext.
+	Audit struct {
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+		CreatedBy string    `gorm:"size:255" json:"created_by,omitempty"`
+		UpdatedBy string    `gorm:"size:255" json:"updated_by,omitempty"`
+	}
+
+	// SoftDelete makes deleting a model that embeds it mark the rows as deleted instead of removing
+	// them. Deleted rows are left out of queries unless the context is made by IncludeDeleted.
+	SoftDelete struct {
+		DeletedAt *time.Time `sql:"index" json:"deleted_at,omitempty"`
+		DeletedBy string     `gorm:"size:255" json:"deleted_by,omitempty"`
+	}
+)
+
+type (
+	identityContextKey       struct{}
+	includeDeletedContextKey struct{}
+)
+
+// registerAuditCallbacks installs the audit callbacks on the handle of a data source
+func registerAuditCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().After("gorm:update_time_stamp").Register("dataaccess:audit_create", auditCreateCallback)
+	callbacks.Update().After("gorm:update_time_stamp").Register("dataaccess:audit_update", auditUpdateCallback)
+	callbacks.Delete().Replace("gorm:delete", softDeleteCallback)
+}
+
+// WithIdentity returns a context whose changes are audited as made by identity, e.g. for jobs
+// running without a token
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext returns who makes the changes of a request: the identity set by WithIdentity,
+// or else the user name of the token validated by uaa.Protected, or for client tokens its client id
+func IdentityFromContext(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityContextKey{}).(string); ok {
+		return identity
+	}
+	if claims, ok := uaa.ClaimsFromContext(ctx); ok {
+		if user := uaa.StringClaim(claims, uaa.UserNameClaim); user != "" {
+			return user
+		}
+		return uaa.StringClaim(claims, uaa.ClientIdClaim)
+	}
+	return ""
+}
+
+// IncludeDeleted returns a context whose repository reads include soft deleted rows
+func IncludeDeleted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, includeDeletedContextKey{}, true)
+}
+
+func includesDeleted(ctx context.Context) bool {
+	include, _ := ctx.Value(includeDeletedContextKey{}).(bool)
+	return include
+}
+
+// withIdentity passes the identity of the request on to the audit callbacks
+func withIdentity(db *gorm.DB, ctx context.Context) *gorm.DB {
+	if identity := IdentityFromContext(ctx); identity != "" {
+		return db.Set(identityKey, identity)
+	}
+	return db
+}
+
+func identityOf(scope *gorm.Scope) string {
+	identity, _ := scope.Get(identityKey)
+	s, _ := identity.(string)
+	return s
+}
+
+func auditCreateCallback(scope *gorm.Scope) {
+	identity := identityOf(scope)
+	if scope.HasError() || identity == "" {
+		return
+	}
+	for _, name := range []string{"CreatedBy", "UpdatedBy"} {
+		if field, ok := scope.FieldByName(name); ok && field.IsBlank {
+			field.Set(identity)
+		}
+	}
+}
+
+func auditUpdateCallback(scope *gorm.Scope) {
+	identity := identityOf(scope)
+	if scope.HasError() || identity == "" {
+		return
+	}
+	// UpdateColumn skips the timestamps and so the audit columns
+	if _, ok := scope.Get("gorm:update_column"); ok {
+		return
+	}
+	if _, ok := scope.FieldByName("UpdatedBy"); ok {
+		scope.SetColumn("UpdatedBy", identity)
+	}
+}
+
+// softDeleteCallback replaces the gorm delete callback so that soft deletes also record the identity
+func softDeleteCallback(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	var extraOption string
+	if option, ok := scope.Get("gorm:delete_option"); ok {
+		extraOption = " " + fmt.Sprint(option)
+	}
+	// the values of the statement are bound in the order they are added, so the SET clause comes
+	// before the conditions
+	conditions := func() string {
+		if sql := scope.CombinedConditionSql(); sql != "" {
+			return " " + sql
+		}
+		return ""
+	}
+
+	deletedAt, softDelete := scope.FieldByName("DeletedAt")
+	if scope.Search.Unscoped || !softDelete {
+		scope.Raw(fmt.Sprintf("DELETE FROM %v%v%v", scope.QuotedTableName(), conditions(), extraOption)).Exec()
+		return
+	}
+
+	set := fmt.Sprintf("%v=%v", scope.Quote(deletedAt.DBName), scope.AddToVars(gorm.NowFunc()))
+	if deletedBy, ok := scope.FieldByName("DeletedBy"); ok {
+		if identity := identityOf(scope); identity != "" {
+			set += fmt.Sprintf(", %v=%v", scope.Quote(deletedBy.DBName), scope.AddToVars(identity))
+		}
+	}
+	scope.Raw(fmt.Sprintf("UPDATE %v SET %v%v%v", scope.QuotedTableName(), set, conditions(), extraOption)).Exec()
+}
@@ -0,0 +1,163 @@
+package dataaccess_test
+
+import (
+	"context"
+	"net/http"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	"shakilakhtar/go-microservices-platform/security/uaa"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type invoice struct {
+	ID     uint `gorm:"primary_key"`
+	Amount int
+	dataaccess.Audit
+	dataaccess.SoftDelete
+}
+
+var _ = Describe("audit", func() {
+	var (
+		ds    *dataaccess.DataSource
+		repo  *dataaccess.Repository
+		alice = uaa.WithClaims(context.Background(), jwt.MapClaims{uaa.UserNameClaim: "alice", uaa.ClientIdClaim: "billing"})
+	)
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&invoice{})
+		repo = dataaccess.NewRepository(ds, &invoice{})
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	Context("identity", func() {
+		It("should be the user name of the token", func() {
+			Expect(dataaccess.IdentityFromContext(alice)).To(Equal("alice"))
+		})
+
+		It("should be the client id of a client token", func() {
+			ctx := uaa.WithClaims(context.Background(), jwt.MapClaims{uaa.ClientIdClaim: "billing"})
+			Expect(dataaccess.IdentityFromContext(ctx)).To(Equal("billing"))
+		})
+
+		It("should be the identity set explicitly over the token", func() {
+			Expect(dataaccess.IdentityFromContext(dataaccess.WithIdentity(alice, "nightly-job"))).To(Equal("nightly-job"))
+		})
+
+		It("should be empty without token", func() {
+			Expect(dataaccess.IdentityFromContext(context.Background())).To(BeEmpty())
+		})
+	})
+
+	Context("audit columns", func() {
+		It("should record who created a row", func() {
+			created := &invoice{Amount: 10}
+			Expect(repo.Create(alice, created)).To(Succeed())
+
+			var loaded invoice
+			Expect(repo.Get(alice, &loaded, created.ID)).To(Succeed())
+			Expect(loaded.CreatedBy).To(Equal("alice"))
+			Expect(loaded.UpdatedBy).To(Equal("alice"))
+			Expect(loaded.CreatedAt).NotTo(BeZero())
+		})
+
+		It("should not overwrite an identity set on the entity", func() {
+			created := &invoice{Amount: 10, Audit: dataaccess.Audit{CreatedBy: "import"}}
+			Expect(repo.Create(alice, created)).To(Succeed())
+			Expect(created.CreatedBy).To(Equal("import"))
+		})
+
+		It("should record who updated a row", func() {
+			created := &invoice{Amount: 10}
+			Expect(repo.Create(alice, created)).To(Succeed())
+
+			bob := dataaccess.WithIdentity(context.Background(), "bob")
+			Expect(repo.Patch(bob, created, map[string]interface{}{"amount": 20})).To(Succeed())
+			var loaded invoice
+			Expect(repo.Get(bob, &loaded, created.ID)).To(Succeed())
+			Expect(loaded.Amount).To(Equal(20))
+			Expect(loaded.CreatedBy).To(Equal("alice"))
+			Expect(loaded.UpdatedBy).To(Equal("bob"))
+
+			loaded.Amount = 30
+			Expect(repo.Update(dataaccess.WithIdentity(context.Background(), "carol"), &loaded)).To(Succeed())
+			Expect(repo.Get(bob, &loaded, created.ID)).To(Succeed())
+			Expect(loaded.UpdatedBy).To(Equal("carol"))
+		})
+
+		It("should record the identity of a transaction", func() {
+			err := ds.WithTransaction(alice, func(tx *dataaccess.Tx) error {
+				return tx.Create(&invoice{Amount: 10}).Error
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			var loaded invoice
+			Expect(ds.DB().First(&loaded).Error).NotTo(HaveOccurred())
+			Expect(loaded.CreatedBy).To(Equal("alice"))
+		})
+
+		It("should leave the columns empty without identity", func() {
+			created := &invoice{Amount: 10}
+			Expect(repo.Create(context.Background(), created)).To(Succeed())
+			Expect(created.CreatedBy).To(BeEmpty())
+		})
+	})
+
+	Context("soft delete", func() {
+		var created *invoice
+
+		BeforeEach(func() {
+			created = &invoice{Amount: 10}
+			Expect(repo.Create(alice, created)).To(Succeed())
+			Expect(repo.Create(alice, &invoice{Amount: 20})).To(Succeed())
+		})
+
+		It("should mark the row as deleted by the identity", func() {
+			Expect(repo.Delete(alice, created)).To(Succeed())
+
+			var loaded invoice
+			Expect(statusOf(repo.Get(alice, &loaded, created.ID))).To(Equal(http.StatusNotFound))
+			Expect(repo.Get(dataaccess.IncludeDeleted(alice), &loaded, created.ID)).To(Succeed())
+			Expect(loaded.DeletedAt).NotTo(BeNil())
+			Expect(loaded.DeletedBy).To(Equal("alice"))
+		})
+
+		It("should leave deleted rows out of lists and counts", func() {
+			Expect(repo.Delete(alice, created)).To(Succeed())
+
+			var invoices []invoice
+			page, err := repo.List(alice, dataaccess.QuerySpec{}, &invoices)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page.Total).To(BeEquivalentTo(1))
+			Expect(invoices).To(HaveLen(1))
+
+			count, err := repo.Count(dataaccess.IncludeDeleted(alice), dataaccess.QuerySpec{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(2))
+		})
+
+		It("should soft delete in bulk", func() {
+			deleted, err := repo.BulkDelete(alice, []dataaccess.Filter{dataaccess.Eq("amount", 20)})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deleted).To(BeEquivalentTo(1))
+
+			var invoices []invoice
+			Expect(ds.DB().Unscoped().Where("deleted_by = ?", "alice").Find(&invoices).Error).NotTo(HaveOccurred())
+			Expect(invoices).To(HaveLen(1))
+			Expect(invoices[0].Amount).To(Equal(20))
+		})
+
+		It("should remove the row when deleting unscoped", func() {
+			Expect(ds.DB().Unscoped().Delete(created).Error).NotTo(HaveOccurred())
+
+			var count int
+			Expect(ds.DB().Unscoped().Model(&invoice{}).Count(&count).Error).NotTo(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+	})
+})
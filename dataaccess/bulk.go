@@ -0,0 +1,366 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// DEFAULT_BULK_BATCH_SIZE is the number of rows per INSERT statement of a bulk load without COPY
+	DEFAULT_BULK_BATCH_SIZE = 500
+
+	// bulkStagingTable is the temporary table postgres upserts copy the rows into
+	bulkStagingTable = "dataaccess_bulk_staging"
+)
+
+// maxBulkParameters is the number of placeholders a statement of a dialect may have, which caps the
+// rows of a batch
+var maxBulkParameters = map[string]int{
+	DIALECT_POSTGRES: 65535,
+	DIALECT_MYSQL:    65535,
+	DIALECT_SQLITE:   999,
+	DIALECT_MSSQL:    2100,
+}
+
+// maxBulkRows is the number of rows the VALUES list of a statement of a dialect may have
+var maxBulkRows = map[string]int{
+	DIALECT_MSSQL: 1000,
+}
+
+// BulkRows streams the rows of a bulk load. Next returns the values of the next row in the order of
+// the columns of the load, and false once the rows are exhausted.
+type BulkRows interface {
+	Next(ctx context.Context) ([]interface{}, bool, error)
+}
+
+// BulkRowsFunc adapts a function, e.g. one reading the next record of a file, to BulkRows
+type BulkRowsFunc func(ctx context.Context) ([]interface{}, bool, error)
+
+// Next calls f
+func (f BulkRowsFunc) Next(ctx context.Context) ([]interface{}, bool, error) {
+	return f(ctx)
+}
+
+// RowsFromChannel streams the rows sent on a channel until it is closed. The producer should stop
+// sending when the context of the load is done.
+func RowsFromChannel(rows <-chan []interface{}) BulkRows {
+	return BulkRowsFunc(func(ctx context.Context) ([]interface{}, bool, error) {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case row, ok := <-rows:
+			return row, ok, nil
+		}
+	})
+}
+
+// RowsFromSlice streams rows held in memory
+func RowsFromSlice(rows [][]interface{}) BulkRows {
+	next := 0
+	return BulkRowsFunc(func(ctx context.Context) ([]interface{}, bool, error) {
+		if next >= len(rows) {
+			return nil, false, nil
+		}
+		next++
+		return rows[next-1], true, nil
+	})
+}
+
+// BulkLoad describes where a bulk load writes its rows
+type BulkLoad struct {
+	// Table the rows are written to, optionally qualified with its schema
+	Table string
+	// Columns of the values of every row
+	Columns []string
+	// BatchSize is the number of rows per INSERT statement of dialects without COPY and of
+	// upserts, DEFAULT_BULK_BATCH_SIZE unless set. It is capped by the number of placeholders a
+	// statement may have.
+	BatchSize int
+	// ConflictColumns are the conflict target of an upsert, the columns of the primary key or of a
+	// unique index. MySQL takes the conflict target from the keys of the table.
+	ConflictColumns []string
+	// UpdateColumns are overwritten with the values of an upserted row conflicting with an existing
+	// one. Without them the existing row is kept.
+	UpdateColumns []string
+}
+
+// BulkInsert writes a stream of rows into a table and returns the number of rows written. Postgres
+// copies the rows with COPY FROM STDIN, other dialects insert batches of rows with multi-row INSERT
+// statements. Only a batch of rows is held in memory at a time.
+//
+// The load runs in a transaction, or in a savepoint of the transaction carried by ctx, so that either
+// all rows or none are written. Unlike WithTransaction it is not retried, as the rows cannot be
+// read a second time.
+func (s *SQL) BulkInsert(ctx context.Context, load BulkLoad, rows BulkRows) (int64, error) {
+	if err := load.validate(false); err != nil {
+		return 0, err
+	}
+	var written int64
+	err := s.ds.transactionOnce(ctx, func(tx *Tx) error {
+		var err error
+		if s.ds.Dialect() == DIALECT_POSTGRES {
+			written, err = s.copyIn(tx.Context(), load.Table, load.Columns, rows)
+		} else {
+			written, err = s.insertBatches(tx.Context(), load, rows, "")
+		}
+		return err
+	})
+	return written, err
+}
+
+// BulkUpsert writes a stream of rows into a table like BulkInsert, updating the UpdateColumns of
+// existing rows conflicting on the ConflictColumns, or keeping them without UpdateColumns. It returns
+// the number of rows inserted or updated as reported by the database; MySQL counts an updated row
+// twice. The rows of one load must not conflict with each other.
+//
+// Postgres copies the rows into a temporary table and upserts them from there, the other dialects
+// upsert batches of rows with INSERT ... ON CONFLICT, or ON DUPLICATE KEY UPDATE on MySQL. SQL Server
+// is not supported.
+func (s *SQL) BulkUpsert(ctx context.Context, load BulkLoad, rows BulkRows) (int64, error) {
+	if err := load.validate(true); err != nil {
+		return 0, err
+	}
+	conflict, err := s.conflictClause(load)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	err = s.ds.transactionOnce(ctx, func(tx *Tx) error {
+		var err error
+		if s.ds.Dialect() == DIALECT_POSTGRES {
+			written, err = s.copyUpsert(tx.Context(), load, rows, conflict)
+		} else {
+			written, err = s.insertBatches(tx.Context(), load, rows, conflict)
+		}
+		return err
+	})
+	return written, err
+}
+
+func (load BulkLoad) validate(upsert bool) error {
+	if load.Table == "" || len(load.Columns) == 0 {
+		return fmt.Errorf("a bulk load needs a table and columns")
+	}
+	if upsert && len(load.ConflictColumns) == 0 {
+		return fmt.Errorf("an upsert into %s needs conflict columns", load.Table)
+	}
+	return nil
+}
+
+// conflictClause returns the clause appended to the INSERT statements of an upsert
+func (s *SQL) conflictClause(load BulkLoad) (string, error) {
+	dialect := s.ds.DB().Dialect()
+	switch s.ds.Dialect() {
+	case DIALECT_POSTGRES, DIALECT_SQLITE:
+		clause := fmt.Sprintf(" ON CONFLICT (%s)", s.quoteColumns(load.ConflictColumns))
+		if len(load.UpdateColumns) == 0 {
+			return clause + " DO NOTHING", nil
+		}
+		updates := make([]string, len(load.UpdateColumns))
+		for i, column := range load.UpdateColumns {
+			updates[i] = fmt.Sprintf("%s = excluded.%s", dialect.Quote(column), dialect.Quote(column))
+		}
+		return clause + " DO UPDATE SET " + strings.Join(updates, ", "), nil
+	case DIALECT_MYSQL:
+		if len(load.UpdateColumns) == 0 {
+			// assigning a column to itself keeps the existing row without ignoring other errors
+			// like INSERT IGNORE would
+			column := dialect.Quote(load.ConflictColumns[0])
+			return fmt.Sprintf(" ON DUPLICATE KEY UPDATE %s = %s", column, column), nil
+		}
+		updates := make([]string, len(load.UpdateColumns))
+		for i, column := range load.UpdateColumns {
+			updates[i] = fmt.Sprintf("%s = VALUES(%s)", dialect.Quote(column), dialect.Quote(column))
+		}
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "), nil
+	}
+	return "", fmt.Errorf("bulk upserts are not supported on %s", s.ds.Dialect())
+}
+
+// bulkBatchSize returns the rows per INSERT statement, the requested batch size capped by the
+// limits of the dialect on the parameters and rows of a statement
+func bulkBatchSize(dialect string, requested int, columns int) int {
+	batchSize := requested
+	if batchSize <= 0 {
+		batchSize = DEFAULT_BULK_BATCH_SIZE
+	}
+	if max := maxBulkParameters[dialect] / columns; max > 0 && batchSize > max {
+		batchSize = max
+	}
+	if max, ok := maxBulkRows[dialect]; ok && batchSize > max {
+		batchSize = max
+	}
+	return batchSize
+}
+
+// insertBatches writes the rows with multi-row INSERT statements of a batch of rows each,
+// followed by conflict for upserts
+func (s *SQL) insertBatches(ctx context.Context, load BulkLoad, rows BulkRows, conflict string) (int64, error) {
+	q, err := s.querier(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	batchSize := bulkBatchSize(s.ds.Dialect(), load.BatchSize, len(load.Columns))
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", s.quoteTable(load.Table), s.quoteColumns(load.Columns))
+	var (
+		read, written int64
+		count         int
+		args          = make([]interface{}, 0, batchSize*len(load.Columns))
+	)
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		var query strings.Builder
+		query.WriteString(insert)
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteByte('(')
+			for j := range load.Columns {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				query.WriteString(bindVar(s.ds.Dialect(), i*len(load.Columns)+j+1))
+			}
+			query.WriteByte(')')
+		}
+		query.WriteString(conflict)
+
+		timer := startQueryTimer(ctx)
+		result, err := q.ExecContext(ctx, query.String(), args...)
+		var affected int64
+		if err == nil {
+			affected, _ = result.RowsAffected()
+		}
+		s.ds.finishQuery(timer, sqlEvent(query.String(), affected, err))
+		if err != nil {
+			return err
+		}
+		written += affected
+		count, args = 0, args[:0]
+		return nil
+	}
+
+	for {
+		values, ok, err := rows.Next(ctx)
+		if err != nil {
+			return written, err
+		}
+		if !ok {
+			break
+		}
+		if read++; len(values) != len(load.Columns) {
+			return written, fmt.Errorf("row %d has %d values for %d columns", read, len(values), len(load.Columns))
+		}
+		args = append(args, values...)
+		if count++; count == batchSize {
+			if err := flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, flush()
+}
+
+// copyIn copies the rows into a table with COPY FROM STDIN
+func (s *SQL) copyIn(ctx context.Context, table string, columns []string, rows BulkRows) (int64, error) {
+	q, err := s.querier(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	preparer, ok := q.(interface {
+		PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	})
+	if !ok {
+		return 0, fmt.Errorf("COPY needs a transaction of data source %q", s.ds.name)
+	}
+	query := pq.CopyIn(table, columns...)
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		query = pq.CopyInSchema(table[:i], table[i+1:], columns...)
+	}
+
+	timer := startQueryTimer(ctx)
+	copied, err := copyRows(ctx, preparer, query, len(columns), rows)
+	s.ds.finishQuery(timer, QueryEvent{Table: table, Operation: "COPY", SQL: query, Rows: copied, ErrorClass: ErrorClass(err)})
+	return copied, err
+}
+
+func copyRows(ctx context.Context, preparer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}, query string, columns int, rows BulkRows) (copied int64, err error) {
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := stmt.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for {
+		values, ok, err := rows.Next(ctx)
+		if err != nil {
+			return copied, err
+		}
+		if !ok {
+			break
+		}
+		if len(values) != columns {
+			return copied, fmt.Errorf("row %d has %d values for %d columns", copied+1, len(values), columns)
+		}
+		// the driver buffers the rows and sends them on in chunks
+		if _, err := stmt.ExecContext(ctx, values...); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	// an Exec without values ends the copy
+	_, err = stmt.ExecContext(ctx)
+	return copied, err
+}
+
+// copyUpsert copies the rows into a temporary table and upserts them from there into the table
+func (s *SQL) copyUpsert(ctx context.Context, load BulkLoad, rows BulkRows, conflict string) (int64, error) {
+	staging := s.ds.DB().Dialect().Quote(bulkStagingTable)
+	create := fmt.Sprintf("CREATE TEMPORARY TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", staging, s.quoteTable(load.Table))
+	if _, err := s.Exec(ctx, create); err != nil {
+		return 0, err
+	}
+	if _, err := s.copyIn(ctx, bulkStagingTable, load.Columns, rows); err != nil {
+		return 0, err
+	}
+	columns := s.quoteColumns(load.Columns)
+	result, err := s.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s%s", s.quoteTable(load.Table), columns, columns, staging, conflict))
+	if err != nil {
+		return 0, err
+	}
+	// a second upsert of the transaction creates the table again
+	if _, err := s.Exec(ctx, "DROP TABLE "+staging); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQL) quoteTable(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = s.ds.DB().Dialect().Quote(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s *SQL) quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = s.ds.DB().Dialect().Quote(column)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,159 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bulk loads", func() {
+	var (
+		ds   *dataaccess.DataSource
+		db   *dataaccess.SQL
+		ctx  = context.Background()
+		load dataaccess.BulkLoad
+	)
+
+	count := func() int {
+		var n int
+		Expect(db.Get(ctx, &n, "SELECT count(*) FROM orders")).To(Succeed())
+		return n
+	}
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&order{})
+		db = ds.SQL()
+		load = dataaccess.BulkLoad{Table: "orders", Columns: []string{"id", "customer", "total"}}
+	})
+
+	AfterEach(func() {
+		dataaccess.SetQueryObserver(nil)
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	Context("insert", func() {
+		It("should insert the rows in batches", func() {
+			var statements int
+			dataaccess.SetQueryObserver(func(ctx context.Context, event dataaccess.QueryEvent) {
+				if event.Operation == "INSERT" {
+					statements++
+				}
+			})
+
+			load.BatchSize = 2
+			written, err := db.BulkInsert(ctx, load, dataaccess.RowsFromSlice([][]interface{}{
+				{1, "acme", 10}, {2, "acme", 20}, {3, "globex", 30}, {4, "initech", 40}, {5, "initech", 50},
+			}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(BeEquivalentTo(5))
+			Expect(statements).To(Equal(3))
+			Expect(count()).To(Equal(5))
+		})
+
+		It("should cap batches by the parameter and row limits of the dialect", func() {
+			Expect(dataaccess.BulkBatchSize(dataaccess.DIALECT_SQLITE, 0, 1)).To(Equal(dataaccess.DEFAULT_BULK_BATCH_SIZE))
+			Expect(dataaccess.BulkBatchSize(dataaccess.DIALECT_SQLITE, 500, 10)).To(Equal(99))
+			Expect(dataaccess.BulkBatchSize(dataaccess.DIALECT_MSSQL, 5000, 20)).To(Equal(105))
+			// SQL Server takes at most 1000 rows in a VALUES list
+			Expect(dataaccess.BulkBatchSize(dataaccess.DIALECT_MSSQL, 5000, 1)).To(Equal(1000))
+			Expect(dataaccess.BulkBatchSize(dataaccess.DIALECT_POSTGRES, 5000, 1)).To(Equal(5000))
+		})
+
+		It("should stream the rows of a channel", func() {
+			rows := make(chan []interface{})
+			go func() {
+				defer close(rows)
+				for i := 1; i <= 1200; i++ {
+					rows <- []interface{}{i, "acme", i}
+				}
+			}()
+			written, err := db.BulkInsert(ctx, load, dataaccess.RowsFromChannel(rows))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(BeEquivalentTo(1200))
+
+			var total int
+			Expect(db.Get(ctx, &total, "SELECT sum(total) FROM orders")).To(Succeed())
+			Expect(total).To(Equal(1200 * 1201 / 2))
+		})
+
+		It("should write all rows or none", func() {
+			load.BatchSize = 1
+			_, err := db.BulkInsert(ctx, load, dataaccess.RowsFromSlice([][]interface{}{{1, "acme", 10}, {2, "acme"}}))
+			Expect(err).To(MatchError("row 2 has 2 values for 3 columns"))
+			Expect(count()).To(BeZero())
+
+			failing := dataaccess.BulkRowsFunc(func(ctx context.Context) ([]interface{}, bool, error) {
+				return nil, false, errors.New("unreadable")
+			})
+			_, err = db.BulkInsert(ctx, load, failing)
+			Expect(err).To(MatchError("unreadable"))
+		})
+
+		It("should stop when the context is done", func() {
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err := db.BulkInsert(canceled, load, dataaccess.RowsFromChannel(make(chan []interface{})))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should join the transaction carried by the context", func() {
+			err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+				written, err := db.BulkInsert(tx.Context(), load, dataaccess.RowsFromSlice([][]interface{}{{1, "acme", 10}}))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(written).To(BeEquivalentTo(1))
+				return errors.New("undo")
+			})
+			Expect(err).To(MatchError("undo"))
+			Expect(count()).To(BeZero())
+		})
+
+		It("should refuse a load without table or columns", func() {
+			_, err := db.BulkInsert(ctx, dataaccess.BulkLoad{Table: "orders"}, dataaccess.RowsFromSlice(nil))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("upsert", func() {
+		BeforeEach(func() {
+			_, err := db.BulkInsert(ctx, load, dataaccess.RowsFromSlice([][]interface{}{{1, "acme", 10}, {2, "globex", 20}}))
+			Expect(err).NotTo(HaveOccurred())
+			load.ConflictColumns = []string{"id"}
+		})
+
+		It("should update the conflicting rows", func() {
+			load.UpdateColumns = []string{"total"}
+			written, err := db.BulkUpsert(ctx, load, dataaccess.RowsFromSlice([][]interface{}{{2, "initech", 25}, {3, "initech", 30}}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(BeEquivalentTo(2))
+
+			var rows []orderRow
+			Expect(db.Select(ctx, &rows, "SELECT id, customer, total FROM orders ORDER BY id")).To(Succeed())
+			Expect(rows).To(Equal([]orderRow{
+				{Id: 1, Customer: "acme", Amount: 10},
+				{Id: 2, Customer: "globex", Amount: 25},
+				{Id: 3, Customer: "initech", Amount: 30},
+			}))
+		})
+
+		It("should keep the conflicting rows without update columns", func() {
+			written, err := db.BulkUpsert(ctx, load, dataaccess.RowsFromSlice([][]interface{}{{1, "initech", 99}, {3, "initech", 30}}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(written).To(BeEquivalentTo(1))
+
+			var total int
+			Expect(db.Get(ctx, &total, "SELECT total FROM orders WHERE id = 1")).To(Succeed())
+			Expect(total).To(Equal(10))
+			Expect(count()).To(Equal(3))
+		})
+
+		It("should need a conflict target", func() {
+			load.ConflictColumns = nil
+			_, err := db.BulkUpsert(ctx, load, dataaccess.RowsFromSlice(nil))
+			Expect(err).To(MatchError("an upsert into orders needs conflict columns"))
+		})
+	})
+})
@@ -0,0 +1,372 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jinzhu/gorm"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_DATASOURCE is the data source opened from Configuration.DBConfig
+	DEFAULT_DATASOURCE = "default"
+)
+
+// DataSource is a named database whose connection pool is opened once and shared by the whole
+// process. The *gorm.DB it hands out is safe for concurrent use and must not be closed by callers.
+// DB is the primary, which takes all writes and transactions; Reader spreads reads over replicas.
+type DataSource struct {
+	name string
+	// pools holds the *pool in use, which a credential rotation replaces, see RotateCredentials
+	pools atomic.Value
+	// rotate serializes the rotations and closing the data source
+	rotate sync.Mutex
+	closed bool
+	// draining holds the replaced pools until they are closed
+	draining struct {
+		sync.Mutex
+		pools map[*pool]bool
+	}
+	// next is the round robin position among the replicas
+	next uint32
+}
+
+// pool is the primary and replica pools of a data source opened with one configuration
+type pool struct {
+	config   dbConfiguration
+	db       *gorm.DB
+	replicas []*replica
+	// stop ends the replica health checks
+	stop chan struct{}
+	// sessions counts the connections held by session locks, see sessionConn
+	sessions int32
+}
+
+// registry of the open data sources by name
+var dataSources = struct {
+	sync.Mutex
+	byName map[string]*DataSource
+}{byName: map[string]*DataSource{}}
+
+// RegisterDataSource opens the pool of a new named data source, retrying like Connect
+func RegisterDataSource(name string, config dbConfiguration) (*DataSource, error) {
+	if isRegistered(name) {
+		return nil, fmt.Errorf("data source %q is already registered", name)
+	}
+	ds, err := connectWithRetry(context.Background(), name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSources.Lock()
+	defer dataSources.Unlock()
+	if _, ok := dataSources.byName[name]; ok {
+		ds.close()
+		return nil, fmt.Errorf("data source %q is already registered", name)
+	}
+	dataSources.byName[name] = ds
+	return ds, nil
+}
+
+// GetDataSource returns the named data source, opening it from the loaded configuration on first use.
+// The DEFAULT_DATASOURCE is opened from Configuration.DBConfig, others from Configuration.DataSources.
+func GetDataSource(name string) (*DataSource, error) {
+	return Connect(context.Background(), name)
+}
+
+// Connect returns the named data source like GetDataSource. While the database cannot be reached it
+// retries with exponential backoff until the connect deadline of the configuration passes or ctx
+// is done, so that a service can wait for CF to finish binding its database or abort its startup.
+func Connect(ctx context.Context, name string) (*DataSource, error) {
+	dataSources.Lock()
+	ds, ok := dataSources.byName[name]
+	// read under the lock, a rotation writes the configuration back, see storeConfiguration
+	config, configured := configurationFor(name)
+	dataSources.Unlock()
+	if ok {
+		return ds, nil
+	}
+	if !configured {
+		return nil, fmt.Errorf("no configuration found for data source %q", name)
+	}
+	opened, err := connectWithRetry(ctx, name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	dataSources.Lock()
+	defer dataSources.Unlock()
+	if ds, ok := dataSources.byName[name]; ok {
+		// a concurrent caller won the race
+		opened.close()
+		return ds, nil
+	}
+	dataSources.byName[name] = opened
+	return opened, nil
+}
+
+// PoolStats returns the connection pool statistics of every open data source
+func PoolStats() map[string]sql.DBStats {
+	dataSources.Lock()
+	defer dataSources.Unlock()
+
+	stats := make(map[string]sql.DBStats, len(dataSources.byName))
+	for name, ds := range dataSources.byName {
+		stats[name] = ds.Stats()
+		for _, r := range ds.current().replicas {
+			stats[name+"@"+r.address] = r.db.DB().Stats()
+		}
+	}
+	return stats
+}
+
+// Shutdown closes the pools of all data sources. It is meant to be called once when the service stops.
+func Shutdown() error {
+	dataSources.Lock()
+	defer dataSources.Unlock()
+
+	var firstErr error
+	for name, ds := range dataSources.byName {
+		logger.Debug("Closing data source ", name)
+		if err := ds.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing data source %q: %w", name, err)
+		}
+		delete(dataSources.byName, name)
+	}
+	return firstErr
+}
+
+// Close closes the pools of the data source and unregisters it, e.g. when a test is done with
+// its database. A later Connect opens the data source again.
+func (ds *DataSource) Close() error {
+	dataSources.Lock()
+	if dataSources.byName[ds.name] == ds {
+		delete(dataSources.byName, ds.name)
+	}
+	dataSources.Unlock()
+	return ds.close()
+}
+
+// Name returns the name the data source is registered under
+func (ds *DataSource) Name() string {
+	return ds.name
+}
+
+// Dialect returns the gorm dialect of the data source
+func (ds *DataSource) Dialect() string {
+	return ds.current().config.Dialect()
+}
+
+// DSN returns the data source name of the primary with the password masked, for diagnostics
+func (ds *DataSource) DSN() string {
+	return ds.current().config.redactedDSN()
+}
+
+// DB returns the shared gorm handle of the data source. After a credential rotation it returns
+// the handle of the new pool, so callers should not keep it beyond the work at hand.
+func (ds *DataSource) DB() *gorm.DB {
+	return ds.current().db
+}
+
+// Stats returns the connection pool statistics of the primary of the data source
+func (ds *DataSource) Stats() sql.DBStats {
+	return ds.DB().DB().Stats()
+}
+
+// current returns the pools in use
+func (ds *DataSource) current() *pool {
+	return ds.pools.Load().(*pool)
+}
+
+func (ds *DataSource) close() error {
+	ds.rotate.Lock()
+	defer ds.rotate.Unlock()
+	if ds.closed {
+		return nil
+	}
+	ds.closed = true
+	return ds.current().close()
+}
+
+func (p *pool) close() error {
+	replicaErr := p.closeReplicas()
+	if err := p.db.Close(); err != nil {
+		return err
+	}
+	return replicaErr
+}
+
+func connectWithRetry(ctx context.Context, name string, config dbConfiguration) (*DataSource, error) {
+	deadline := config.ConnectDeadline.Duration
+	if deadline <= 0 {
+		deadline = DEFAULT_CONNECT_DEADLINE
+	}
+	maxInterval := config.RetryMaxInterval.Duration
+	if maxInterval <= 0 {
+		maxInterval = DEFAULT_RETRY_MAX_INTERVAL
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	log := logger.WithFields(logger.Fields{
+		"datasource": name,
+		"dialect":    config.Dialect(),
+		"host":       config.Host,
+		"port":       config.Port,
+		"schema":     config.Schema,
+		"username":   config.Username,
+		"password":   config.redacted().Password,
+	})
+	retry := newBackoff(config.RetryInitialInterval.Duration, maxInterval)
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		log.WithField("attempt", attempt).Info("Connecting to database")
+		ds, err := openDataSource(ctx, name, config)
+		if err == nil {
+			return ds, nil
+		}
+		if _, isConfigErr := err.(configError); isConfigErr {
+			return nil, err
+		}
+		if ctx.Err() == nil || lastErr == nil {
+			// keep the cause of the failure rather than the deadline that cut the last attempt short
+			lastErr = err
+		}
+
+		delay := retry.next()
+		log.WithFields(logger.Fields{"attempt": attempt, "retry_in": delay, "error": err}).Warn("Database connection failed")
+		if waitErr := sleepContext(ctx, delay); waitErr != nil {
+			return nil, fmt.Errorf("connecting data source %q gave up after %d attempts: %v: %w", name, attempt, lastErr, waitErr)
+		}
+	}
+}
+
+// configError reports a configuration that cannot work however often it is retried
+type configError struct {
+	error
+}
+
+func (e configError) Unwrap() error {
+	return e.error
+}
+
+func openDataSource(ctx context.Context, name string, config dbConfiguration) (*DataSource, error) {
+	ds := &DataSource{name: name}
+	p, err := ds.openPool(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	ds.pools.Store(p)
+	return ds, nil
+}
+
+// openPool opens the primary and replica pools of the data source with a configuration
+func (ds *DataSource) openPool(ctx context.Context, config dbConfiguration) (*pool, error) {
+	name := ds.name
+	uri, err := buildDBURI(config)
+	if err != nil {
+		return nil, configError{config.redactError(err)}
+	}
+	sqlDB, err := sql.Open(config.Dialect(), uri)
+	if err != nil {
+		return nil, configError{config.redactError(fmt.Errorf("opening data source %q: %w", name, err))}
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close()
+		return nil, config.redactError(fmt.Errorf("opening data source %q: %w", name, err))
+	}
+	db, err := gorm.Open(config.Dialect(), sqlDB)
+	if err != nil {
+		sqlDB.Close()
+		return nil, config.redactError(fmt.Errorf("opening data source %q: %w", name, err))
+	}
+	applyPoolSettings(sqlDB, config)
+	registerAuditCallbacks(db)
+	registerVersionCallbacks(db)
+	registerEncryptionCallbacks(db)
+
+	p := &pool{config: config, db: db}
+	ds.registerInstrumentation(db)
+	if err := ds.openReplicas(p); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func applyPoolSettings(db *sql.DB, config dbConfiguration) {
+	if config.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if config.ConnMaxLifetime.Duration > 0 {
+		db.SetConnMaxLifetime(config.ConnMaxLifetime.Duration)
+	}
+	if config.ConnMaxIdleTime.Duration > 0 {
+		db.SetConnMaxIdleTime(config.ConnMaxIdleTime.Duration)
+	}
+}
+
+func configurationFor(name string) (dbConfiguration, bool) {
+	GetConfiguration()
+	if name == DEFAULT_DATASOURCE {
+		return Configuration.DBConfig, true
+	}
+	config, ok := Configuration.DataSources[name]
+	return config, ok
+}
+
+func isRegistered(name string) bool {
+	dataSources.Lock()
+	defer dataSources.Unlock()
+	_, ok := dataSources.byName[name]
+	return ok
+}
+
+// storeConfiguration writes the configuration a data source was rotated to back to Configuration,
+// so that opening the data source again after it was closed does not revert the rotation. Data
+// sources registered with a configuration of their own are left out.
+func storeConfiguration(name string, config dbConfiguration) {
+	dataSources.Lock()
+	defer dataSources.Unlock()
+
+	GetConfiguration()
+	if name == DEFAULT_DATASOURCE {
+		Configuration.DBConfig = config
+	} else if _, ok := Configuration.DataSources[name]; ok {
+		Configuration.DataSources[name] = config
+	}
+}
+
+// isManaged reports whether db belongs to the pools of a registered data source, including the
+// pools replaced by a credential rotation that are still draining
+func isManaged(db *gorm.DB) bool {
+	dataSources.Lock()
+	defer dataSources.Unlock()
+
+	for _, ds := range dataSources.byName {
+		if ds.current().owns(db) || ds.isDraining(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports whether db is the primary or a replica of the pool
+func (p *pool) owns(db *gorm.DB) bool {
+	if p.db.DB() == db.DB() {
+		return true
+	}
+	for _, r := range p.replicas {
+		if r.db.DB() == db.DB() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const pooledConfig = `{
+	"database": "sqlite3",
+	"schema": ":memory:",
+	"max_open_conns": 4,
+	"max_idle_conns": 2,
+	"conn_max_lifetime": "30m",
+	"conn_max_idle_time": 60000000000,
+	"datasources": {
+		"reporting": {"database": "sqlite", "schema": "file:reporting?mode=memory&cache=shared", "max_open_conns": 1}
+	}
+}`
+
+var _ = Describe("data sources", func() {
+	var location string
+
+	BeforeEach(func() {
+		var err error
+		location, err = ioutil.TempDir("", "dataaccess")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(location, dataaccess.DB_CONFIG_FILE), []byte(pooledConfig), 0600)).To(Succeed())
+		Expect(dataaccess.LoadDBConfigurationFromFile(location)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+		os.RemoveAll(location)
+	})
+
+	It("reads pool settings and named data sources from the config file", func() {
+		config := dataaccess.Configuration.DBConfig
+		Expect(config.MaxOpenConns).To(Equal(4))
+		Expect(config.ConnMaxLifetime.Duration).To(Equal(30 * time.Minute))
+		Expect(config.ConnMaxIdleTime.Duration).To(Equal(time.Minute))
+		Expect(dataaccess.Configuration.DataSources).To(HaveKey("reporting"))
+	})
+
+	It("shares one pool between callers", func() {
+		first := dataaccess.GetConnection()
+		second := dataaccess.GetConnection()
+		Expect(first.DB()).To(BeIdenticalTo(second.DB()))
+
+		dataaccess.CloseConnection(first)
+		Expect(second.DB().Ping()).To(Succeed())
+	})
+
+	It("applies the pool settings and reports statistics per data source", func() {
+		_, err := dataaccess.GetDataSource(dataaccess.DEFAULT_DATASOURCE)
+		Expect(err).NotTo(HaveOccurred())
+		reporting, err := dataaccess.GetDataSource("reporting")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reporting.Dialect()).To(Equal(dataaccess.DIALECT_SQLITE))
+
+		stats := dataaccess.PoolStats()
+		Expect(stats).To(HaveLen(2))
+		Expect(stats[dataaccess.DEFAULT_DATASOURCE].MaxOpenConnections).To(Equal(4))
+		Expect(stats["reporting"].MaxOpenConnections).To(Equal(1))
+	})
+
+	It("registers additional data sources once", func() {
+		config := dataaccess.Configuration.DBConfig
+		config.Schema = "file:audit?mode=memory&cache=shared"
+		_, err := dataaccess.RegisterDataSource("audit", config)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = dataaccess.RegisterDataSource("audit", config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails for unknown data sources", func() {
+		_, err := dataaccess.GetDataSource("unknown")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("closes all pools on shutdown", func() {
+		db := dataaccess.GetConnection()
+		Expect(dataaccess.Shutdown()).To(Succeed())
+		Expect(db.DB().Ping()).NotTo(Succeed())
+		Expect(dataaccess.PoolStats()).To(BeEmpty())
+	})
+})
+
+const unreachableConfig = `{
+	"database": "postgres",
+	"host": "127.0.0.1",
+	"port": "1",
+	"username": "svc",
+	"password": "secret",
+	"sslmode": "disable",
+	"connect_deadline": "300ms",
+	"retry_initial_interval": "20ms"
+}`
+
+var _ = Describe("connecting with retries", func() {
+	var location string
+
+	BeforeEach(func() {
+		var err error
+		location, err = ioutil.TempDir("", "dataaccess")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(location, dataaccess.DB_CONFIG_FILE), []byte(unreachableConfig), 0600)).To(Succeed())
+		Expect(dataaccess.LoadDBConfigurationFromFile(location)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(location)
+	})
+
+	It("returns the wrapped error once the deadline passes", func() {
+		start := time.Now()
+		_, err := dataaccess.Connect(context.Background(), dataaccess.DEFAULT_DATASOURCE)
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("connection refused"))
+		Expect(err.Error()).NotTo(ContainSubstring("secret"))
+		Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+	})
+
+	It("stops retrying when the context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := dataaccess.Connect(ctx, dataaccess.DEFAULT_DATASOURCE)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	})
+
+	It("does not retry configurations that can never work", func() {
+		config := dataaccess.Configuration.DBConfig
+		config.Database = "oracle"
+		start := time.Now()
+		_, err := dataaccess.RegisterDataSource("oracle", config)
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+})
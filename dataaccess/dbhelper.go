@@ -3,13 +3,24 @@ package dataaccess
 import (
 	"shakilakhtar/go-microservices-platform/utils"
 	logger "github.com/sirupsen/logrus"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"sync"
-	"bytes"
+	"time"
 )
 
 type (
 	configuration struct {
 		DBConfig dbConfiguration
+		// additional named data sources, read from the "datasources" object of the config file
+		DataSources map[string]dbConfiguration `json:"datasources"`
+		// keys of the encrypted fields, see KeyringFromConfiguration
+		Encryption keyringConfiguration `json:"encryption"`
+		// Source tells where the connection settings of DBConfig came from
+		Source string `json:"-"`
 	}
 
 	dbConfiguration struct {
@@ -20,52 +31,201 @@ type (
 		Username string `json:"username"`
 		Password string `json:"password"`
 		SSLMode  string `json:"sslmode"`
+		// client TLS material, used by the verify-ca and verify-full ssl modes
+		SSLRootCert string `json:"sslrootcert"`
+		SSLCert     string `json:"sslcert"`
+		SSLKey      string `json:"sslkey"`
+		// schemas searched for unqualified names, postgres only
+		SearchPath string `json:"search_path"`
+		// connection pool settings, zero leaves the database/sql default in place
+		MaxOpenConns    int      `json:"max_open_conns"`
+		MaxIdleConns    int      `json:"max_idle_conns"`
+		ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+		ConnMaxIdleTime Duration `json:"conn_max_idle_time"`
+		// connect retries, see Connect
+		ConnectDeadline      Duration `json:"connect_deadline"`
+		RetryInitialInterval Duration `json:"retry_initial_interval"`
+		RetryMaxInterval     Duration `json:"retry_max_interval"`
+		// retries of transactions failing with a serialization error, see WithTransaction
+		TxMaxRetries int `json:"tx_max_retries"`
+		// read replicas and how reads are spread over them, see DataSource.Reader
+		Replicas              []replicaConfiguration `json:"replicas"`
+		ReplicaPolicy         string                 `json:"replica_policy"`
+		ReplicaHealthInterval Duration               `json:"replica_health_interval"`
+		// queries taking longer are logged, negative to log none, see DEFAULT_SLOW_QUERY_THRESHOLD
+		SlowQueryThreshold Duration `json:"slow_query_threshold"`
+		// pass the caller of every transaction on to row-level security policies, postgres only,
+		// see RowLevelSecurityPolicySQL. Repositories and SQL then need a transaction.
+		RowLevelSecurity bool `json:"row_level_security"`
+	}
+
+	// Duration is a time.Duration read from JSON either as a string such as "5m" or as nanoseconds
+	Duration struct {
+		time.Duration
 	}
 )
 
 const (
 	DB_CONFIG_FILE = "dbconfig.json"
+
+	DEFAULT_CONNECT_DEADLINE       = 30 * time.Second
+	DEFAULT_RETRY_INITIAL_INTERVAL = 500 * time.Millisecond
+	DEFAULT_RETRY_MAX_INTERVAL     = 10 * time.Second
+	REDACTED                       = "*****"
 )
 
 //A singleton context
 var Configuration *configuration
 var once sync.Once
 
-// Load application configurations from config files and decode into context
-func LoadDBConfigurationFromFile(location string) {
+// LoadDBConfiguration configures the data sources from the database service bound to the app when
+// running on CF, and from the config file in location otherwise. The service is selected by the
+// DB_SERVICE environment variable, "postgres" by default; pool and retry settings are read from the
+// config file in both cases when it exists. Environment variables such as DB_HOST or DB_PASSWORD_FILE
+// override both, see applyEnvOverrides, and without a config file they suffice on their own.
+// It returns the source the settings came from, which is also kept in Configuration.Source.
+func LoadDBConfiguration(location string) (string, error) {
+	GetConfiguration()
+	if location == "" {
+		location = "config"
+	}
+	onCF := hasBoundServices()
+
+	if err := LoadDBConfigurationFromFile(location); err != nil {
+		// the file is optional when the connection settings come from elsewhere
+		if !errors.Is(err, os.ErrNotExist) || !onCF && !hasEnvOverrides(DB_ENV_PREFIX) {
+			return "", err
+		}
+		Configuration.Source = ""
+	}
+	if onCF {
+		selector := os.Getenv(DB_SERVICE_ENV)
+		if selector == "" {
+			selector = DEFAULT_DB_SERVICE
+		}
+		if err := LoadDBConfigurationFromVCAP(selector); err != nil {
+			return "", err
+		}
+	}
+
+	applied, err := applyEnvOverrides(&Configuration.DBConfig, DB_ENV_PREFIX)
+	if err != nil {
+		return "", err
+	}
+	for name, config := range Configuration.DataSources {
+		overrides, err := applyEnvOverrides(&config, envPrefix(name))
+		if err != nil {
+			return "", err
+		}
+		Configuration.DataSources[name] = config
+		applied = append(applied, overrides...)
+	}
+	if len(applied) > 0 {
+		overrides := "environment " + strings.Join(applied, ", ")
+		if Configuration.Source == "" {
+			Configuration.Source = overrides
+		} else {
+			Configuration.Source += " with " + overrides
+		}
+	}
+
+	logger.Info("Database configuration loaded from ", Configuration.Source)
+	return Configuration.Source, nil
+}
+
+// Load application configurations from config files and decode into context. A missing or invalid
+// file is returned as an error rather than leaving the configuration empty.
+func LoadDBConfigurationFromFile(location string) error {
 	GetConfiguration()
 	if location == "" {
-		logger.Info("location found empty trying with default db configuration %s", DB_CONFIG_FILE)
+		logger.Infof("location found empty trying with default db configuration %s", DB_CONFIG_FILE)
 		location = "config"
 	}
+	file := location + "/" + DB_CONFIG_FILE
 	//load database configurations from default config file
-	utils.LoadConfig(location+"/"+DB_CONFIG_FILE, &Configuration.DBConfig)
-	//else{
-	//   //load database configurations
-	//   loadConfig(configFile, &Configuration.DBConfig)
-	// }
+	if err := utils.LoadConfig(file, &Configuration.DBConfig); err != nil {
+		return err
+	}
+	if err := utils.LoadConfig(file, Configuration); err != nil {
+		return err
+	}
+	Configuration.Source = "file " + file
+	return nil
+}
+
+//Prepare Database connection URI from config details, using the DSN builder of the configured dialect,
+//and register the TLS settings the driver connects with
+func buildDBURI(config dbConfiguration) (string, error) {
+	uri, err := buildDSN(config)
+	if err != nil {
+		return "", err
+	}
+	if err := registerMySQLTLS(config); err != nil {
+		return "", err
+	}
+
+	logger.Debug("Database connection URI ", config.redactedDSN())
 
+	return uri, nil
 }
 
-//Prepare Database connection URI from config details
-func buildDBURI() string {
-	var buffer bytes.Buffer
-	buffer.WriteString("host=")
-	buffer.WriteString(Configuration.DBConfig.Host)
-	buffer.WriteString(" port=")
-	buffer.WriteString(Configuration.DBConfig.Port)
-	buffer.WriteString(" user=")
-	buffer.WriteString(Configuration.DBConfig.Username)
-	buffer.WriteString(" dbname=")
-	buffer.WriteString(Configuration.DBConfig.Schema)
-	buffer.WriteString(" sslmode=")
-	buffer.WriteString(Configuration.DBConfig.SSLMode)
-	buffer.WriteString(" password=")
-	buffer.WriteString(Configuration.DBConfig.Password)
-
-	logger.Info("Database connection URI", "DBURI", buffer.String())
-
-	return buffer.String()
+// redacted returns a copy of the configuration that is safe to log
+func (c dbConfiguration) redacted() dbConfiguration {
+	if c.Password != "" {
+		c.Password = REDACTED
+	}
+	if len(c.Replicas) > 0 {
+		// the replicas are shared with the original configuration
+		c.Replicas = append([]replicaConfiguration(nil), c.Replicas...)
+		for i := range c.Replicas {
+			if c.Replicas[i].Password != "" {
+				c.Replicas[i].Password = REDACTED
+			}
+		}
+	}
+	return c
+}
+
+// redactedDSN returns the data source name with the password masked
+func (c dbConfiguration) redactedDSN() string {
+	dsn, err := buildDSN(c.redacted())
+	if err != nil {
+		return ""
+	}
+	return dsn
+}
+
+// redactedError masks the password wherever a driver repeats it in an error message
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e redactedError) Error() string {
+	return e.message
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with every occurrence of the password of the configuration masked
+func (c dbConfiguration) redactError(err error) error {
+	if err == nil || c.Password == "" || !strings.Contains(err.Error(), c.Password) {
+		return err
+	}
+	return redactedError{message: strings.Replace(err.Error(), c.Password, REDACTED, -1), err: err}
+}
+
+// String masks the password so that configurations can be logged and printed safely
+func (c dbConfiguration) String() string {
+	type plain dbConfiguration
+	return fmt.Sprintf("%+v", plain(c.redacted()))
+}
+
+// GoString masks the password when printed with %#v
+func (c dbConfiguration) GoString() string {
+	return c.String()
 }
 
 // GetInstance returns a singleton instance of configuration.
@@ -78,3 +238,27 @@ func GetConfiguration() *configuration {
 	return Configuration
 
 }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		d.Duration = time.Duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.Duration = parsed
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Package dbtest stands up isolated databases for tests of data access code. A database is an
+// in-memory SQLite database, or a temporary schema of the local postgres named by DBTEST_URL_ENV.
+// It is migrated, loaded with fixtures and rolled back or cleaned between tests:
+//
+//	var db *dbtest.Database
+//	var ctx context.Context
+//
+//	BeforeEach(func() {
+//		var err error
+//		db, err = dbtest.New(dbtest.Options{Models: []interface{}{&Order{}}})
+//		Expect(err).NotTo(HaveOccurred())
+//		ctx, err = db.Begin(context.Background())
+//		Expect(err).NotTo(HaveOccurred())
+//		Expect(db.LoadFixtures(ctx, "testdata/orders.yml")).To(Succeed())
+//	})
+//
+//	AfterEach(func() {
+//		Expect(db.Close()).To(Succeed())
+//	})
+//
+//	It("ships orders", func() {
+//		...
+//		Expect(db.Rows(ctx, "orders")).To(dbtest.ContainRow(dbtest.Row{"status": "shipped"}))
+//	})
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	"shakilakhtar/go-microservices-platform/dataaccess/migrate"
+)
+
+const (
+	// DBTEST_URL_ENV names a local postgres database whose temporary schemas isolate the tests,
+	// e.g. postgres://postgres@localhost:5432/test?sslmode=disable. Without it tests use SQLite.
+	DBTEST_URL_ENV = "DBTEST_URL"
+
+	// SCHEMA_PREFIX prefixes the temporary schemas, so that schemas left behind by a crashed test
+	// run can be found and dropped
+	SCHEMA_PREFIX = "dbtest_"
+)
+
+var databaseCount int64
+
+// Options set up a test database
+type Options struct {
+	// Migrations applied to the database
+	Migrations []*migrate.Migration
+	// Models whose tables gorm creates after the migrations
+	Models []interface{}
+	// Fixtures loaded after the tables are created and kept by Rollback
+	Fixtures []string
+}
+
+// Database is an isolated database for a test or a suite. The embedded data source is registered
+// under the name of the database, so that code connecting by name finds it.
+type Database struct {
+	*dataaccess.DataSource
+	// schema is the temporary postgres schema, empty for SQLite
+	schema string
+	tx     *dataaccess.Tx
+}
+
+// New creates an isolated database, applies the migrations, creates the tables of the models and
+// loads the fixtures
+func New(options Options) (*Database, error) {
+	name := fmt.Sprintf("%s%d_%d", SCHEMA_PREFIX, os.Getpid(), atomic.AddInt64(&databaseCount, 1))
+
+	config := dataaccess.GetConfiguration().DBConfig
+	config.Database = dataaccess.DIALECT_SQLITE
+	config.Schema = fmt.Sprintf("file:%s?mode=memory&cache=shared", name)
+	config.Replicas = nil
+	schema := ""
+	if url := os.Getenv(DBTEST_URL_ENV); url != "" {
+		var err error
+		if config, err = dataaccess.ConfigurationFromURI(url); err != nil {
+			return nil, fmt.Errorf("%s: %w", DBTEST_URL_ENV, err)
+		}
+		if config.Dialect() != dataaccess.DIALECT_POSTGRES {
+			return nil, fmt.Errorf("%s: temporary schemas need postgres, not %s", DBTEST_URL_ENV, config.Dialect())
+		}
+		// connections search the schema once it exists
+		schema = name
+		config.SearchPath = schema
+	}
+
+	ds, err := dataaccess.RegisterDataSource(name, config)
+	if err != nil {
+		return nil, err
+	}
+	db := &Database{DataSource: ds, schema: schema}
+	if err := db.setUp(options); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *Database) setUp(options Options) error {
+	if db.schema != "" {
+		if err := db.DB().Exec("CREATE SCHEMA " + db.quote(db.schema)).Error; err != nil {
+			return err
+		}
+	}
+	if len(options.Migrations) > 0 {
+		migrator, err := migrate.New(db.DB().DB(), db.Dialect(), options.Migrations)
+		if err != nil {
+			return err
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			return err
+		}
+	}
+	if len(options.Models) > 0 {
+		if err := db.DB().AutoMigrate(options.Models...).Error; err != nil {
+			return err
+		}
+	}
+	return db.LoadFixtures(context.Background(), options.Fixtures...)
+}
+
+// Begin starts the transaction of a test and returns the context carrying it. Repositories, SQL
+// helpers and fixtures given the context write into the transaction, and Rollback or Close
+// discard everything written.
+func (db *Database) Begin(ctx context.Context) (context.Context, error) {
+	if db.tx != nil {
+		return nil, fmt.Errorf("database %s already has a transaction", db.Name())
+	}
+	tx, err := db.DataSource.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db.tx = tx
+	return tx.Context(), nil
+}
+
+// Rollback discards what was written with the context returned by Begin
+func (db *Database) Rollback() error {
+	if db.tx == nil {
+		return nil
+	}
+	err := db.tx.Rollback().Error
+	db.tx = nil
+	return err
+}
+
+// Close rolls back the transaction of the test, drops the temporary schema and closes the database
+func (db *Database) Close() error {
+	err := db.Rollback()
+	if db.schema != "" {
+		if dropErr := db.DB().Exec("DROP SCHEMA IF EXISTS " + db.quote(db.schema) + " CASCADE").Error; err == nil {
+			err = dropErr
+		}
+	}
+	if closeErr := db.DataSource.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Clean deletes the rows of every table but the migration ledger, for tests that have to commit
+// and cannot be rolled back
+func (db *Database) Clean(ctx context.Context) error {
+	tables, err := db.tables(ctx)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if table == migrate.DEFAULT_TABLE || table == migrate.DEFAULT_TABLE+"_lock" {
+			continue
+		}
+		if _, err := db.SQL().Exec(ctx, "DELETE FROM "+db.quote(table)); err != nil {
+			return fmt.Errorf("cleaning %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Rows returns the rows of a table, read in the transaction carried by ctx
+func (db *Database) Rows(ctx context.Context, table string) ([]Row, error) {
+	var rows []Row
+	err := db.SQL().Select(ctx, &rows, "SELECT * FROM "+db.quote(table)+" ORDER BY 1")
+	return rows, err
+}
+
+func (db *Database) quote(name string) string {
+	return db.DB().Dialect().Quote(name)
+}
+
+// tables returns the names of the tables of the database
+func (db *Database) tables(ctx context.Context) ([]string, error) {
+	query := `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+	if db.schema != "" {
+		query = `SELECT tablename FROM pg_tables WHERE schemaname = current_schema() ORDER BY tablename`
+	}
+	var tables []string
+	err := db.SQL().Select(ctx, &tables, query)
+	return tables, err
+}
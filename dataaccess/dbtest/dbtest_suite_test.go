@@ -0,0 +1,13 @@
+package dbtest_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestDBTest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "dbtest")
+}
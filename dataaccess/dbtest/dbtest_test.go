@@ -0,0 +1,111 @@
+package dbtest_test
+
+import (
+	"context"
+	"database/sql"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	"shakilakhtar/go-microservices-platform/dataaccess/dbtest"
+	"shakilakhtar/go-microservices-platform/dataaccess/migrate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type customer struct {
+	ID   uint `gorm:"primary_key"`
+	Name string
+}
+
+var createOrders = migrate.NewGoMigration(1, "create_orders", func(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE orders (id INTEGER PRIMARY KEY, customer_id INTEGER, status TEXT, total INTEGER, note TEXT)")
+	return err
+}, func(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE orders")
+	return err
+})
+
+var _ = Describe("dbtest", func() {
+	var (
+		db  *dbtest.Database
+		ctx context.Context
+	)
+
+	BeforeEach(func() {
+		var err error
+		db, err = dbtest.New(dbtest.Options{
+			Migrations: []*migrate.Migration{createOrders},
+			Models:     []interface{}{&customer{}},
+			Fixtures:   []string{"testdata/customers.yml"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		ctx, err = db.Begin(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(db.Close()).To(Succeed())
+	})
+
+	It("should migrate and load the fixtures", func() {
+		Expect(db.Rows(ctx, "customers")).To(dbtest.ConsistOfRows(
+			dbtest.Row{"id": 1, "name": "acme"},
+			dbtest.Row{"id": 2, "name": "globex"},
+		))
+		Expect(db.Rows(ctx, "orders")).To(ConsistOf(
+			dbtest.MatchRow(dbtest.Row{"customer_id": 1, "status": "open", "total": BeNumerically("<", 20), "note": nil}),
+			dbtest.MatchRow(dbtest.Row{"customer_id": 2, "status": "shipped"}),
+		))
+	})
+
+	It("should register the data source under the name of the database", func() {
+		ds, err := dataaccess.GetDataSource(db.Name())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds).To(BeIdenticalTo(db.DataSource))
+	})
+
+	It("should roll back what the test wrote", func() {
+		Expect(db.LoadFixtures(ctx, "testdata/orders.json")).To(Succeed())
+		Expect(db.Rows(ctx, "orders")).To(dbtest.ContainRow(dbtest.Row{"status": "canceled", "total": 30}))
+
+		_, err := db.Begin(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("already has a transaction")))
+
+		Expect(db.Rollback()).To(Succeed())
+		rows, err := db.Rows(context.Background(), "orders")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rows).To(HaveLen(2))
+		Expect(rows).NotTo(dbtest.ContainRow(dbtest.Row{"status": "canceled"}))
+	})
+
+	It("should isolate the databases", func() {
+		other, err := dbtest.New(dbtest.Options{Models: []interface{}{&customer{}}})
+		Expect(err).NotTo(HaveOccurred())
+		defer other.Close()
+		Expect(other.Name()).NotTo(Equal(db.Name()))
+		Expect(other.Rows(context.Background(), "customers")).To(BeEmpty())
+	})
+
+	It("should clean the tables but the migration ledger", func() {
+		Expect(db.Rollback()).To(Succeed())
+		Expect(db.Clean(context.Background())).To(Succeed())
+		Expect(db.Rows(context.Background(), "customers")).To(BeEmpty())
+		Expect(db.Rows(context.Background(), "orders")).To(BeEmpty())
+		Expect(db.Rows(context.Background(), migrate.DEFAULT_TABLE)).To(HaveLen(1))
+	})
+
+	It("should report fixtures that cannot be loaded", func() {
+		Expect(db.LoadFixtures(ctx, "testdata/missing.yml")).To(MatchError(ContainSubstring("reading fixture")))
+		Expect(db.LoadFixtures(ctx, "dbtest_test.go")).To(HaveOccurred())
+	})
+
+	It("should describe the column that did not match", func() {
+		matcher := dbtest.MatchRow(dbtest.Row{"name": "acme", "status": "open"})
+		Expect(matcher.Match(dbtest.Row{"name": "acme"})).To(BeFalse())
+		Expect(matcher.FailureMessage(dbtest.Row{"name": "acme"})).To(ContainSubstring("has no column status"))
+		Expect(matcher.Match(dbtest.Row{"name": "initech", "status": "open"})).To(BeFalse())
+		Expect(matcher.FailureMessage(dbtest.Row{"name": "initech"})).To(ContainSubstring("column name"))
+		_, err := matcher.Match("acme")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,80 @@
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadFixtures inserts the rows of YAML or JSON fixture files, with ctx so that fixtures loaded
+// with the context returned by Begin are rolled back with the test. A fixture maps tables to their
+// rows, which are inserted in the order of the file:
+//
+//	customers:
+//	  - id: 1
+//	    name: acme
+//	orders:
+//	  - customer_id: 1
+//	    status: open
+func (db *Database) LoadFixtures(ctx context.Context, paths ...string) error {
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading fixture: %w", err)
+		}
+		if err := db.loadFixture(ctx, content); err != nil {
+			return fmt.Errorf("loading fixture %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// loadFixture inserts the rows of one fixture. JSON is read as YAML, of which it is a subset.
+func (db *Database) loadFixture(ctx context.Context, content []byte) error {
+	var tables yaml.MapSlice
+	if err := yaml.Unmarshal(content, &tables); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		name := fmt.Sprint(table.Key)
+		rows, ok := table.Value.([]interface{})
+		if !ok && table.Value != nil {
+			return fmt.Errorf("the rows of table %s are not a list", name)
+		}
+		for i, row := range rows {
+			columns, ok := row.(yaml.MapSlice)
+			if !ok {
+				return fmt.Errorf("row %d of table %s is not a map", i+1, name)
+			}
+			if err := db.insert(ctx, name, columns); err != nil {
+				return fmt.Errorf("row %d of table %s: %w", i+1, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Database) insert(ctx context.Context, table string, columns yaml.MapSlice) error {
+	values := make(map[string]interface{}, len(columns))
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		name := fmt.Sprint(column.Key)
+		values[name] = column.Value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	quoted := make([]string, len(names))
+	params := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = db.quote(name)
+		params[i] = ":" + name
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", db.quote(table), strings.Join(quoted, ", "), strings.Join(params, ", "))
+	_, err := db.SQL().Exec(ctx, query, values)
+	return err
+}
@@ -0,0 +1,104 @@
+package dbtest
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/onsi/gomega"
+	"github.com/onsi/gomega/format"
+	"github.com/onsi/gomega/types"
+)
+
+// Row is a row read by Rows, or the expected columns of a row. An expected column is a gomega
+// matcher or a value the column has to be equivalent to, so that integers match whatever integer
+// type the driver returns.
+type Row map[string]interface{}
+
+// MatchRow succeeds if a row has the expected columns. Columns that are not expected are ignored.
+func MatchRow(expected Row) types.GomegaMatcher {
+	return &rowMatcher{expected: expected}
+}
+
+// ContainRow succeeds if rows contain a row matching the expected columns
+func ContainRow(expected Row) types.GomegaMatcher {
+	return gomega.ContainElement(MatchRow(expected))
+}
+
+// ConsistOfRows succeeds if every row matches exactly one of the expected rows, in any order
+func ConsistOfRows(expected ...Row) types.GomegaMatcher {
+	matchers := make([]interface{}, len(expected))
+	for i, row := range expected {
+		matchers[i] = MatchRow(row)
+	}
+	return gomega.ConsistOf(matchers...)
+}
+
+type rowMatcher struct {
+	expected Row
+	// failure describes the first column that did not match
+	failure string
+}
+
+func (m *rowMatcher) Match(actual interface{}) (bool, error) {
+	row, ok := actual.(Row)
+	if !ok {
+		columns, isMap := actual.(map[string]interface{})
+		if !isMap {
+			return false, fmt.Errorf("MatchRow expects a dbtest.Row, got\n%s", format.Object(actual, 1))
+		}
+		row = columns
+	}
+
+	names := make([]string, 0, len(m.expected))
+	for name := range m.expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, found := row[name]
+		if !found {
+			m.failure = fmt.Sprintf("has no column %s", name)
+			return false, nil
+		}
+		matcher := columnMatcher(m.expected[name])
+		matched, err := matcher.Match(normalize(value))
+		if err != nil {
+			return false, fmt.Errorf("column %s: %w", name, err)
+		}
+		if !matched {
+			m.failure = fmt.Sprintf("column %s: %s", name, matcher.FailureMessage(normalize(value)))
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *rowMatcher) FailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n%s\nto match row\n%s\nbut it %s", format.Object(actual, 1), format.Object(m.expected, 1), m.failure)
+}
+
+func (m *rowMatcher) NegatedFailureMessage(actual interface{}) string {
+	return fmt.Sprintf("Expected\n%s\nnot to match row\n%s", format.Object(actual, 1), format.Object(m.expected, 1))
+}
+
+// columnMatcher returns the matcher of an expected column
+func columnMatcher(expected interface{}) types.GomegaMatcher {
+	switch expected := expected.(type) {
+	case types.GomegaMatcher:
+		return expected
+	case nil:
+		return gomega.BeNil()
+	case []byte:
+		return gomega.BeEquivalentTo(string(expected))
+	default:
+		return gomega.BeEquivalentTo(expected)
+	}
+}
+
+// normalize reads the text columns some drivers return as bytes as strings
+func normalize(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return value
+}
@@ -0,0 +1,257 @@
+package dataaccess
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	DIALECT_POSTGRES = "postgres"
+	DIALECT_MYSQL    = "mysql"
+	DIALECT_SQLITE   = "sqlite3"
+	DIALECT_MSSQL    = "mssql"
+
+	SSL_DISABLE     = "disable"
+	SSL_REQUIRE     = "require"
+	SSL_VERIFY_CA   = "verify-ca"
+	SSL_VERIFY_FULL = "verify-full"
+
+	// SQLITE_MEMORY as the schema of a sqlite configuration selects a shared in-memory database
+	SQLITE_MEMORY = ":memory:"
+)
+
+// dsnBuilder turns a database configuration into a driver specific data source name
+type dsnBuilder func(config dbConfiguration) (string, error)
+
+var dsnBuilders = map[string]dsnBuilder{
+	DIALECT_POSTGRES: buildPostgresDSN,
+	DIALECT_MYSQL:    buildMySQLDSN,
+	DIALECT_SQLITE:   buildSQLiteDSN,
+	DIALECT_MSSQL:    buildMSSQLDSN,
+}
+
+var dialectAliases = map[string]string{
+	"postgresql": DIALECT_POSTGRES,
+	"pg":         DIALECT_POSTGRES,
+	"sqlite":     DIALECT_SQLITE,
+	"sqlserver":  DIALECT_MSSQL,
+}
+
+// Dialect returns the normalized gorm dialect name of the configuration, e.g. "sqlite" becomes "sqlite3"
+func (c dbConfiguration) Dialect() string {
+	dialect := strings.ToLower(strings.TrimSpace(c.Database))
+	if alias, ok := dialectAliases[dialect]; ok {
+		return alias
+	}
+	return dialect
+}
+
+// buildDSN prepares the data source name for the dialect of the configuration
+func buildDSN(config dbConfiguration) (string, error) {
+	builder, ok := dsnBuilders[config.Dialect()]
+	if !ok {
+		return "", fmt.Errorf("unsupported database dialect %q", config.Database)
+	}
+	return builder(config)
+}
+
+// buildPostgresDSN builds a libpq key/value connection string, quoting values where needed
+func buildPostgresDSN(c dbConfiguration) (string, error) {
+	var buffer bytes.Buffer
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if buffer.Len() > 0 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(key)
+		buffer.WriteString("=")
+		buffer.WriteString(quotePostgresValue(value))
+	}
+	add("host", c.Host)
+	add("port", c.Port)
+	add("user", c.Username)
+	add("dbname", c.Schema)
+	add("sslmode", c.SSLMode)
+	add("sslrootcert", c.SSLRootCert)
+	add("sslcert", c.SSLCert)
+	add("sslkey", c.SSLKey)
+	add("search_path", c.SearchPath)
+	add("password", c.Password)
+	return buffer.String(), nil
+}
+
+func quotePostgresValue(value string) string {
+	if !strings.ContainsAny(value, " '\\\t\n") {
+		return value
+	}
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+// buildMySQLDSN builds a go-sql-driver DSN. The driver takes care of escaping.
+func buildMySQLDSN(c dbConfiguration) (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.Net = "tcp"
+	cfg.Addr = hostPort(c, "3306")
+	cfg.DBName = c.Schema
+	// gorm models use time.Time columns
+	cfg.ParseTime = true
+
+	switch c.SSLMode {
+	case "", SSL_DISABLE:
+	case SSL_REQUIRE:
+		cfg.TLSConfig = "skip-verify"
+	case SSL_VERIFY_CA, SSL_VERIFY_FULL:
+		// the configuration itself is registered by registerMySQLTLS when the data source connects
+		cfg.TLSConfig = mysqlTLSConfigName(cfg.Addr)
+	default:
+		return "", fmt.Errorf("unsupported sslmode %q for mysql", c.SSLMode)
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// mysqlTLSConfigName is the name the TLS configuration of a server address is registered under
+func mysqlTLSConfigName(addr string) string {
+	return "dataaccess-" + addr
+}
+
+// registerMySQLTLS registers the TLS configuration of a mysql configuration that verifies the server
+// certificate with the driver, which looks it up by the name in the DSN. Registering changes the
+// state of the driver, so it only happens on connecting rather than on every DSN build.
+func registerMySQLTLS(c dbConfiguration) error {
+	if c.Dialect() != DIALECT_MYSQL || (c.SSLMode != SSL_VERIFY_CA && c.SSLMode != SSL_VERIFY_FULL) {
+		return nil
+	}
+	tlsConfig, err := buildTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(mysqlTLSConfigName(hostPort(c, "3306")), tlsConfig)
+}
+
+// buildSQLiteDSN builds a sqlite URI filename from the schema, which holds the database file.
+// An empty schema or SQLITE_MEMORY selects a shared in-memory database, and a schema that already
+// is a "file:" URI is used as is.
+func buildSQLiteDSN(c dbConfiguration) (string, error) {
+	if strings.HasPrefix(c.Schema, "file:") {
+		return c.Schema, nil
+	}
+
+	params := url.Values{}
+	params.Set("_foreign_keys", "1")
+
+	path := (&url.URL{Path: c.Schema}).EscapedPath()
+	if c.Schema == "" || c.Schema == SQLITE_MEMORY {
+		path = SQLITE_MEMORY
+		params.Set("cache", "shared")
+	}
+	return "file:" + path + "?" + params.Encode(), nil
+}
+
+// buildMSSQLDSN builds a sqlserver:// URL as understood by go-mssqldb
+func buildMSSQLDSN(c dbConfiguration) (string, error) {
+	params := url.Values{}
+	if c.Schema != "" {
+		params.Set("database", c.Schema)
+	}
+
+	switch c.SSLMode {
+	case "":
+	case SSL_DISABLE:
+		params.Set("encrypt", "disable")
+	case SSL_REQUIRE:
+		params.Set("encrypt", "true")
+		params.Set("TrustServerCertificate", "true")
+	case SSL_VERIFY_CA, SSL_VERIFY_FULL:
+		params.Set("encrypt", "true")
+		params.Set("TrustServerCertificate", "false")
+		if c.SSLRootCert != "" {
+			params.Set("certificate", c.SSLRootCert)
+		}
+		if c.SSLMode == SSL_VERIFY_FULL {
+			params.Set("hostNameInCertificate", c.Host)
+		}
+	default:
+		return "", fmt.Errorf("unsupported sslmode %q for mssql", c.SSLMode)
+	}
+
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(c.Username, c.Password),
+		Host:     hostPort(c, "1433"),
+		RawQuery: params.Encode(),
+	}
+	return u.String(), nil
+}
+
+func hostPort(c dbConfiguration, defaultPort string) string {
+	port := c.Port
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(c.Host, port)
+}
+
+// buildTLSConfig creates a client TLS configuration from the ssl settings of the configuration.
+// verify-ca checks the certificate chain only, verify-full also checks the host name.
+func buildTLSConfig(c dbConfiguration) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: c.Host}
+
+	if c.SSLRootCert != "" {
+		pem, err := ioutil.ReadFile(c.SSLRootCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading sslrootcert: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in sslrootcert %s", c.SSLRootCert)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	if c.SSLCert != "" || c.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.SSLCert, c.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.SSLMode == SSL_VERIFY_CA {
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs[i] = cert
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+	return tlsConfig, nil
+}
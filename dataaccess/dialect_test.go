@@ -0,0 +1,103 @@
+package dataaccess_test
+
+import (
+	"net/url"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dialect DSN builders", func() {
+	config := dataaccess.GetConfiguration().DBConfig
+
+	BeforeEach(func() {
+		config = dataaccess.GetConfiguration().DBConfig
+		config.Host = "db.internal"
+		config.Port = "6000"
+		config.Schema = "orders"
+		config.Username = "svc"
+		config.Password = `p@ss w'rd\1`
+	})
+
+	It("quotes postgres values containing spaces, quotes and backslashes", func() {
+		config.Database = "postgresql"
+		config.SSLMode = dataaccess.SSL_VERIFY_FULL
+		config.SSLRootCert = "/etc/ssl/db ca.pem"
+		dsn, err := dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dsn).To(Equal(`host=db.internal port=6000 user=svc dbname=orders sslmode=verify-full sslrootcert='/etc/ssl/db ca.pem' password='p@ss w\'rd\\1'`))
+	})
+
+	It("builds a mysql DSN the driver parses back", func() {
+		config.Database = dataaccess.DIALECT_MYSQL
+		config.SSLMode = dataaccess.SSL_REQUIRE
+		dsn, err := dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		parsed, err := mysql.ParseDSN(dsn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.Passwd).To(Equal(config.Password))
+		Expect(parsed.Addr).To(Equal("db.internal:6000"))
+		Expect(parsed.DBName).To(Equal("orders"))
+		Expect(parsed.TLSConfig).To(Equal("skip-verify"))
+		Expect(parsed.ParseTime).To(BeTrue())
+	})
+
+	It("names the mysql TLS configuration without registering it", func() {
+		config.Database = dataaccess.DIALECT_MYSQL
+		config.SSLMode = dataaccess.SSL_VERIFY_FULL
+		config.SSLRootCert = "/nonexistent/ca.pem"
+		dsn, err := dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the driver only parses a DSN naming a registered configuration
+		_, err = mysql.ParseDSN(dsn)
+		Expect(err).To(MatchError(ContainSubstring("unknown config name: dataaccess-db.internal:6000")))
+	})
+
+	It("builds an escaped sqlserver URL", func() {
+		config.Database = "sqlserver"
+		config.SSLMode = dataaccess.SSL_REQUIRE
+		dsn, err := dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		u, err := url.Parse(dsn)
+		Expect(err).NotTo(HaveOccurred())
+		password, _ := u.User.Password()
+		Expect(password).To(Equal(config.Password))
+		Expect(u.Query().Get("database")).To(Equal("orders"))
+		Expect(u.Query().Get("encrypt")).To(Equal("true"))
+	})
+
+	It("builds sqlite URIs for files and shared memory", func() {
+		config.Database = "sqlite"
+		config.Schema = "/tmp/my db.sqlite"
+		dsn, err := dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dsn).To(Equal("file:/tmp/my%20db.sqlite?_foreign_keys=1"))
+
+		config.Schema = dataaccess.SQLITE_MEMORY
+		dsn, err = dataaccess.BuildDSN(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dsn).To(Equal("file::memory:?_foreign_keys=1&cache=shared"))
+	})
+
+	It("rejects unknown dialects", func() {
+		config.Database = "oracle"
+		_, err := dataaccess.BuildDSN(config)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("opens a sqlite connection without an external database", func() {
+		dataaccess.Configuration.DBConfig.Database = dataaccess.DIALECT_SQLITE
+		dataaccess.Configuration.DBConfig.Schema = dataaccess.SQLITE_MEMORY
+		db := dataaccess.GetConnection()
+		defer dataaccess.Shutdown()
+
+		Expect(db.Exec("CREATE TABLE dialect_check (id integer primary key)").Error).NotTo(HaveOccurred())
+		Expect(db.HasTable("dialect_check")).To(BeTrue())
+	})
+})
@@ -0,0 +1,404 @@
+package dataaccess
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ENCRYPTION_PREFIX starts the values of encrypted fields, followed by the id of the key
+	ENCRYPTION_PREFIX = "enc:v1:"
+	// ENCRYPTION_KEY_SIZE is the size of the keys of a keyring, AES-256
+	ENCRYPTION_KEY_SIZE = 32
+
+	// blindIndexTag names the field a BlindIndex field indexes, e.g. `blind_index:"Email"`
+	blindIndexTag = "blind_index"
+)
+
+var (
+	keyIdPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+	// keyring is the *Keyring of the encrypted fields, see SetKeyring
+	keyring atomic.Value
+
+	errNoKeyring = errors.New("no keyring is set for the encrypted fields, see dataaccess.SetKeyring")
+)
+
+type (
+	// Keyring holds the keys encrypting the fields of type EncryptedString by their ids. Every value
+	// is encrypted with a data key of its own, which is stored with the value encrypted by the primary
+	// key of the keyring together with the id of that key. Values encrypted by any key of the keyring
+	// can be read, so that keys can be rotated: a new primary key is added, ReEncrypt moves the stored
+	// values to it, and the old key is removed once no value uses it.
+	Keyring struct {
+		primary  string
+		keys     map[string]cipher.AEAD
+		indexKey []byte
+	}
+
+	// keyringConfiguration is the "encryption" object of the config file. Keys are base64 encoded.
+	keyringConfiguration struct {
+		// PrimaryKey is the id of the key encrypting new values
+		PrimaryKey string `json:"primary_key"`
+		// Keys and KeyFiles map the ids of the keys to the keys, or to files holding them such as
+		// mounted secrets
+		Keys     map[string]string `json:"keys"`
+		KeyFiles map[string]string `json:"key_files"`
+		// IndexKey is the key of the blind indexes. Unlike the other keys it cannot be rotated
+		// without computing the indexes anew.
+		IndexKey     string `json:"index_key"`
+		IndexKeyFile string `json:"index_key_file"`
+	}
+
+	// EncryptedString is a string stored encrypted with the keyring set by SetKeyring, e.g. a column
+	// holding personal data. Encrypted values are longer than the strings, so columns need a type
+	// such as `gorm:"type:text"`. Equality lookups need a BlindIndex of the field.
+	EncryptedString string
+
+	// BlindIndex is a keyed hash of another field, computed when an entity is created or updated,
+	// which finds entities by the exact value of an encrypted field without decrypting it:
+	//
+	//	Email      dataaccess.EncryptedString `gorm:"type:text"`
+	//	EmailIndex dataaccess.BlindIndex      `gorm:"index" blind_index:"Email"`
+	//
+	// Look entities up by the index of the value, see BlindIndexOf. Values are indexed as they are,
+	// so values differing in case only need normalizing before they are stored and looked up.
+	BlindIndex string
+)
+
+// NewKeyring creates a keyring from keys of ENCRYPTION_KEY_SIZE by their ids. New values are
+// encrypted with the primary key, blind indexes computed with the index key.
+func NewKeyring(primary string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("the primary key %q is not a key of the keyring", primary)
+	}
+	if len(indexKey) != ENCRYPTION_KEY_SIZE {
+		return nil, fmt.Errorf("the index key has %d bytes instead of %d", len(indexKey), ENCRYPTION_KEY_SIZE)
+	}
+	k := &Keyring{primary: primary, keys: make(map[string]cipher.AEAD, len(keys)), indexKey: indexKey}
+	for id, key := range keys {
+		if !keyIdPattern.MatchString(id) {
+			return nil, fmt.Errorf("key id %q is invalid", id)
+		}
+		if len(key) != ENCRYPTION_KEY_SIZE {
+			return nil, fmt.Errorf("key %s has %d bytes instead of %d", id, len(key), ENCRYPTION_KEY_SIZE)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// LocalKeyring creates a keyring with a random primary key "local", e.g. for tests. Values it
+// encrypts cannot be read by any other keyring.
+func LocalKeyring() *Keyring {
+	k, err := NewKeyring("local", map[string][]byte{"local": randomKey()}, randomKey())
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// KeyringFromConfiguration creates the keyring of the "encryption" object of the loaded
+// configuration
+func KeyringFromConfiguration() (*Keyring, error) {
+	GetConfiguration()
+	config := Configuration.Encryption
+	if config.PrimaryKey == "" {
+		return nil, errors.New("the configuration has no encryption keys")
+	}
+	keys := make(map[string][]byte, len(config.Keys)+len(config.KeyFiles))
+	for id, encoded := range config.Keys {
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	for id, path := range config.KeyFiles {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	indexKey, err := decodeKey(config.IndexKey)
+	if config.IndexKeyFile != "" {
+		indexKey, err = readKey(config.IndexKeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("index key: %w", err)
+	}
+	return NewKeyring(config.PrimaryKey, keys, indexKey)
+}
+
+// SetKeyring sets the keyring the encrypted fields of all data sources are encrypted with
+func SetKeyring(k *Keyring) {
+	keyring.Store(k)
+}
+
+func currentKeyring() (*Keyring, error) {
+	k, _ := keyring.Load().(*Keyring)
+	if k == nil {
+		return nil, errNoKeyring
+	}
+	return k, nil
+}
+
+// PrimaryKey returns the id of the key encrypting new values
+func (k *Keyring) PrimaryKey() string {
+	return k.primary
+}
+
+// Encrypt encrypts a value with a new data key, which is encrypted with the primary key
+func (k *Keyring) Encrypt(plaintext []byte) (string, error) {
+	dataKey := randomKey()
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, plaintext, nil)
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dataKey, sealed)
+}
+
+// Decrypt decrypts a value encrypted by any key of the keyring
+func (k *Keyring) Decrypt(ciphertext string) ([]byte, error) {
+	_, dataKey, sealed, err := k.unwrap(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, sealed, nil)
+}
+
+// Rewrap encrypts the data key of a value with the primary key, leaving the value itself as it is.
+// It reports whether the value changed, which it does not when the primary key encrypts it already.
+func (k *Keyring) Rewrap(ciphertext string) (string, bool, error) {
+	id, dataKey, sealed, err := k.unwrap(ciphertext)
+	if err != nil || id == k.primary {
+		return ciphertext, false, err
+	}
+	rewrapped, err := k.wrap(dataKey, sealed)
+	return rewrapped, err == nil, err
+}
+
+// BlindIndex returns the blind index of a value
+func (k *Keyring) BlindIndex(value string) BlindIndex {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(value))
+	return BlindIndex(base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// wrap formats a value as enc:v1:<key id>:<encrypted data key>:<encrypted value>
+func (k *Keyring) wrap(dataKey []byte, sealed []byte) (string, error) {
+	// the key id is authenticated, so that a value cannot be passed off as encrypted by another key
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	return ENCRYPTION_PREFIX + k.primary + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap returns the key id, the decrypted data key and the encrypted value of a value
+func (k *Keyring) unwrap(ciphertext string) (string, []byte, []byte, error) {
+	if !strings.HasPrefix(ciphertext, ENCRYPTION_PREFIX) {
+		return "", nil, nil, errors.New("the value is not encrypted")
+	}
+	parts := strings.Split(strings.TrimPrefix(ciphertext, ENCRYPTION_PREFIX), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("the encrypted value is malformed")
+	}
+	id := parts[0]
+	aead, ok := k.keys[id]
+	if !ok {
+		return id, nil, nil, fmt.Errorf("the value is encrypted with key %q, which is not in the keyring", id)
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return id, nil, nil, errors.New("the encrypted value is malformed")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return id, nil, nil, errors.New("the encrypted value is malformed")
+	}
+	dataKey, err := open(aead, wrapped, []byte(id))
+	if err != nil {
+		return id, nil, nil, fmt.Errorf("decrypting the data key with key %s: %w", id, err)
+	}
+	return id, dataKey, sealed, nil
+}
+
+// Value encrypts the string for the database
+func (s EncryptedString) Value() (driver.Value, error) {
+	k, err := currentKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return k.Encrypt([]byte(s))
+}
+
+// Scan decrypts a value read from the database. NULL is read as the empty string.
+func (s *EncryptedString) Scan(value interface{}) error {
+	var ciphertext string
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+		return nil
+	case []byte:
+		ciphertext = string(v)
+	case string:
+		ciphertext = v
+	default:
+		return fmt.Errorf("cannot decrypt a value of type %T", value)
+	}
+	k, err := currentKeyring()
+	if err != nil {
+		return err
+	}
+	plaintext, err := k.Decrypt(ciphertext)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// BlindIndexOf returns the blind index of a value with the keyring set by SetKeyring, e.g. to find
+// the entities whose encrypted field has the value
+func BlindIndexOf(value string) (BlindIndex, error) {
+	k, err := currentKeyring()
+	if err != nil {
+		return "", err
+	}
+	return k.BlindIndex(value), nil
+}
+
+// registerEncryptionCallbacks installs the callbacks computing the blind indexes on the handle of a
+// data source
+func registerEncryptionCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().After("gorm:update_time_stamp").Register("dataaccess:blind_index_create", blindIndexCallback)
+	callbacks.Update().After("gorm:update_time_stamp").Register("dataaccess:blind_index_update", blindIndexCallback)
+}
+
+// blindIndexCallback sets the blind indexes of the fields that are written
+func blindIndexCallback(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	attrs, updating := scope.InstanceGet("gorm:update_attrs")
+	for _, field := range scope.Fields() {
+		source := field.Tag.Get(blindIndexTag)
+		if source == "" {
+			continue
+		}
+		sourceField, ok := scope.FieldByName(source)
+		if !ok {
+			scope.Err(fmt.Errorf("the blind index %s indexes the unknown field %s", field.Name, source))
+			return
+		}
+		value := sourceField.Field
+		if updating {
+			// an update of some columns only changes the index along with its field
+			attr, ok := attrs.(map[string]interface{})[sourceField.DBName]
+			if !ok {
+				continue
+			}
+			value = reflect.ValueOf(attr)
+		}
+		value = reflect.Indirect(value)
+		if value.Kind() != reflect.String {
+			scope.Err(fmt.Errorf("the blind index %s indexes %s, which is no string", field.Name, source))
+			return
+		}
+		k, err := currentKeyring()
+		if err != nil {
+			scope.Err(err)
+			return
+		}
+		scope.SetColumn(field.Name, k.BlindIndex(value.String()))
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it puts in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("the encrypted value is malformed")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+func randomKey() []byte {
+	key := make([]byte, ENCRYPTION_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(fmt.Errorf("reading random key: %w", err))
+	}
+	return key
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("the key is not base64 encoded: %w", err)
+	}
+	return key, nil
+}
+
+func readKey(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(string(content))
+}
+
+// String keeps the keys out of logs
+func (c keyringConfiguration) String() string {
+	return fmt.Sprintf("{PrimaryKey:%s Keys:%d KeyFiles:%v}", c.PrimaryKey, len(c.Keys), c.KeyFiles)
+}
+
+// GoString keeps the keys out of logs
+func (c keyringConfiguration) GoString() string {
+	return c.String()
+}
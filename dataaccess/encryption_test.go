@@ -0,0 +1,249 @@
+package dataaccess_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type customer struct {
+	ID         uint                       `gorm:"primary_key"`
+	Email      dataaccess.EncryptedString `gorm:"type:text"`
+	EmailIndex dataaccess.BlindIndex      `gorm:"index" blind_index:"Email"`
+	Phone      dataaccess.EncryptedString `gorm:"type:text"`
+}
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, dataaccess.ENCRYPTION_KEY_SIZE)
+}
+
+func newKeyring(primary string) *dataaccess.Keyring {
+	k, err := dataaccess.NewKeyring(primary, map[string][]byte{"2025": key(1), "2026": key(2)}, key(3))
+	Expect(err).NotTo(HaveOccurred())
+	return k
+}
+
+var _ = Describe("encryption", func() {
+	Context("keyring", func() {
+		It("should encrypt with the primary key and a data key per value", func() {
+			k := newKeyring("2025")
+			first, err := k.Encrypt([]byte("ada@example.com"))
+			Expect(err).NotTo(HaveOccurred())
+			second, err := k.Encrypt([]byte("ada@example.com"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first).To(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2025:"))
+			Expect(first).NotTo(Equal(second))
+
+			plaintext, err := k.Decrypt(first)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("ada@example.com"))
+		})
+
+		It("should refuse tampered values and unknown keys", func() {
+			k := newKeyring("2025")
+			ciphertext, err := k.Encrypt([]byte("secret"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = k.Decrypt(strings.Replace(ciphertext, ":2025:", ":2026:", 1))
+			Expect(err).To(MatchError(ContainSubstring("decrypting the data key with key 2026")))
+			_, err = dataaccess.LocalKeyring().Decrypt(ciphertext)
+			Expect(err).To(MatchError(`the value is encrypted with key "2025", which is not in the keyring`))
+			_, err = k.Decrypt("secret")
+			Expect(err).To(MatchError("the value is not encrypted"))
+		})
+
+		It("should rewrap values with a new primary key", func() {
+			ciphertext, err := newKeyring("2025").Encrypt([]byte("secret"))
+			Expect(err).NotTo(HaveOccurred())
+
+			rotated := newKeyring("2026")
+			rewrapped, changed, err := rotated.Rewrap(ciphertext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeTrue())
+			Expect(rewrapped).To(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2026:"))
+			plaintext, err := rotated.Decrypt(rewrapped)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("secret"))
+
+			_, changed, err = rotated.Rewrap(rewrapped)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(BeFalse())
+		})
+
+		It("should compute the same blind index for the same value", func() {
+			k := newKeyring("2025")
+			Expect(k.BlindIndex("ada@example.com")).To(Equal(newKeyring("2026").BlindIndex("ada@example.com")))
+			Expect(k.BlindIndex("ada@example.com")).NotTo(Equal(k.BlindIndex("bob@example.com")))
+			Expect(k.BlindIndex("ada@example.com")).NotTo(Equal(dataaccess.LocalKeyring().BlindIndex("ada@example.com")))
+		})
+
+		It("should load the keys from the configuration and files", func() {
+			location, err := ioutil.TempDir("", "keyring")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(location)
+			path := filepath.Join(location, "2026.key")
+			Expect(ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key(2))+"\n"), 0600)).To(Succeed())
+
+			dataaccess.GetConfiguration()
+			saved := dataaccess.Configuration.Encryption
+			defer func() { dataaccess.Configuration.Encryption = saved }()
+			dataaccess.Configuration.Encryption.PrimaryKey = "2026"
+			dataaccess.Configuration.Encryption.Keys = map[string]string{"2025": base64.StdEncoding.EncodeToString(key(1))}
+			dataaccess.Configuration.Encryption.KeyFiles = map[string]string{"2026": path}
+			dataaccess.Configuration.Encryption.IndexKey = base64.StdEncoding.EncodeToString(key(3))
+
+			k, err := dataaccess.KeyringFromConfiguration()
+			Expect(err).NotTo(HaveOccurred())
+			ciphertext, err := k.Encrypt([]byte("secret"))
+			Expect(err).NotTo(HaveOccurred())
+			plaintext, err := newKeyring("2025").Decrypt(ciphertext)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plaintext)).To(Equal("secret"))
+			Expect(dataaccess.Configuration.Encryption.String()).NotTo(ContainSubstring(dataaccess.Configuration.Encryption.IndexKey))
+
+			dataaccess.Configuration.Encryption.PrimaryKey = "2027"
+			_, err = dataaccess.KeyringFromConfiguration()
+			Expect(err).To(MatchError(`the primary key "2027" is not a key of the keyring`))
+		})
+	})
+
+	Context("fields", func() {
+		var (
+			ds  *dataaccess.DataSource
+			ctx = context.Background()
+		)
+
+		BeforeEach(func() {
+			dataaccess.SetKeyring(newKeyring("2025"))
+			ds = newSQLiteDataSource(&customer{})
+		})
+
+		AfterEach(func() {
+			Expect(dataaccess.Shutdown()).To(Succeed())
+		})
+
+		stored := func(id uint) (string, string) {
+			var row struct{ Email, Phone string }
+			Expect(ds.SQL().Get(ctx, &row, "SELECT email, coalesce(phone, '') AS phone FROM customers WHERE id = ?", id)).To(Succeed())
+			return row.Email, row.Phone
+		}
+
+		It("should store the fields encrypted and find them by blind index", func() {
+			ada := customer{Email: "ada@example.com", Phone: "555-0100"}
+			Expect(ds.DB().Create(&ada).Error).To(Succeed())
+			email, _ := stored(ada.ID)
+			Expect(email).To(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2025:"))
+
+			index, err := dataaccess.BlindIndexOf("ada@example.com")
+			Expect(err).NotTo(HaveOccurred())
+			var found customer
+			Expect(ds.DB().Where("email_index = ?", index).First(&found).Error).To(Succeed())
+			Expect(found.Email).To(BeEquivalentTo("ada@example.com"))
+			Expect(found.Phone).To(BeEquivalentTo("555-0100"))
+
+			Expect(ds.DB().Model(&found).Updates(map[string]interface{}{"email": dataaccess.EncryptedString("ada@example.org")}).Error).To(Succeed())
+			index, _ = dataaccess.BlindIndexOf("ada@example.org")
+			Expect(ds.DB().Where("email_index = ?", index).First(&customer{}).Error).To(Succeed())
+		})
+
+		It("should re-encrypt rotated and plaintext values", func() {
+			ada := customer{Email: "ada@example.com", Phone: "555-0100"}
+			Expect(ds.DB().Create(&ada).Error).To(Succeed())
+			_, err := ds.SQL().Exec(ctx, "INSERT INTO customers (id, email, phone) VALUES (2, 'bob@example.com', NULL)")
+			Expect(err).NotTo(HaveOccurred())
+
+			dataaccess.SetKeyring(newKeyring("2026"))
+			options := dataaccess.ReEncryptOptions{Table: "customers", Columns: []string{"email", "phone"}, BatchSize: 1}
+			rewritten, err := ds.SQL().ReEncrypt(ctx, options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeEquivalentTo(2))
+
+			for _, id := range []uint{1, 2} {
+				email, _ := stored(id)
+				Expect(email).To(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2026:"))
+			}
+			_, phone := stored(2)
+			Expect(phone).To(BeEmpty())
+			var customers []customer
+			Expect(ds.DB().Order("id").Find(&customers).Error).To(Succeed())
+			Expect(customers[0].Phone).To(BeEquivalentTo("555-0100"))
+			Expect(customers[1].Email).To(BeEquivalentTo("bob@example.com"))
+
+			rewritten, err = ds.SQL().ReEncrypt(ctx, options)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rewritten).To(BeZero())
+		})
+
+		It("should skip the rows it cannot re-encrypt and go on", func() {
+			Expect(ds.DB().Create(&customer{Email: "ada@example.com"}).Error).To(Succeed())
+			_, err := ds.SQL().Exec(ctx, "INSERT INTO customers (id, email) VALUES (2, 'bob@example.com'), (3, 'eve@example.com')")
+			Expect(err).NotTo(HaveOccurred())
+
+			// the key of the first row was dropped from the keyring
+			k, err := dataaccess.NewKeyring("2026", map[string][]byte{"2026": key(2)}, key(3))
+			Expect(err).NotTo(HaveOccurred())
+			dataaccess.SetKeyring(k)
+			options := dataaccess.ReEncryptOptions{Table: "customers", Columns: []string{"email"}, BatchSize: 1}
+			rewritten, err := ds.SQL().ReEncrypt(ctx, options)
+			Expect(rewritten).To(BeEquivalentTo(2))
+			var skipped *dataaccess.ReEncryptError
+			Expect(errors.As(err, &skipped)).To(BeTrue())
+			Expect(skipped.Rows).To(HaveLen(1))
+			Expect(skipped.Rows[0].Key).To(BeEquivalentTo(1))
+			Expect(err).To(MatchError(ContainSubstring(`re-encrypting customers skipped 1 rows: row 1: column email: the value is encrypted with key "2025"`)))
+
+			for _, id := range []uint{2, 3} {
+				email, _ := stored(id)
+				Expect(email).To(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2026:"))
+			}
+		})
+
+		It("should index the plaintext values it encrypts", func() {
+			_, err := ds.SQL().Exec(ctx, "INSERT INTO customers (id, email) VALUES (1, 'ada@example.com')")
+			Expect(err).NotTo(HaveOccurred())
+
+			options := dataaccess.ReEncryptOptions{Table: "customers", Columns: []string{"email"}, BlindIndexes: map[string]string{"email": "email_index"}}
+			Expect(ds.SQL().ReEncrypt(ctx, options)).To(BeEquivalentTo(1))
+
+			index, err := dataaccess.BlindIndexOf("ada@example.com")
+			Expect(err).NotTo(HaveOccurred())
+			var found customer
+			Expect(ds.DB().Where("email_index = ?", index).First(&found).Error).To(Succeed())
+			Expect(found.Email).To(BeEquivalentTo("ada@example.com"))
+
+			// rewrapping keeps the index
+			dataaccess.SetKeyring(newKeyring("2026"))
+			Expect(ds.SQL().ReEncrypt(ctx, options)).To(BeEquivalentTo(1))
+			Expect(ds.DB().Where("email_index = ?", index).First(&customer{}).Error).To(Succeed())
+		})
+
+		It("should re-encrypt at an interval until stopped", func() {
+			ada := customer{Email: "ada@example.com"}
+			Expect(ds.DB().Create(&ada).Error).To(Succeed())
+			job := dataaccess.NewReEncryption(ds, dataaccess.ReEncryptOptions{Table: "customers", Columns: []string{"email", "phone"}})
+			job.Interval = 10 * time.Millisecond
+			runCtx, cancel := context.WithCancel(ctx)
+			done := make(chan error)
+			go func() { done <- job.Run(runCtx) }()
+
+			dataaccess.SetKeyring(newKeyring("2026"))
+			Eventually(func() string {
+				email, _ := stored(ada.ID)
+				return email
+			}).Should(HavePrefix(dataaccess.ENCRYPTION_PREFIX + "2026:"))
+			cancel()
+			Eventually(done).Should(Receive(Equal(context.Canceled)))
+		})
+	})
+})
@@ -0,0 +1,119 @@
+package dataaccess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DB_ENV_PREFIX prefixes the environment variables overriding the default data source, e.g. DB_HOST.
+	// Named data sources use DB_<NAME>_, e.g. DB_REPORTING_HOST.
+	DB_ENV_PREFIX = "DB_"
+
+	// FILE_ENV_SUFFIX marks a variable naming a file that holds the value, e.g. DB_PASSWORD_FILE
+	// pointing at a mounted secret
+	FILE_ENV_SUFFIX = "_FILE"
+)
+
+var durationType = reflect.TypeOf(Duration{})
+
+// envPrefix returns the prefix of the environment variables overriding the named data source
+func envPrefix(name string) string {
+	if name == DEFAULT_DATASOURCE {
+		return DB_ENV_PREFIX
+	}
+	normalized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	return DB_ENV_PREFIX + strings.ToUpper(normalized) + "_"
+}
+
+// hasEnvOverrides reports whether any variable overriding a field of the configuration is set
+func hasEnvOverrides(prefix string) bool {
+	t := reflect.TypeOf(dbConfiguration{})
+	for i := 0; i < t.NumField(); i++ {
+		variable := envVariable(prefix, t.Field(i))
+		if variable == "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(variable); ok {
+			return true
+		}
+		if _, ok := os.LookupEnv(variable + FILE_ENV_SUFFIX); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// envVariable returns the variable overriding a field, named after its JSON name
+func envVariable(prefix string, field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "" || tag == "-" {
+		return ""
+	}
+	return prefix + strings.ToUpper(tag)
+}
+
+// applyEnvOverrides sets the fields of config from the environment variables named after the
+// prefix and the upper case JSON name of the field, e.g. DB_HOST or DB_MAX_OPEN_CONNS, or from the
+// file named by the variable with the _FILE suffix. It returns the names of the variables applied.
+// Errors name the variable but never its value.
+func applyEnvOverrides(config *dbConfiguration, prefix string) ([]string, error) {
+	var applied []string
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		variable := envVariable(prefix, v.Type().Field(i))
+		if variable == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(variable)
+		if path, fromFile := os.LookupEnv(variable + FILE_ENV_SUFFIX); fromFile && !ok {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return applied, fmt.Errorf("reading %s: %w", variable+FILE_ENV_SUFFIX, err)
+			}
+			// secrets are commonly mounted with a trailing newline
+			value, ok, variable = strings.TrimRight(string(content), "\r\n"), true, variable+FILE_ENV_SUFFIX
+		}
+		if !ok {
+			continue
+		}
+
+		target := v.Field(i)
+		switch {
+		case target.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return applied, fmt.Errorf("%s is not a duration", variable)
+			}
+			target.Set(reflect.ValueOf(Duration{d}))
+		case target.Kind() == reflect.String:
+			target.SetString(value)
+		case target.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return applied, fmt.Errorf("%s is not a number", variable)
+			}
+			target.SetInt(int64(n))
+		case target.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return applied, fmt.Errorf("%s is not a boolean", variable)
+			}
+			target.SetBool(b)
+		default:
+			return applied, fmt.Errorf("%s cannot be set from the environment", variable)
+		}
+		applied = append(applied, variable)
+	}
+	return applied, nil
+}
@@ -0,0 +1,143 @@
+package dataaccess_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("environment overrides", func() {
+	var (
+		location string
+		restore  func()
+		env      = []string{"DB_HOST", "DB_PASSWORD", "DB_PASSWORD_FILE", "DB_MAX_OPEN_CONNS", "DB_CONNECT_DEADLINE", "DB_REPORTING_SCHEMA", "DB_ROW_LEVEL_SECURITY"}
+	)
+
+	BeforeEach(func() {
+		var err error
+		location, err = ioutil.TempDir("", "dataaccess")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(location, dataaccess.DB_CONFIG_FILE), []byte(pooledConfig), 0600)).To(Succeed())
+		dataaccess.GetConfiguration()
+		saved := *dataaccess.Configuration
+		restore = func() { *dataaccess.Configuration = saved }
+	})
+
+	AfterEach(func() {
+		for _, variable := range env {
+			os.Unsetenv(variable)
+		}
+		restore()
+		os.RemoveAll(location)
+	})
+
+	It("override the settings of the config file", func() {
+		os.Setenv("DB_HOST", "db.internal")
+		os.Setenv("DB_MAX_OPEN_CONNS", "12")
+		os.Setenv("DB_CONNECT_DEADLINE", "1m")
+		os.Setenv("DB_REPORTING_SCHEMA", "reports")
+		os.Setenv("DB_ROW_LEVEL_SECURITY", "true")
+
+		source, err := dataaccess.LoadDBConfiguration(location)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(ContainSubstring(dataaccess.DB_CONFIG_FILE))
+		Expect(source).To(ContainSubstring("environment DB_HOST, DB_MAX_OPEN_CONNS, DB_CONNECT_DEADLINE, DB_ROW_LEVEL_SECURITY, DB_REPORTING_SCHEMA"))
+
+		config := dataaccess.Configuration.DBConfig
+		Expect(config.Host).To(Equal("db.internal"))
+		Expect(config.MaxOpenConns).To(Equal(12))
+		Expect(config.ConnectDeadline.Duration).To(Equal(time.Minute))
+		Expect(config.RowLevelSecurity).To(BeTrue())
+		Expect(config.Schema).To(Equal(":memory:"))
+		Expect(dataaccess.Configuration.DataSources["reporting"].Schema).To(Equal("reports"))
+	})
+
+	It("read values from files such as mounted secrets", func() {
+		secret := filepath.Join(location, "password")
+		Expect(ioutil.WriteFile(secret, []byte("s3cret\n"), 0600)).To(Succeed())
+		os.Setenv("DB_PASSWORD_FILE", secret)
+
+		source, err := dataaccess.LoadDBConfiguration(location)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(ContainSubstring("DB_PASSWORD_FILE"))
+		Expect(source).NotTo(ContainSubstring("s3cret"))
+		Expect(dataaccess.Configuration.DBConfig.Password).To(Equal("s3cret"))
+	})
+
+	It("report invalid values without repeating them", func() {
+		os.Setenv("DB_MAX_OPEN_CONNS", "many")
+		_, err := dataaccess.LoadDBConfiguration(location)
+		Expect(err).To(MatchError("DB_MAX_OPEN_CONNS is not a number"))
+	})
+
+	It("suffice without a config file", func() {
+		os.Setenv("DB_HOST", "db.internal")
+		source, err := dataaccess.LoadDBConfiguration(filepath.Join(location, "missing"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source).To(Equal("environment DB_HOST"))
+	})
+})
+
+var _ = Describe("loading the config file", func() {
+	var location string
+
+	BeforeEach(func() {
+		var err error
+		location, err = ioutil.TempDir("", "dataaccess")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(location)
+	})
+
+	It("reports a missing file", func() {
+		err := dataaccess.LoadDBConfigurationFromFile(location)
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		_, err = dataaccess.LoadDBConfiguration(location)
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+	})
+
+	It("reports an invalid file", func() {
+		Expect(ioutil.WriteFile(filepath.Join(location, dataaccess.DB_CONFIG_FILE), []byte(`{"host": `), 0600)).To(Succeed())
+		Expect(dataaccess.LoadDBConfigurationFromFile(location)).To(MatchError(ContainSubstring(dataaccess.DB_CONFIG_FILE)))
+	})
+})
+
+var _ = Describe("redaction", func() {
+	It("masks the password when a configuration is printed", func() {
+		dataaccess.GetConfiguration()
+		config := dataaccess.Configuration.DBConfig
+		config.Password = "s3cret"
+		for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+			printed := fmt.Sprintf(format, config)
+			Expect(printed).NotTo(ContainSubstring("s3cret"))
+			Expect(printed).To(ContainSubstring(dataaccess.REDACTED))
+		}
+	})
+
+	It("masks the password in logged DSNs of every dialect", func() {
+		dataaccess.GetConfiguration()
+		config := dataaccess.Configuration.DBConfig
+		config.Host, config.Port, config.Schema, config.SSLMode = "db.internal", "5432", "orders", dataaccess.SSL_DISABLE
+		config.Username, config.Password = "svc", "s3cret"
+		for _, dialect := range []string{dataaccess.DIALECT_POSTGRES, dataaccess.DIALECT_MYSQL, dataaccess.DIALECT_MSSQL} {
+			config.Database = dialect
+			dsn, err := dataaccess.BuildDSN(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dsn).To(ContainSubstring("s3cret"))
+
+			redacted := dataaccess.RedactedDSN(config)
+			Expect(redacted).NotTo(ContainSubstring("s3cret"), dialect)
+			Expect(redacted).To(ContainSubstring("db.internal"), dialect)
+		}
+	})
+})
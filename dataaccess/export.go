@@ -0,0 +1,171 @@
+package dataaccess
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// FORMAT_CSV is comma separated values with a header row naming the columns
+	FORMAT_CSV = "csv"
+	// FORMAT_NDJSON is newline delimited JSON, one object per row
+	FORMAT_NDJSON = "ndjson"
+)
+
+// ExportOptions set how rows are written by Export
+type ExportOptions struct {
+	// Format is FORMAT_CSV unless set
+	Format string
+	// Null is the CSV field written for NULL, empty unless set. NDJSON writes null.
+	Null string
+}
+
+// rowWriter writes the rows of an export in one format
+type rowWriter interface {
+	header(columns []string) error
+	row(values []interface{}) error
+	flush() error
+}
+
+// ExportTable streams all rows of a table to w, see Export
+func (s *SQL) ExportTable(ctx context.Context, w io.Writer, table string, options ExportOptions) (int64, error) {
+	return s.Export(ctx, w, options, "SELECT * FROM "+s.quoteTable(table))
+}
+
+// Export streams the rows of a query to w in the format of the options and returns the number of
+// rows written. Rows are written as they are read, so that exports of any size run in bounded memory.
+// Timestamps are written in RFC 3339 format, binary values in NDJSON as base64.
+func (s *SQL) Export(ctx context.Context, w io.Writer, options ExportOptions, query string, args ...interface{}) (int64, error) {
+	out, err := newRowWriter(w, options)
+	if err != nil {
+		return 0, err
+	}
+	it, err := s.Iterate(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	if err := out.header(it.Columns()); err != nil {
+		return 0, err
+	}
+	var written int64
+	values := make([]interface{}, len(it.Columns()))
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for it.Next() {
+		if err := it.rows.Scan(pointers...); err != nil {
+			return written, err
+		}
+		if err := out.row(values); err != nil {
+			return written, err
+		}
+		written++
+	}
+	if err := it.Close(); err != nil {
+		return written, err
+	}
+	return written, out.flush()
+}
+
+func newRowWriter(w io.Writer, options ExportOptions) (rowWriter, error) {
+	switch options.Format {
+	case "", FORMAT_CSV:
+		return &csvRowWriter{w: csv.NewWriter(w), null: options.Null}, nil
+	case FORMAT_NDJSON:
+		return &ndjsonRowWriter{w: bufio.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", options.Format)
+}
+
+type csvRowWriter struct {
+	w      *csv.Writer
+	null   string
+	fields []string
+}
+
+func (c *csvRowWriter) header(columns []string) error {
+	c.fields = make([]string, len(columns))
+	return c.w.Write(columns)
+}
+
+func (c *csvRowWriter) row(values []interface{}) error {
+	for i, value := range values {
+		c.fields[i] = c.format(value)
+	}
+	return c.w.Write(c.fields)
+}
+
+func (c *csvRowWriter) format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return c.null
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+func (c *csvRowWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonRowWriter struct {
+	w       *bufio.Writer
+	columns [][]byte
+}
+
+func (n *ndjsonRowWriter) header(columns []string) error {
+	n.columns = make([][]byte, len(columns))
+	for i, column := range columns {
+		name, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		n.columns[i] = name
+	}
+	return nil
+}
+
+// row writes the columns in the order of the query, which encoding a map would not keep
+func (n *ndjsonRowWriter) row(values []interface{}) error {
+	n.w.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			n.w.WriteByte(',')
+		}
+		// text columns of some drivers are bytes
+		if b, ok := value.([]byte); ok && utf8.Valid(b) {
+			value = string(b)
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("encoding column %s: %w", n.columns[i], err)
+		}
+		n.w.Write(n.columns[i])
+		n.w.WriteByte(':')
+		n.w.Write(encoded)
+	}
+	n.w.WriteString("}\n")
+	return nil
+}
+
+func (n *ndjsonRowWriter) flush() error {
+	return n.w.Flush()
+}
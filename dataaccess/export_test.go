@@ -0,0 +1,63 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// exposes internals to the dataaccess_test package
+var BuildDSN = buildDSN
+
+var BulkBatchSize = bulkBatchSize
+
+// CloseReplica closes the pool of a replica so that its health check fails
+func (ds *DataSource) CloseReplica(i int) error {
+	return ds.current().replicas[i].db.Close()
+}
+
+// RedactedDSN returns the DSN of a configuration as it is logged
+func RedactedDSN(config dbConfiguration) string {
+	return config.redactedDSN()
+}
+
+// NewTestSubscription creates a subscription receiving the notifications sent on notify, calling
+// close when it stops
+func NewTestSubscription(ctx context.Context, notify <-chan *pq.Notification, close func() error) *Subscription {
+	return newSubscription(ctx, notify, nil, close)
+}
+
+// RLSSettings returns the row-level security settings of a transaction of the tenant
+func RLSSettings(ctx context.Context, tenant string) [][2]string {
+	return rlsSettings(ctx, tenant)
+}
+
+// DBConfiguration names the configuration of a data source, e.g. for credential sources
+type DBConfiguration = dbConfiguration
+
+// NewTestLock creates a lock renewed by checking held and released by release
+func NewTestLock(name string, held func(ctx context.Context) (bool, error), release func() error, options LockOptions) *Lock {
+	return newLock(name, held, release, options)
+}
+
+// SetTryLock replaces how the election takes the lock of the leader
+func (e *LeaderElection) SetTryLock(tryLock func(ctx context.Context) (*Lock, error)) {
+	e.tryLock = tryLock
+}
+
+// CurrentConfiguration returns the configuration of the pool in use
+func (ds *DataSource) CurrentConfiguration() dbConfiguration {
+	return ds.current().config
+}
+
+// HoldSessionConnection takes a connection off the pool in use like a session lock, returning the
+// connection and how to give it back
+func (ds *DataSource) HoldSessionConnection(ctx context.Context) (*sql.Conn, func() error, error) {
+	p := ds.current()
+	conn, err := p.sessionConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() error { return p.closeSessionConn(conn) }, nil
+}
@@ -3,20 +3,30 @@ package dataaccess
 import (
 	logger "github.com/sirupsen/logrus"
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mssql"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
-//Method to get local postgres database connection with GORM handle
+//Method to get the shared GORM handle of the default data source for the configured dialect.
+//The handle is pooled and shared by the whole process, see GetDataSource. GetConnection panics
+//when the database cannot be reached, services should prefer Connect which returns the error.
 func GetConnection() *gorm.DB {
-	conn, err := gorm.Open(Configuration.DBConfig.Database, buildDBURI())
+	ds, err := GetDataSource(DEFAULT_DATASOURCE)
 	if err != nil {
-		panic("failed to connect database")
+		panic("failed to connect database: " + err.Error())
 	}
-	return conn
+	return ds.DB()
 }
 
-//Close an open gorm database connection
+//Close an open gorm database connection. Handles of managed data sources are left open,
+//their pools are closed by Shutdown.
 func CloseConnection(db *gorm.DB) {
+	if isManaged(db) {
+		logger.Debug("Leaving pooled database connection open")
+		return
+	}
 	logger.Debug("Closing database connection", db)
 	defer db.Close()
 }
@@ -0,0 +1,285 @@
+package dataaccess
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ImportOptions set how Import reads rows and where it writes them
+type ImportOptions struct {
+	// Format is FORMAT_CSV unless set
+	Format string
+	// Table the rows are written to
+	Table string
+	// Columns maps the columns of the file, the CSV header or the keys of the NDJSON objects, to the
+	// columns of the table. Columns mapped to "" or "-" are skipped, unmapped columns keep their name.
+	Columns map[string]string
+	// BatchSize is passed on to the bulk load, see BulkLoad
+	BatchSize int
+	// ConflictColumns switch the import to an upsert updating the UpdateColumns of conflicting
+	// rows, see BulkUpsert
+	ConflictColumns []string
+	UpdateColumns   []string
+	// Null is the CSV field read as NULL, empty unless set. NDJSON reads null and missing keys as NULL.
+	Null string
+	// DryRun imports every row in a transaction that is rolled back, see Import
+	DryRun bool
+}
+
+// ImportResult counts the rows of an import
+type ImportResult struct {
+	// Rows read from the file
+	Rows int64
+	// Written is the number of rows written, as counted by BulkInsert or BulkUpsert
+	Written int64
+}
+
+// rowReader reads the rows of an import in one format
+type rowReader interface {
+	// columns returns the columns of the file
+	columns() ([]string, error)
+	// next returns the values of the next row in the order of the columns, io.EOF after the last row
+	next() ([]interface{}, error)
+}
+
+// Import loads the rows of a CSV or NDJSON file into a table with BulkInsert, or BulkUpsert when
+// conflict columns are set. The file is streamed, so files of any size import in bounded memory,
+// and all rows or none are written. CSV values are passed to the database as text; NDJSON numbers
+// as text, nested objects and arrays as JSON.
+//
+// The columns of the file have to be columns of the table. A dry run imports every row in a
+// transaction it rolls back, reporting the first malformed row or value the database refuses
+// without keeping anything.
+func (s *SQL) Import(ctx context.Context, r io.Reader, options ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	in, err := newRowReader(r, options)
+	if err != nil {
+		return result, err
+	}
+	fileColumns, err := in.columns()
+	if err != nil {
+		return result, fmt.Errorf("reading columns: %w", err)
+	}
+
+	// indexes of the file columns that are imported, and the table columns they go to
+	var (
+		indexes []int
+		columns []string
+	)
+	for i, column := range fileColumns {
+		target, mapped := options.Columns[column]
+		if !mapped {
+			target = column
+		}
+		if target == "" || target == "-" {
+			continue
+		}
+		indexes = append(indexes, i)
+		columns = append(columns, target)
+	}
+	if len(columns) == 0 {
+		return result, fmt.Errorf("the file has no columns to import")
+	}
+	if err := s.checkColumns(ctx, options.Table, columns); err != nil {
+		return result, err
+	}
+
+	rows := BulkRowsFunc(func(ctx context.Context) ([]interface{}, bool, error) {
+		values, err := in.next()
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("row %d: %w", result.Rows+1, err)
+		}
+		result.Rows++
+		row := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			row[i] = values[index]
+		}
+		return row, true, nil
+	})
+
+	load := BulkLoad{
+		Table:           options.Table,
+		Columns:         columns,
+		BatchSize:       options.BatchSize,
+		ConflictColumns: options.ConflictColumns,
+		UpdateColumns:   options.UpdateColumns,
+	}
+	if !options.DryRun {
+		result.Written, err = s.bulkLoad(ctx, load, rows)
+		return result, err
+	}
+
+	// a dry run writes the rows in a transaction it rolls back, so that the database converts and
+	// checks every value as in the real import
+	err = s.ds.transactionOnce(ctx, func(tx *Tx) error {
+		if _, err := s.bulkLoad(tx.Context(), load, rows); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if err == errDryRun {
+		err = nil
+	}
+	return result, err
+}
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// bulkLoad writes the rows with BulkUpsert when the load has conflict columns and BulkInsert otherwise
+func (s *SQL) bulkLoad(ctx context.Context, load BulkLoad, rows BulkRows) (int64, error) {
+	if len(load.ConflictColumns) > 0 {
+		return s.BulkUpsert(ctx, load, rows)
+	}
+	return s.BulkInsert(ctx, load, rows)
+}
+
+// checkColumns makes sure the columns are columns of the table
+func (s *SQL) checkColumns(ctx context.Context, table string, columns []string) error {
+	if table == "" {
+		return fmt.Errorf("an import needs a table")
+	}
+	it, err := s.Iterate(ctx, "SELECT * FROM "+s.quoteTable(table)+" WHERE 1 = 0")
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	known := make(map[string]bool, len(it.Columns()))
+	for _, column := range it.Columns() {
+		known[column] = true
+	}
+	for _, column := range columns {
+		if !known[column] {
+			return fmt.Errorf("%s has no column %s", table, column)
+		}
+	}
+	return it.Close()
+}
+
+func newRowReader(r io.Reader, options ImportOptions) (rowReader, error) {
+	switch options.Format {
+	case "", FORMAT_CSV:
+		reader := csv.NewReader(bufio.NewReader(r))
+		reader.ReuseRecord = true
+		return &csvRowReader{r: reader, null: options.Null}, nil
+	case FORMAT_NDJSON:
+		return &ndjsonRowReader{r: bufio.NewReader(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", options.Format)
+}
+
+type csvRowReader struct {
+	r    *csv.Reader
+	null string
+}
+
+func (c *csvRowReader) columns() ([]string, error) {
+	header, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	// the record is reused by the next read
+	return append([]string(nil), header...), nil
+}
+
+func (c *csvRowReader) next() ([]interface{}, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(record))
+	for i, field := range record {
+		if field != c.null {
+			values[i] = field
+		}
+	}
+	return values, nil
+}
+
+// ndjsonRowReader reads the keys of the first object as the columns of the file
+type ndjsonRowReader struct {
+	r     *bufio.Reader
+	keys  map[string]int
+	first map[string]interface{}
+}
+
+func (n *ndjsonRowReader) columns() ([]string, error) {
+	first, err := n.object()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(first))
+	for key := range first {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	n.keys = make(map[string]int, len(columns))
+	for i, column := range columns {
+		n.keys[column] = i
+	}
+	n.first = first
+	return columns, nil
+}
+
+func (n *ndjsonRowReader) next() ([]interface{}, error) {
+	object := n.first
+	n.first = nil
+	if object == nil {
+		var err error
+		if object, err = n.object(); err != nil {
+			return nil, err
+		}
+	}
+	values := make([]interface{}, len(n.keys))
+	for key, value := range object {
+		i, ok := n.keys[key]
+		if !ok {
+			return nil, fmt.Errorf("key %s is not a key of the first object", key)
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			value = string(encoded)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// object reads the object of the next line that is not blank
+func (n *ndjsonRowReader) object() (map[string]interface{}, error) {
+	for {
+		line, err := n.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+			var object map[string]interface{}
+			if err := decoder.Decode(&object); err != nil {
+				return nil, err
+			}
+			if object == nil {
+				return nil, fmt.Errorf("the line is no JSON object")
+			}
+			return object, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
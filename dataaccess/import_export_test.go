@@ -0,0 +1,143 @@
+package dataaccess_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("export and import", func() {
+	var (
+		db  *dataaccess.SQL
+		ctx = context.Background()
+	)
+
+	BeforeEach(func() {
+		db = newSQLiteDataSource(&order{}).SQL()
+		_, err := db.BulkInsert(ctx, dataaccess.BulkLoad{Table: "orders", Columns: []string{"id", "customer", "status", "total"}},
+			dataaccess.RowsFromSlice([][]interface{}{{1, "acme", "open", 10}, {2, `o"hara, inc`, nil, 20}}))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	totals := func() []int {
+		var totals []int
+		Expect(db.Select(ctx, &totals, "SELECT total FROM orders ORDER BY id")).To(Succeed())
+		return totals
+	}
+
+	Context("export", func() {
+		It("should write a table as CSV", func() {
+			var out bytes.Buffer
+			rows, err := db.ExportTable(ctx, &out, "orders", dataaccess.ExportOptions{Null: `\N`})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rows).To(BeEquivalentTo(2))
+			Expect(out.String()).To(Equal("id,customer,status,total\n1,acme,open,10\n2,\"o\"\"hara, inc\",\\N,20\n"))
+		})
+
+		It("should write a query as NDJSON", func() {
+			var out bytes.Buffer
+			rows, err := db.Export(ctx, &out, dataaccess.ExportOptions{Format: dataaccess.FORMAT_NDJSON},
+				"SELECT total, customer, status FROM orders WHERE total > :min ORDER BY id", map[string]interface{}{"min": 0})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rows).To(BeEquivalentTo(2))
+			Expect(out.String()).To(Equal("{\"total\":10,\"customer\":\"acme\",\"status\":\"open\"}\n" +
+				"{\"total\":20,\"customer\":\"o\\\"hara, inc\",\"status\":null}\n"))
+		})
+
+		It("should refuse unknown formats", func() {
+			_, err := db.ExportTable(ctx, &bytes.Buffer{}, "orders", dataaccess.ExportOptions{Format: "xml"})
+			Expect(err).To(MatchError(`unknown format "xml"`))
+		})
+	})
+
+	Context("import", func() {
+		It("should reload an export", func() {
+			for _, format := range []string{dataaccess.FORMAT_CSV, dataaccess.FORMAT_NDJSON} {
+				var out bytes.Buffer
+				_, err := db.ExportTable(ctx, &out, "orders", dataaccess.ExportOptions{Format: format})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = db.Exec(ctx, "DELETE FROM orders")
+				Expect(err).NotTo(HaveOccurred())
+
+				result, err := db.Import(ctx, &out, dataaccess.ImportOptions{Format: format, Table: "orders", BatchSize: 1})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal(dataaccess.ImportResult{Rows: 2, Written: 2}))
+
+				var rows []orderRow
+				Expect(db.Select(ctx, &rows, "SELECT id, customer, total FROM orders ORDER BY id")).To(Succeed())
+				Expect(rows).To(HaveLen(2))
+				Expect(rows[1].Customer).To(Equal(`o"hara, inc`))
+				Expect(rows[1].Amount).To(Equal(20))
+				var missing int
+				Expect(db.Get(ctx, &missing, "SELECT count(*) FROM orders WHERE status IS NULL")).To(Succeed())
+				Expect(missing).To(Equal(1))
+			}
+		})
+
+		It("should map and skip columns", func() {
+			in := strings.NewReader("order_id,customer,amount,note\n3,initech,30,skipped\n4,umbrella,,skipped\n")
+			result, err := db.Import(ctx, in, dataaccess.ImportOptions{
+				Table:   "orders",
+				Columns: map[string]string{"order_id": "id", "amount": "total", "note": "-"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Written).To(BeEquivalentTo(2))
+
+			var missing int
+			Expect(db.Get(ctx, &missing, "SELECT count(*) FROM orders WHERE total IS NULL")).To(Succeed())
+			Expect(missing).To(Equal(1))
+		})
+
+		It("should upsert", func() {
+			in := strings.NewReader(`{"id": 1, "total": 15}` + "\n\n" + `{"id": 3, "customer": "initech", "total": 30}` + "\n")
+			result, err := db.Import(ctx, in, dataaccess.ImportOptions{
+				Format:          dataaccess.FORMAT_NDJSON,
+				Table:           "orders",
+				ConflictColumns: []string{"id"},
+				UpdateColumns:   []string{"total"},
+			})
+			Expect(err).To(MatchError(ContainSubstring("key customer is not a key of the first object")))
+			Expect(result.Written).To(BeZero())
+			Expect(totals()).To(Equal([]int{10, 20}))
+
+			in = strings.NewReader(`{"id": 1, "total": 15}` + "\n" + `{"id": 3, "total": 30}` + "\n")
+			_, err = db.Import(ctx, in, dataaccess.ImportOptions{
+				Format:          dataaccess.FORMAT_NDJSON,
+				Table:           "orders",
+				ConflictColumns: []string{"id"},
+				UpdateColumns:   []string{"total"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(totals()).To(Equal([]int{15, 20, 30}))
+		})
+
+		It("should validate without writing in a dry run", func() {
+			result, err := db.Import(ctx, strings.NewReader("id,total\n3,30\n4,40\n"), dataaccess.ImportOptions{Table: "orders", DryRun: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(dataaccess.ImportResult{Rows: 2}))
+			Expect(totals()).To(Equal([]int{10, 20}))
+
+			_, err = db.Import(ctx, strings.NewReader("id,total\n3,30\n4\n"), dataaccess.ImportOptions{Table: "orders", DryRun: true})
+			Expect(err).To(MatchError(ContainSubstring("row 2")))
+
+			_, err = db.Import(ctx, strings.NewReader("id,price\n3,30\n"), dataaccess.ImportOptions{Table: "orders", DryRun: true})
+			Expect(err).To(MatchError("orders has no column price"))
+		})
+
+		It("should report the values the database refuses in a dry run", func() {
+			// the second row takes the id of an existing order
+			_, err := db.Import(ctx, strings.NewReader("id,total\n3,30\n1,40\n"), dataaccess.ImportOptions{Table: "orders", DryRun: true})
+			Expect(err).To(MatchError(ContainSubstring("UNIQUE constraint failed")))
+			Expect(totals()).To(Equal([]int{10, 20}))
+		})
+	})
+})
@@ -0,0 +1,364 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	newrelic "github.com/newrelic/go-agent"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_SLOW_QUERY_THRESHOLD is the duration above which queries are logged, see SlowQueryThreshold
+	DEFAULT_SLOW_QUERY_THRESHOLD = 500 * time.Millisecond
+
+	// error classes of queries, see QueryEvent
+	QUERY_ERROR_NOT_FOUND     = "not_found"
+	QUERY_ERROR_CONSTRAINT    = "constraint"
+	QUERY_ERROR_SERIALIZATION = "serialization"
+	QUERY_ERROR_SYNTAX        = "syntax"
+	QUERY_ERROR_CONNECTION    = "connection"
+	QUERY_ERROR_CANCELED      = "canceled"
+	QUERY_ERROR_TIMEOUT       = "timeout"
+	QUERY_ERROR_OTHER         = "other"
+
+	// gorm settings carrying the context of a query and the state of its instrumentation
+	queryContextKey = "dataaccess:context"
+	queryTimerKey   = "dataaccess:query_timer"
+)
+
+var (
+	sqlPlaceholders = regexp.MustCompile(`\$\d+|@p\d+`)
+	sqlLiterals     = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+	sqlLists        = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlWhitespace   = regexp.MustCompile(`\s+`)
+	sqlTables       = regexp.MustCompile("(?i)\\b(?:FROM|INTO|UPDATE|JOIN)\\s+([\\w.\"`\\[\\]]+)")
+	sqlQuotes       = strings.NewReplacer(`"`, "", "`", "", "[", "", "]", "")
+
+	datastoreProducts = map[string]newrelic.DatastoreProduct{
+		DIALECT_POSTGRES: newrelic.DatastorePostgres,
+		DIALECT_MYSQL:    newrelic.DatastoreMySQL,
+		DIALECT_SQLITE:   newrelic.DatastoreSQLite,
+		DIALECT_MSSQL:    newrelic.DatastoreMSSQL,
+	}
+)
+
+type (
+	// QueryEvent describes an executed query. SQL is normalized and holds no parameter values.
+	QueryEvent struct {
+		DataSource string
+		Table      string
+		Operation  string
+		SQL        string
+		Duration   time.Duration
+		Rows       int64
+		// ErrorClass is empty for a successful query and one of the QUERY_ERROR_ classes otherwise
+		ErrorClass string
+	}
+
+	// QueryObserver receives every executed query, e.g. to export metrics to a monitoring system
+	QueryObserver func(ctx context.Context, event QueryEvent)
+
+	// QueryKey identifies the queries of one operation on one table of a data source
+	QueryKey struct {
+		DataSource string
+		Table      string
+		Operation  string
+	}
+
+	// QueryMetrics aggregates the queries of a QueryKey since the process started
+	QueryMetrics struct {
+		Count    int64
+		Errors   int64
+		Rows     int64
+		Duration time.Duration
+		Max      time.Duration
+	}
+
+	traceContextKey struct{}
+)
+
+// aggregated metrics of all queries by table and operation
+var queryMetrics = struct {
+	sync.Mutex
+	byKey map[QueryKey]*QueryMetrics
+}{byKey: map[QueryKey]*QueryMetrics{}}
+
+var queryObserver atomic.Value
+
+// SetQueryObserver registers the observer every executed query is passed to, nil to remove it
+func SetQueryObserver(observer QueryObserver) {
+	queryObserver.Store(observer)
+}
+
+// QueryStats returns the metrics of the queries of every table and operation
+func QueryStats() map[QueryKey]QueryMetrics {
+	queryMetrics.Lock()
+	defer queryMetrics.Unlock()
+
+	stats := make(map[QueryKey]QueryMetrics, len(queryMetrics.byKey))
+	for key, metrics := range queryMetrics.byKey {
+		stats[key] = *metrics
+	}
+	return stats
+}
+
+// WithTrace returns a context whose queries are recorded as datastore segments of the New Relic
+// transaction
+func WithTrace(ctx context.Context, txn newrelic.Transaction) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, txn)
+}
+
+// TraceFromContext returns the New Relic transaction of ctx
+func TraceFromContext(ctx context.Context) (newrelic.Transaction, bool) {
+	txn, ok := ctx.Value(traceContextKey{}).(newrelic.Transaction)
+	return txn, ok
+}
+
+// TraceHandler passes the New Relic transaction of requests wrapped by newrelic.WrapHandle on to
+// the data access, so that the queries of a request become segments of its trace
+func TraceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if txn, ok := w.(newrelic.Transaction); ok {
+			r = r.WithContext(WithTrace(r.Context(), txn))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withContext passes ctx on to the instrumentation callbacks
+func withContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	return db.Set(queryContextKey, ctx)
+}
+
+// registerInstrumentation installs the callbacks timing every query of the handle around the
+// statement of the query. gorm runs Exec without callbacks, so raw statements are instrumented by
+// Tx.Exec, the SQL helpers and instrument instead; DB().Exec outside of a transaction is not.
+func (ds *DataSource) registerInstrumentation(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("dataaccess:instrument_start", ds.startQuery)
+	callbacks.Create().After("gorm:create").Register("dataaccess:instrument_end", ds.endQuery)
+	callbacks.Update().Before("gorm:update").Register("dataaccess:instrument_start", ds.startQuery)
+	callbacks.Update().After("gorm:update").Register("dataaccess:instrument_end", ds.endQuery)
+	callbacks.Delete().Before("gorm:delete").Register("dataaccess:instrument_start", ds.startQuery)
+	callbacks.Delete().After("gorm:delete").Register("dataaccess:instrument_end", ds.endQuery)
+	callbacks.Query().Before("gorm:query").Register("dataaccess:instrument_start", ds.startQuery)
+	callbacks.Query().After("gorm:query").Register("dataaccess:instrument_end", ds.endQuery)
+	callbacks.RowQuery().Before("gorm:row_query").Register("dataaccess:instrument_start", ds.startQuery)
+	callbacks.RowQuery().After("gorm:row_query").Register("dataaccess:instrument_end", ds.endQuery)
+}
+
+// instrument times a statement that does not pass the callbacks, e.g. one run with gorm's Exec or
+// on a connection of its own, with run returning the number of rows it affected
+func (ds *DataSource) instrument(ctx context.Context, query string, run func() (int64, error)) error {
+	timer := startQueryTimer(ctx)
+	rows, err := run()
+	ds.finishQuery(timer, sqlEvent(query, rows, err))
+	return err
+}
+
+func (ds *DataSource) startQuery(scope *gorm.Scope) {
+	scope.Set(queryTimerKey, startQueryTimer(queryContext(scope)))
+}
+
+func (ds *DataSource) endQuery(scope *gorm.Scope) {
+	timer, ok := scope.Get(queryTimerKey)
+	if !ok {
+		return
+	}
+	ds.finishQuery(timer.(*queryTimer), QueryEvent{
+		Table:      scope.TableName(),
+		Operation:  sqlOperation(scope.SQL),
+		SQL:        scope.SQL,
+		Rows:       scope.DB().RowsAffected,
+		ErrorClass: ErrorClass(scope.DB().Error),
+	})
+}
+
+// queryTimer measures a query and, when its context is traced, its datastore segment
+type queryTimer struct {
+	ctx     context.Context
+	start   time.Time
+	segment *newrelic.SegmentStartTime
+}
+
+func startQueryTimer(ctx context.Context) *queryTimer {
+	timer := &queryTimer{ctx: ctx, start: time.Now()}
+	if txn, ok := TraceFromContext(ctx); ok {
+		segment := newrelic.StartSegmentNow(txn)
+		timer.segment = &segment
+	}
+	return timer
+}
+
+// finishQuery completes the event of a query with its duration and normalized SQL, ends its
+// segment, records it and passes it to the observer
+func (ds *DataSource) finishQuery(timer *queryTimer, event QueryEvent) {
+	event.DataSource = ds.name
+	event.SQL = NormalizeSQL(event.SQL)
+	event.Duration = time.Since(timer.start)
+
+	if timer.segment != nil {
+		config := ds.current().config
+		segment := newrelic.DatastoreSegment{
+			StartTime:          *timer.segment,
+			Product:            datastoreProducts[ds.Dialect()],
+			Collection:         event.Table,
+			Operation:          event.Operation,
+			ParameterizedQuery: event.SQL,
+			Host:               config.Host,
+			PortPathOrID:       config.Port,
+			DatabaseName:       config.Schema,
+		}
+		segment.End()
+	}
+
+	ds.recordQuery(event)
+	if observer, ok := queryObserver.Load().(QueryObserver); ok && observer != nil {
+		observer(timer.ctx, event)
+	}
+}
+
+// recordQuery adds the query to the metrics and logs it when it is slow
+func (ds *DataSource) recordQuery(event QueryEvent) {
+	key := QueryKey{DataSource: event.DataSource, Table: event.Table, Operation: event.Operation}
+	queryMetrics.Lock()
+	metrics, ok := queryMetrics.byKey[key]
+	if !ok {
+		metrics = &QueryMetrics{}
+		queryMetrics.byKey[key] = metrics
+	}
+	metrics.Count++
+	metrics.Rows += event.Rows
+	metrics.Duration += event.Duration
+	if event.Duration > metrics.Max {
+		metrics.Max = event.Duration
+	}
+	if event.ErrorClass != "" && event.ErrorClass != QUERY_ERROR_NOT_FOUND {
+		metrics.Errors++
+	}
+	queryMetrics.Unlock()
+
+	threshold := ds.current().config.SlowQueryThreshold.Duration
+	if threshold == 0 {
+		threshold = DEFAULT_SLOW_QUERY_THRESHOLD
+	}
+	if threshold > 0 && event.Duration >= threshold {
+		logger.WithFields(logger.Fields{
+			"datasource":  event.DataSource,
+			"table":       event.Table,
+			"operation":   event.Operation,
+			"duration":    event.Duration,
+			"rows":        event.Rows,
+			"error_class": event.ErrorClass,
+			"sql":         event.SQL,
+		}).Warn("Slow query")
+	}
+}
+
+func queryContext(scope *gorm.Scope) context.Context {
+	if ctx, ok := scope.Get(queryContextKey); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+// NormalizeSQL replaces the placeholders and literals of a statement by ?, and collapses lists of
+// placeholders and whitespace, so that statements differing only in their values read the same
+func NormalizeSQL(sql string) string {
+	sql = sqlPlaceholders.ReplaceAllString(sql, "?")
+	sql = sqlLiterals.ReplaceAllString(sql, "?")
+	sql = sqlLists.ReplaceAllString(sql, "(?)")
+	return strings.TrimSpace(sqlWhitespace.ReplaceAllString(sql, " "))
+}
+
+// sqlTable returns the first table a statement reads or writes, e.g. orders for
+// SELECT * FROM orders JOIN customers ...
+func sqlTable(sql string) string {
+	match := sqlTables.FindStringSubmatch(sql)
+	if match == nil {
+		return ""
+	}
+	return sqlQuotes.Replace(match[1])
+}
+
+// sqlOperation returns the verb of a statement, e.g. SELECT
+func sqlOperation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// ErrorClass classifies the error of a query into one of the QUERY_ERROR_ classes, empty for nil
+func ErrorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case gorm.IsRecordNotFoundError(err):
+		return QUERY_ERROR_NOT_FOUND
+	case errors.Is(err, context.Canceled):
+		return QUERY_ERROR_CANCELED
+	case errors.Is(err, context.DeadlineExceeded):
+		return QUERY_ERROR_TIMEOUT
+	case IsRetryable(err):
+		return QUERY_ERROR_SERIALIZATION
+	case errors.Is(err, driver.ErrBadConn):
+		return QUERY_ERROR_CONNECTION
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "23":
+			return QUERY_ERROR_CONSTRAINT
+		case pqErr.Code.Class() == "42":
+			return QUERY_ERROR_SYNTAX
+		case pqErr.Code.Class() == "08":
+			return QUERY_ERROR_CONNECTION
+		case pqErr.Code == "57014":
+			return QUERY_ERROR_CANCELED
+		}
+		return QUERY_ERROR_OTHER
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		// ER_DUP_ENTRY, ER_ROW_IS_REFERENCED_2, ER_NO_REFERENCED_ROW_2, ER_BAD_NULL_ERROR
+		case 1062, 1451, 1452, 1048:
+			return QUERY_ERROR_CONSTRAINT
+		// ER_PARSE_ERROR, ER_NO_SUCH_TABLE, ER_BAD_FIELD_ERROR
+		case 1064, 1146, 1054:
+			return QUERY_ERROR_SYNTAX
+		}
+		return QUERY_ERROR_OTHER
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if sqliteErr.Code == sqlite3.ErrConstraint {
+			return QUERY_ERROR_CONSTRAINT
+		}
+		if strings.Contains(sqliteErr.Error(), "syntax error") || strings.Contains(sqliteErr.Error(), "no such") {
+			return QUERY_ERROR_SYNTAX
+		}
+		return QUERY_ERROR_OTHER
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return QUERY_ERROR_CONNECTION
+	}
+	return QUERY_ERROR_OTHER
+}
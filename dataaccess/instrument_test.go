@@ -0,0 +1,203 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	newrelic "github.com/newrelic/go-agent"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	logger "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeTrace counts the segments started by the queries of a traced request. Its other methods
+// are not implemented.
+type fakeTrace struct {
+	newrelic.Transaction
+	segments int
+}
+
+func (t *fakeTrace) StartSegmentNow() newrelic.SegmentStartTime {
+	t.segments++
+	return newrelic.SegmentStartTime{}
+}
+
+var _ = Describe("query instrumentation", func() {
+	var (
+		ds   *dataaccess.DataSource
+		repo *dataaccess.Repository
+		ctx  = context.Background()
+	)
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&order{})
+		repo = dataaccess.NewRepository(ds, &order{})
+	})
+
+	AfterEach(func() {
+		dataaccess.SetQueryObserver(nil)
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	Context("normalized SQL", func() {
+		It("should replace literals and placeholders", func() {
+			Expect(dataaccess.NormalizeSQL(`SELECT * FROM "orders"  WHERE (customer = 'o''hara' AND total > 10.5 AND id = $1)`)).
+				To(Equal(`SELECT * FROM "orders" WHERE (customer = ? AND total > ? AND id = ?)`))
+		})
+
+		It("should collapse lists", func() {
+			Expect(dataaccess.NormalizeSQL("DELETE FROM orders WHERE id IN (?, ?,?)\n")).To(Equal("DELETE FROM orders WHERE id IN (?)"))
+			Expect(dataaccess.NormalizeSQL("SELECT * FROM tenant_a1.orders2 WHERE id IN (@p1, @p2)")).To(Equal("SELECT * FROM tenant_a1.orders2 WHERE id IN (?)"))
+		})
+	})
+
+	Context("error classes", func() {
+		It("should classify driver errors", func() {
+			Expect(dataaccess.ErrorClass(nil)).To(BeEmpty())
+			Expect(dataaccess.ErrorClass(gorm.ErrRecordNotFound)).To(Equal(dataaccess.QUERY_ERROR_NOT_FOUND))
+			Expect(dataaccess.ErrorClass(fmt.Errorf("query: %w", context.Canceled))).To(Equal(dataaccess.QUERY_ERROR_CANCELED))
+			Expect(dataaccess.ErrorClass(context.DeadlineExceeded)).To(Equal(dataaccess.QUERY_ERROR_TIMEOUT))
+			Expect(dataaccess.ErrorClass(&pq.Error{Code: "23505"})).To(Equal(dataaccess.QUERY_ERROR_CONSTRAINT))
+			Expect(dataaccess.ErrorClass(&pq.Error{Code: "42P01"})).To(Equal(dataaccess.QUERY_ERROR_SYNTAX))
+			Expect(dataaccess.ErrorClass(&pq.Error{Code: "40001"})).To(Equal(dataaccess.QUERY_ERROR_SERIALIZATION))
+			Expect(dataaccess.ErrorClass(&mysql.MySQLError{Number: 1062})).To(Equal(dataaccess.QUERY_ERROR_CONSTRAINT))
+			Expect(dataaccess.ErrorClass(errors.New("boom"))).To(Equal(dataaccess.QUERY_ERROR_OTHER))
+		})
+
+		It("should classify sqlite errors", func() {
+			err := ds.DB().Exec("SELEC 1").Error
+			Expect(dataaccess.ErrorClass(err)).To(Equal(dataaccess.QUERY_ERROR_SYNTAX))
+
+			Expect(repo.Create(ctx, &order{ID: 1})).To(Succeed())
+			err = repo.Create(ctx, &order{ID: 1})
+			Expect(dataaccess.ErrorClass(err)).To(Equal(dataaccess.QUERY_ERROR_CONSTRAINT))
+		})
+	})
+
+	It("should aggregate metrics per table and operation", func() {
+		Expect(repo.BulkCreate(ctx, []order{{Customer: "acme"}, {Customer: "globex"}})).To(Succeed())
+		var orders []order
+		_, err := repo.List(ctx, dataaccess.QuerySpec{}, &orders)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(repo.Get(ctx, &order{}, 99)).NotTo(Succeed())
+
+		stats := dataaccess.QueryStats()
+		inserts := stats[dataaccess.QueryKey{DataSource: ds.Name(), Table: "orders", Operation: "INSERT"}]
+		Expect(inserts.Count).To(BeEquivalentTo(2))
+		Expect(inserts.Rows).To(BeEquivalentTo(2))
+		Expect(inserts.Duration).To(BeNumerically(">", 0))
+		selects := stats[dataaccess.QueryKey{DataSource: ds.Name(), Table: "orders", Operation: "SELECT"}]
+		// the count and the page of List, and the Get
+		Expect(selects.Count).To(BeEquivalentTo(3))
+		Expect(selects.Errors).To(BeZero())
+	})
+
+	It("should pass every query to the observer", func() {
+		var (
+			mu     sync.Mutex
+			events []dataaccess.QueryEvent
+		)
+		type requestKey struct{}
+		dataaccess.SetQueryObserver(func(ctx context.Context, event dataaccess.QueryEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(ctx.Value(requestKey{})).To(Equal("r-1"))
+			events = append(events, event)
+		})
+
+		requestCtx := context.WithValue(ctx, requestKey{}, "r-1")
+		Expect(repo.Create(requestCtx, &order{Customer: "acme", Total: 10})).To(Succeed())
+		Expect(repo.Get(requestCtx, &order{}, 99)).NotTo(Succeed())
+
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Operation).To(Equal("INSERT"))
+		Expect(events[0].Table).To(Equal("orders"))
+		Expect(events[0].Rows).To(BeEquivalentTo(1))
+		Expect(events[0].SQL).NotTo(ContainSubstring("acme"))
+		Expect(events[1].ErrorClass).To(Equal(dataaccess.QUERY_ERROR_NOT_FOUND))
+	})
+
+	It("should instrument raw statements, which gorm runs without callbacks", func() {
+		var (
+			mu         sync.Mutex
+			operations []string
+		)
+		dataaccess.SetQueryObserver(func(ctx context.Context, event dataaccess.QueryEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			operations = append(operations, event.Operation)
+		})
+
+		Expect(ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			if err := tx.Exec("UPDATE orders SET status = ?", "open").Error; err != nil {
+				return err
+			}
+			return ds.WithTransaction(tx.Context(), func(nested *dataaccess.Tx) error { return nil })
+		})).To(Succeed())
+		_, err := ds.SQL().Exec(ctx, "DELETE FROM orders")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(operations).To(Equal([]string{"UPDATE", "SAVEPOINT", "RELEASE", "DELETE"}))
+	})
+
+	It("should log slow queries without their values", func() {
+		config := dataaccess.Configuration.DBConfig
+		config.Database = dataaccess.DIALECT_SQLITE
+		config.Schema = "file:slow?mode=memory&cache=shared"
+		config.SlowQueryThreshold = dataaccess.Duration{Duration: time.Nanosecond}
+		slow, err := dataaccess.RegisterDataSource("slow", config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(slow.DB().AutoMigrate(&order{}).Error).NotTo(HaveOccurred())
+
+		hook := test.NewGlobal()
+		defer logger.StandardLogger().ReplaceHooks(logger.LevelHooks{})
+		Expect(dataaccess.NewRepository(slow, &order{}).Create(ctx, &order{Customer: "acme"})).To(Succeed())
+
+		var entry *logger.Entry
+		for _, e := range hook.AllEntries() {
+			if e.Message == "Slow query" {
+				entry = e
+			}
+		}
+		Expect(entry).NotTo(BeNil())
+		Expect(entry.Level).To(Equal(logger.WarnLevel))
+		Expect(entry.Data).To(HaveKeyWithValue("table", "orders"))
+		Expect(entry.Data).To(HaveKeyWithValue("operation", "INSERT"))
+		Expect(entry.Data["sql"]).To(ContainSubstring(`INSERT INTO "orders"`))
+		Expect(entry.Data["sql"]).NotTo(ContainSubstring("acme"))
+	})
+
+	It("should not log queries under the threshold", func() {
+		hook := test.NewGlobal()
+		defer logger.StandardLogger().ReplaceHooks(logger.LevelHooks{})
+		Expect(repo.Create(ctx, &order{Customer: "acme"})).To(Succeed())
+		for _, e := range hook.AllEntries() {
+			Expect(e.Message).NotTo(Equal("Slow query"))
+		}
+	})
+
+	It("should record the queries of a traced request as segments", func() {
+		trace := &fakeTrace{}
+		handler := dataaccess.TraceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(repo.Create(r.Context(), &order{Customer: "acme"})).To(Succeed())
+			Expect(repo.Get(r.Context(), &order{}, 1)).To(Succeed())
+		}))
+		handler.ServeHTTP(trace, httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+		Expect(trace.segments).To(Equal(2))
+
+		// untraced requests start no segments
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+		Expect(trace.segments).To(Equal(2))
+	})
+})
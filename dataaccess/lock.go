@@ -0,0 +1,341 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_LOCK_TTL is how long a session lock survives failing renewals before it counts as lost
+	DEFAULT_LOCK_TTL            = 30 * time.Second
+	DEFAULT_LOCK_RENEW_INTERVAL = 10 * time.Second
+	DEFAULT_ELECTION_RETRY      = 5 * time.Second
+)
+
+// ErrLockHeld is returned when a lock is held by another session
+var ErrLockHeld = errors.New("the lock is held by another session")
+
+// LockOptions set how the lease of a session lock is renewed. Renewing checks that the session still
+// holds the lock; when the check fails for the TTL, or finds the lock gone, the lock is lost.
+type LockOptions struct {
+	// TTL is DEFAULT_LOCK_TTL unless set
+	TTL time.Duration
+	// RenewInterval is DEFAULT_LOCK_RENEW_INTERVAL unless set, and shorter than the TTL
+	RenewInterval time.Duration
+}
+
+// Lock is a session level advisory lock, held on a connection taken from the pool for as long as
+// the lock is held. It is released by Unlock, or by the database when the session ends, e.g. when
+// the instance holding it crashes. A credential rotation leaves the lock on its session of the
+// replaced pool until it is released.
+type Lock struct {
+	name string
+	// held checks that the session still holds the lock, release unlocks it and ends the session
+	held    func(ctx context.Context) (bool, error)
+	release func() error
+
+	lost    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	unlock  sync.Once
+	lostErr error
+}
+
+// LockKey returns the key of the advisory lock of a name
+func LockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// TryLock takes the named session lock if no other session holds it, and returns ErrLockHeld
+// otherwise. Only postgres supports advisory locks.
+func (ds *DataSource) TryLock(ctx context.Context, name string, options LockOptions) (*Lock, error) {
+	return ds.lock(ctx, name, options, "SELECT pg_try_advisory_lock($1), pg_backend_pid()")
+}
+
+// Lock waits for the named session lock until it is free or ctx is done
+func (ds *DataSource) Lock(ctx context.Context, name string, options LockOptions) (*Lock, error) {
+	return ds.lock(ctx, name, options, "SELECT true, pg_backend_pid() FROM pg_advisory_lock($1)")
+}
+
+func (ds *DataSource) lock(ctx context.Context, name string, options LockOptions, query string) (*Lock, error) {
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return nil, fmt.Errorf("advisory locks are not supported on %s", ds.Dialect())
+	}
+	p := ds.current()
+	conn, err := p.sessionConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := LockKey(name)
+	var (
+		locked bool
+		// pid is the backend of the session holding the lock
+		pid int64
+	)
+	// the statements run on the connection of the lock, which the instrumentation callbacks do not see
+	err = ds.instrument(ctx, query, func() (int64, error) {
+		return 1, conn.QueryRowContext(ctx, query, key).Scan(&locked, &pid)
+	})
+	if err != nil {
+		p.closeSessionConn(conn)
+		return nil, fmt.Errorf("locking %s: %w", name, err)
+	}
+	if !locked {
+		p.closeSessionConn(conn)
+		return nil, ErrLockHeld
+	}
+
+	// pg_locks shows the key of a lock split into its high and low 32 bits
+	high, low := int64(uint64(key)>>32), int64(uint32(key))
+	check := `SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory'
+		AND pid = pg_backend_pid() AND granted AND classid = $1 AND objid = $2 AND objsubid = 1)`
+	held := func(ctx context.Context) (bool, error) {
+		var held bool
+		err := ds.instrument(ctx, check, func() (int64, error) {
+			return 1, conn.QueryRowContext(ctx, check, high, low).Scan(&held)
+		})
+		return held, err
+	}
+	release := func() error {
+		defer p.closeSessionConn(conn)
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_LOCK_TTL)
+		defer cancel()
+		unlock := "SELECT pg_advisory_unlock($1)"
+		err := ds.instrument(ctx, unlock, func() (int64, error) {
+			_, err := conn.ExecContext(ctx, unlock, key)
+			return 0, err
+		})
+		if err != nil && err != sql.ErrConnDone {
+			// ending the session from another connection releases the lock, rather than returning the
+			// connection to the pool still locked
+			terminate := "SELECT pg_terminate_backend($1)"
+			terminateErr := ds.instrument(ctx, terminate, func() (int64, error) {
+				_, err := ds.DB().DB().ExecContext(ctx, terminate, pid)
+				return 0, err
+			})
+			if terminateErr != nil {
+				logger.WithFields(logger.Fields{"lock": name, "pid": pid, "error": terminateErr}).Warn("Ending the session of a lock failed")
+			}
+		}
+		if err == sql.ErrConnDone {
+			return nil
+		}
+		return err
+	}
+	return newLock(name, held, release, options), nil
+}
+
+// sessionConn takes the connection of a session lock from the primary of the pool. When a credential
+// rotation replaces the pool, its drain does not wait for the connection: the lock stays on its
+// session of the replaced pool until it is released, e.g. when the leader holding it resigns.
+func (p *pool) sessionConn(ctx context.Context) (*sql.Conn, error) {
+	conn, err := p.db.DB().Conn(ctx)
+	if err == nil {
+		atomic.AddInt32(&p.sessions, 1)
+	}
+	return conn, err
+}
+
+// closeSessionConn returns the connection of a session lock to the pool
+func (p *pool) closeSessionConn(conn *sql.Conn) error {
+	atomic.AddInt32(&p.sessions, -1)
+	return conn.Close()
+}
+
+func newLock(name string, held func(ctx context.Context) (bool, error), release func() error, options LockOptions) *Lock {
+	if options.TTL <= 0 {
+		options.TTL = DEFAULT_LOCK_TTL
+	}
+	if options.RenewInterval <= 0 {
+		options.RenewInterval = DEFAULT_LOCK_RENEW_INTERVAL
+	}
+	l := &Lock{
+		name:    name,
+		held:    held,
+		release: release,
+		lost:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go l.renew(options)
+	return l
+}
+
+// renew checks the lock at the renew interval until it is unlocked or lost
+func (l *Lock) renew(options LockOptions) {
+	defer close(l.done)
+	ticker := time.NewTicker(options.RenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), options.TTL)
+		held, err := l.held(ctx)
+		cancel()
+		switch {
+		case err == nil && held:
+			renewed = time.Now()
+			continue
+		case err == nil:
+			l.lostErr = fmt.Errorf("lock %s is no longer held", l.name)
+		case time.Since(renewed) >= options.TTL:
+			l.lostErr = fmt.Errorf("lock %s could not be renewed for %v: %w", l.name, options.TTL, err)
+		default:
+			logger.WithFields(logger.Fields{"lock": l.name, "error": err}).Warn("Renewing lock failed")
+			continue
+		}
+		logger.WithFields(logger.Fields{"lock": l.name, "error": l.lostErr}).Warn("Lock lost")
+		close(l.lost)
+		return
+	}
+}
+
+// Name returns the name of the lock
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Lost returns a channel that is closed when the lock is lost. Work guarded by the lock should stop
+// when it is, as another session may take the lock.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Unlock releases the lock. Unlocking a lock again does nothing, unlocking a lost lock returns the
+// reason it was lost.
+func (l *Lock) Unlock() error {
+	var err error
+	l.unlock.Do(func() {
+		close(l.stop)
+		<-l.done
+		err = l.release()
+		if l.lostErr != nil {
+			err = l.lostErr
+		}
+	})
+	return err
+}
+
+// TryLock takes the named lock until the transaction ends if no other session holds it, see
+// DataSource.TryLock
+func (tx *Tx) TryLock(name string) (bool, error) {
+	if tx.ds.Dialect() != DIALECT_POSTGRES {
+		return false, fmt.Errorf("advisory locks are not supported on %s", tx.ds.Dialect())
+	}
+	var locked bool
+	err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", LockKey(name)).Row().Scan(&locked)
+	return locked, err
+}
+
+// Lock waits for the named lock and holds it until the transaction ends
+func (tx *Tx) Lock(name string) error {
+	if tx.ds.Dialect() != DIALECT_POSTGRES {
+		return fmt.Errorf("advisory locks are not supported on %s", tx.ds.Dialect())
+	}
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", LockKey(name)).Error
+}
+
+// LeaderElection elects one of the instances running an election of the same name as leader, the
+// one holding the session lock of the name. Instances that are not leader try to take the lock at
+// the retry interval, so that one of them takes over when the leader stops or loses its lock.
+type LeaderElection struct {
+	name      string
+	onElected func(ctx context.Context)
+	onLost    func()
+	tryLock   func(ctx context.Context) (*Lock, error)
+	leader    int32
+
+	// RetryInterval is the wait between attempts to become leader
+	RetryInterval time.Duration
+	// Lease sets the renewal of the lock of the leader
+	Lease LockOptions
+}
+
+// NewLeaderElection creates an election of ds. The instance elected leader calls onElected with a
+// context that is done when it is no longer leader, and which onElected has to return on. onLost is
+// called once onElected returned, after the leadership ended. Either callback may be nil.
+func NewLeaderElection(ds *DataSource, name string, onElected func(ctx context.Context), onLost func()) *LeaderElection {
+	e := &LeaderElection{
+		name:          name,
+		onElected:     onElected,
+		onLost:        onLost,
+		RetryInterval: DEFAULT_ELECTION_RETRY,
+	}
+	e.tryLock = func(ctx context.Context) (*Lock, error) {
+		return ds.TryLock(ctx, "leader:"+name, e.Lease)
+	}
+	return e
+}
+
+// Run takes part in the election until ctx is done, resigning when the instance is leader
+func (e *LeaderElection) Run(ctx context.Context) error {
+	log := logger.WithField("election", e.name)
+	for {
+		lock, err := e.tryLock(ctx)
+		if err == nil {
+			e.lead(ctx, lock)
+		} else if err != ErrLockHeld && ctx.Err() == nil {
+			log.WithField("error", err).Warn("Taking part in the election failed")
+		}
+		if err := sleepContext(ctx, e.RetryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// IsLeader reports whether the instance is the leader
+func (e *LeaderElection) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// lead runs the callbacks of the leader until ctx is done or the lock is lost
+func (e *LeaderElection) lead(ctx context.Context, lock *Lock) {
+	log := logger.WithField("election", e.name)
+	log.Info("Elected leader")
+	atomic.StoreInt32(&e.leader, 1)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	elected := make(chan struct{})
+	go func() {
+		defer close(elected)
+		if e.onElected != nil {
+			e.onElected(leaderCtx)
+		}
+	}()
+	lost := false
+	select {
+	case <-ctx.Done():
+	case <-lock.Lost():
+		lost = true
+	}
+	cancel()
+	// the work of the leader stops before another instance may take over
+	<-elected
+	atomic.StoreInt32(&e.leader, 0)
+	err := lock.Unlock()
+	switch {
+	case lost:
+		log.WithField("error", err).Warn("Leadership lost")
+	case err != nil:
+		log.WithField("error", err).Warn("Releasing the leader lock failed")
+	default:
+		log.Info("Resigned leadership")
+	}
+	if e.onLost != nil {
+		e.onLost()
+	}
+}
@@ -0,0 +1,147 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("locks", func() {
+	var (
+		held     atomic.Value
+		released int32
+		options  = dataaccess.LockOptions{TTL: 50 * time.Millisecond, RenewInterval: 10 * time.Millisecond}
+	)
+
+	setHeld := func(ok bool, err error) {
+		held.Store(func() (bool, error) { return ok, err })
+	}
+	newLock := func() *dataaccess.Lock {
+		return dataaccess.NewTestLock("jobs", func(ctx context.Context) (bool, error) {
+			return held.Load().(func() (bool, error))()
+		}, func() error {
+			atomic.AddInt32(&released, 1)
+			return nil
+		}, options)
+	}
+
+	BeforeEach(func() {
+		setHeld(true, nil)
+		atomic.StoreInt32(&released, 0)
+	})
+
+	It("should hash names to keys", func() {
+		Expect(dataaccess.LockKey("jobs")).To(Equal(dataaccess.LockKey("jobs")))
+		Expect(dataaccess.LockKey("jobs")).NotTo(Equal(dataaccess.LockKey("reports")))
+	})
+
+	It("should keep a renewed lock until it is unlocked", func() {
+		lock := newLock()
+		Consistently(lock.Lost(), 100*time.Millisecond).ShouldNot(BeClosed())
+		Expect(lock.Unlock()).To(Succeed())
+		Expect(lock.Unlock()).To(Succeed())
+		Expect(atomic.LoadInt32(&released)).To(BeEquivalentTo(1))
+	})
+
+	It("should lose a lock the session no longer holds", func() {
+		lock := newLock()
+		setHeld(false, nil)
+		Eventually(lock.Lost()).Should(BeClosed())
+		Expect(lock.Unlock()).To(MatchError("lock jobs is no longer held"))
+		Expect(atomic.LoadInt32(&released)).To(BeEquivalentTo(1))
+	})
+
+	It("should lose a lock that cannot be renewed for the TTL", func() {
+		lock := newLock()
+		setHeld(false, errors.New("connection reset"))
+		Consistently(lock.Lost(), 30*time.Millisecond).ShouldNot(BeClosed())
+		Eventually(lock.Lost()).Should(BeClosed())
+		Expect(lock.Unlock()).To(MatchError(ContainSubstring("connection reset")))
+	})
+
+	It("should need postgres", func() {
+		ds := newSQLiteDataSource()
+		defer dataaccess.Shutdown()
+		_, err := ds.TryLock(context.Background(), "jobs", dataaccess.LockOptions{})
+		Expect(err).To(MatchError("advisory locks are not supported on sqlite3"))
+		Expect(ds.WithTransaction(context.Background(), func(tx *dataaccess.Tx) error {
+			return tx.Lock("jobs")
+		})).To(MatchError("advisory locks are not supported on sqlite3"))
+	})
+
+	Context("leader election", func() {
+		var (
+			election *dataaccess.LeaderElection
+			attempts int32
+			locks    chan *dataaccess.Lock
+			elected  chan context.Context
+			lost     chan struct{}
+			cancel   context.CancelFunc
+			stopped  chan error
+		)
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&attempts, 0)
+			locks = make(chan *dataaccess.Lock, 2)
+			elected = make(chan context.Context, 2)
+			lost = make(chan struct{}, 2)
+			election = dataaccess.NewLeaderElection(nil, "relay", func(ctx context.Context) {
+				elected <- ctx
+				<-ctx.Done()
+			}, func() {
+				lost <- struct{}{}
+			})
+			election.RetryInterval = 10 * time.Millisecond
+			election.SetTryLock(func(ctx context.Context) (*dataaccess.Lock, error) {
+				// another instance leads for the first attempts and while the lock is not held
+				if ok, _ := held.Load().(func() (bool, error))(); atomic.AddInt32(&attempts, 1) < 3 || !ok {
+					return nil, dataaccess.ErrLockHeld
+				}
+				lock := newLock()
+				locks <- lock
+				return lock, nil
+			})
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			stopped = make(chan error, 1)
+			go func() { stopped <- election.Run(ctx) }()
+		})
+
+		AfterEach(func() {
+			cancel()
+			Eventually(stopped).Should(Receive(MatchError(context.Canceled)))
+		})
+
+		It("should lead until the lock is lost and then campaign again", func() {
+			var leaderCtx context.Context
+			Eventually(elected).Should(Receive(&leaderCtx))
+			Expect(election.IsLeader()).To(BeTrue())
+			Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+
+			setHeld(false, nil)
+			Eventually(leaderCtx.Done()).Should(BeClosed())
+			Eventually(lost).Should(Receive())
+			Expect(election.IsLeader()).To(BeFalse())
+
+			setHeld(true, nil)
+			Eventually(elected).Should(Receive())
+		})
+
+		It("should resign when stopped", func() {
+			Eventually(elected).Should(Receive())
+			var lock *dataaccess.Lock
+			Expect(locks).To(Receive(&lock))
+			cancel()
+			Eventually(lost).Should(Receive())
+			Expect(election.IsLeader()).To(BeFalse())
+			Expect(atomic.LoadInt32(&released)).To(BeEquivalentTo(1))
+		})
+	})
+})
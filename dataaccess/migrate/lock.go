@@ -0,0 +1,193 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// lock makes sure only one instance migrates a database at a time
+type lock interface {
+	acquire(ctx context.Context, timeout time.Duration) error
+	release(ctx context.Context) error
+}
+
+func newLock(db *sql.DB, dialect string, table string) lock {
+	switch dialect {
+	case POSTGRES:
+		return &advisoryLock{db: db, key: lockKey(table)}
+	case MYSQL:
+		return &namedLock{db: db, name: table + "_lock"}
+	case MSSQL:
+		return &appLock{db: db, resource: table + "_lock"}
+	default:
+		return &tableLock{db: db, dialect: dialect, table: table + "_lock"}
+	}
+}
+
+// lockKey hashes the ledger table name into a Postgres advisory lock key
+func lockKey(table string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("migrate:" + table))
+	return int64(h.Sum64())
+}
+
+// pollLock calls try until it reports the lock as taken or the timeout passes
+func pollLock(ctx context.Context, timeout time.Duration, try func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		acquired, err := try()
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ErrLocked, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// advisoryLock holds a Postgres session level advisory lock on a dedicated connection
+type advisoryLock struct {
+	db   *sql.DB
+	key  int64
+	conn *sql.Conn
+}
+
+func (l *advisoryLock) acquire(ctx context.Context, timeout time.Duration) error {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	err = pollLock(ctx, timeout, func() (acquired bool, err error) {
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired)
+		return
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+func (l *advisoryLock) release(ctx context.Context) error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	return err
+}
+
+// namedLock holds a MySQL GET_LOCK lock on a dedicated connection
+type namedLock struct {
+	db   *sql.DB
+	name string
+	conn *sql.Conn
+}
+
+func (l *namedLock) acquire(ctx context.Context, timeout time.Duration) error {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", l.name, int(timeout.Seconds())).Scan(&acquired)
+	if err == nil && acquired.Int64 != 1 {
+		err = ErrLocked
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+func (l *namedLock) release(ctx context.Context) error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", l.name)
+	return err
+}
+
+// appLock holds a SQL Server session owned application lock on a dedicated connection
+type appLock struct {
+	db       *sql.DB
+	resource string
+	conn     *sql.Conn
+}
+
+func (l *appLock) acquire(ctx context.Context, timeout time.Duration) error {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var result int
+	err = conn.QueryRowContext(ctx, `DECLARE @result int;
+EXEC @result = sp_getapplock @Resource = @p1, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = @p2;
+SELECT @result`, l.resource, timeout.Milliseconds()).Scan(&result)
+	if err == nil && result < 0 {
+		err = ErrLocked
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+func (l *appLock) release(ctx context.Context) error {
+	defer l.conn.Close()
+	_, err := l.conn.ExecContext(ctx, "EXEC sp_releaseapplock @Resource = @p1, @LockOwner = 'Session'", l.resource)
+	return err
+}
+
+// tableLock is used by databases without a lock primitive, e.g. sqlite. The lock is a row in
+// a lock table; a crashed migration leaves it behind and it has to be deleted by hand.
+type tableLock struct {
+	db      *sql.DB
+	dialect string
+	table   string
+}
+
+func (l *tableLock) acquire(ctx context.Context, timeout time.Duration) error {
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY, locked_at TIMESTAMP NOT NULL)", l.table)
+	if _, err := l.db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (id, locked_at) VALUES (1, %s)", l.table, placeholder(l.dialect, 1))
+	return pollLock(ctx, timeout, func() (bool, error) {
+		// the primary key rejects a second lock row, any other error is not about the lock
+		_, err := l.db.ExecContext(ctx, insert, time.Now().UTC())
+		if err != nil && !isUniqueViolation(err) {
+			return false, err
+		}
+		return err == nil, nil
+	})
+}
+
+// isUniqueViolation reports whether err is a unique or primary key violation. The package works on
+// any database/sql driver, so the error is recognised by the messages of the supported databases.
+func isUniqueViolation(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, violation := range []string{"unique constraint", "duplicate key", "duplicate entry", "violation of primary key"} {
+		if strings.Contains(message, violation) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *tableLock) release(ctx context.Context) error {
+	_, err := l.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = 1", l.table))
+	return err
+}
@@ -0,0 +1,299 @@
+// Package migrate applies versioned schema migrations and records them in a ledger table.
+//
+// Migrations are SQL files named <version>_<name>.up.sql / .down.sql, read from a directory or an
+// embedded file system, or Go functions created with NewGoMigration. Each migration runs in its
+// own transaction together with its ledger entry. A database level lock makes sure only one
+// instance migrates at a time when several CF instances start together.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	POSTGRES = "postgres"
+	MYSQL    = "mysql"
+	SQLITE   = "sqlite3"
+	MSSQL    = "mssql"
+
+	// DEFAULT_TABLE is the ledger table of applied migrations
+	DEFAULT_TABLE        = "schema_migrations"
+	DEFAULT_LOCK_TIMEOUT = time.Minute
+)
+
+var (
+	// ErrLocked is returned when another instance holds the migration lock for longer than the lock timeout
+	ErrLocked = errors.New("migrations are locked by another instance")
+
+	// ErrChecksumMismatch is returned when an applied migration was changed afterwards
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+
+	// ErrIrreversible is returned when rolling back a migration without a down step
+	ErrIrreversible = errors.New("migration cannot be rolled back")
+)
+
+// Migrator applies migrations to one database
+type Migrator struct {
+	// Table is the ledger table, DEFAULT_TABLE unless set
+	Table string
+	// LockTimeout is how long to wait for another instance to finish migrating
+	LockTimeout time.Duration
+
+	db         *sql.DB
+	dialect    string
+	migrations []*Migration
+}
+
+// Status describes a known or applied migration
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set when the migration changed after it was applied
+	Modified bool
+	// Missing is set when an applied migration is no longer part of the migration set
+	Missing bool
+}
+
+type ledgerEntry struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// New creates a migrator for a database of the given gorm dialect
+func New(db *sql.DB, dialect string, migrations []*Migration) (*Migrator, error) {
+	seen := map[int64]bool{}
+	sorted := make([]*Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if seen[m.Version] {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+		seen[m.Version] = true
+		sorted = append(sorted, m)
+	}
+	sortMigrations(sorted)
+	return &Migrator{Table: DEFAULT_TABLE, LockTimeout: DEFAULT_LOCK_TIMEOUT, db: db, dialect: dialect, migrations: sorted}, nil
+}
+
+// Up applies all pending migrations and returns the ones applied
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	if len(m.migrations) == 0 {
+		return nil, nil
+	}
+	return m.migrateTo(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the given number of most recently applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var reverted []*Migration
+	err := m.locked(ctx, func(applied map[int64]ledgerEntry) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.revert(ctx, migration); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// To migrates up or down until version is the latest applied migration. Version 0 reverts all.
+func (m *Migrator) To(ctx context.Context, version int64) ([]*Migration, error) {
+	return m.migrateTo(ctx, version)
+}
+
+// Status lists every known migration and every applied migration that is no longer known, in the
+// order of their versions
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.ensureLedger(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []Status
+	known := map[int64]bool{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+		s := Status{Version: migration.Version, Name: migration.Name}
+		if entry, ok := applied[migration.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = entry.appliedAt
+			s.Modified = entry.checksum != migration.Checksum
+		}
+		status = append(status, s)
+	}
+	for version, entry := range applied {
+		if !known[version] {
+			status = append(status, Status{Version: version, Name: entry.name, Applied: true, AppliedAt: entry.appliedAt, Missing: true})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+	return status, nil
+}
+
+func (m *Migrator) migrateTo(ctx context.Context, version int64) ([]*Migration, error) {
+	var changed []*Migration
+	err := m.locked(ctx, func(applied map[int64]ledgerEntry) error {
+		for _, migration := range m.migrations {
+			entry, ok := applied[migration.Version]
+			if ok && entry.checksum != migration.Checksum {
+				return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+			}
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := m.revert(ctx, migration); err != nil {
+					return err
+				}
+				changed = append(changed, migration)
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, migration); err != nil {
+					return err
+				}
+				changed = append(changed, migration)
+			}
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// locked runs fn while holding the migration lock, passing the current ledger
+func (m *Migrator) locked(ctx context.Context, fn func(applied map[int64]ledgerEntry) error) error {
+	l := newLock(m.db, m.dialect, m.Table)
+	if err := l.acquire(ctx, m.LockTimeout); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer func() {
+		if err := l.release(context.Background()); err != nil {
+			logger.Error("Releasing migration lock failed: ", err)
+		}
+	}()
+
+	// created under the lock, so that instances starting together do not race to create it
+	if err := m.ensureLedger(ctx); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(applied)
+}
+
+func (m *Migrator) apply(ctx context.Context, migration *Migration) error {
+	logger.Infof("Applying migration %d_%s", migration.Version, migration.Name)
+	insert := fmt.Sprintf("INSERT INTO %s (version, name, checksum, applied_at) VALUES (%s, %s, %s, %s)",
+		m.Table, placeholder(m.dialect, 1), placeholder(m.dialect, 2), placeholder(m.dialect, 3), placeholder(m.dialect, 4))
+	return m.inTransaction(ctx, migration, migration.up, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, insert, migration.Version, migration.Name, migration.Checksum, time.Now().UTC())
+		return err
+	})
+}
+
+func (m *Migrator) revert(ctx context.Context, migration *Migration) error {
+	if migration.down == nil {
+		return fmt.Errorf("%w: %d_%s", ErrIrreversible, migration.Version, migration.Name)
+	}
+	logger.Infof("Reverting migration %d_%s", migration.Version, migration.Name)
+	remove := fmt.Sprintf("DELETE FROM %s WHERE version = %s", m.Table, placeholder(m.dialect, 1))
+	return m.inTransaction(ctx, migration, migration.down, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, remove, migration.Version)
+		return err
+	})
+}
+
+func (m *Migrator) inTransaction(ctx context.Context, migration *Migration, step func(tx *sql.Tx) error, record func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := step(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("recording migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+	return tx.Commit()
+}
+
+// ensureLedger creates the ledger unless it exists. Status creates it without the lock, so losing a
+// race to create it, e.g. on postgres, whose IF NOT EXISTS is not safe under concurrency, is ignored.
+func (m *Migrator) ensureLedger(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, ledgerDDL(m.dialect, m.Table))
+	if err != nil && (isUniqueViolation(err) || strings.Contains(strings.ToLower(err.Error()), "already exists")) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating migration ledger %s: %w", m.Table, err)
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int64]ledgerEntry, error) {
+	rows, err := m.db.QueryContext(ctx, fmt.Sprintf("SELECT version, name, checksum, applied_at FROM %s", m.Table))
+	if err != nil {
+		return nil, fmt.Errorf("reading migration ledger %s: %w", m.Table, err)
+	}
+	defer rows.Close()
+
+	applied := map[int64]ledgerEntry{}
+	for rows.Next() {
+		var entry ledgerEntry
+		if err := rows.Scan(&entry.version, &entry.name, &entry.checksum, &entry.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[entry.version] = entry
+	}
+	return applied, rows.Err()
+}
+
+func ledgerDDL(dialect string, table string) string {
+	columns := "version BIGINT PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum VARCHAR(64) NOT NULL, applied_at TIMESTAMP NOT NULL"
+	if dialect == MSSQL {
+		columns = strings.Replace(columns, "TIMESTAMP", "DATETIME2", 1)
+		return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (%s)", table, table, columns)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, columns)
+}
+
+// placeholder returns the n-th bind parameter marker of the dialect
+func placeholder(dialect string, n int) string {
+	switch dialect {
+	case POSTGRES:
+		return fmt.Sprintf("$%d", n)
+	case MSSQL:
+		return fmt.Sprintf("@p%d", n)
+	default:
+		return "?"
+	}
+}
@@ -0,0 +1,169 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing/fstest"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess/migrate"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var migrations = fstest.MapFS{
+	"migrations/0001_create_orders.up.sql":   {Data: []byte("CREATE TABLE orders (id INTEGER PRIMARY KEY, note TEXT DEFAULT 'a;b'); -- keeps ; in strings\nCREATE INDEX orders_note ON orders (note);")},
+	"migrations/0001_create_orders.down.sql": {Data: []byte("DROP TABLE orders;")},
+	"migrations/0002_add_customer.up.sql":    {Data: []byte("ALTER TABLE orders ADD COLUMN customer TEXT;")},
+	"migrations/0002_add_customer.down.sql":  {Data: []byte("CREATE TABLE orders_old (id INTEGER PRIMARY KEY, note TEXT); INSERT INTO orders_old SELECT id, note FROM orders; DROP TABLE orders; ALTER TABLE orders_old RENAME TO orders;")},
+	"migrations/README.md":                   {Data: []byte("not a migration")},
+}
+
+var _ = Describe("migrate", func() {
+	var (
+		db       *sql.DB
+		migrator *migrate.Migrator
+		ctx      = context.Background()
+		dbCount  int
+	)
+
+	load := func(extra ...*migrate.Migration) *migrate.Migrator {
+		loaded, err := migrate.FromFS(migrations, "migrations")
+		Expect(err).NotTo(HaveOccurred())
+		m, err := migrate.New(db, migrate.SQLITE, append(loaded, extra...))
+		Expect(err).NotTo(HaveOccurred())
+		return m
+	}
+
+	BeforeEach(func() {
+		dbCount++
+		var err error
+		db, err = sql.Open("sqlite3", fmt.Sprintf("file:migrate%d?mode=memory&cache=shared", dbCount))
+		Expect(err).NotTo(HaveOccurred())
+		migrator = load()
+	})
+
+	AfterEach(func() {
+		db.Close()
+	})
+
+	hasColumn := func(column string) bool {
+		var count int
+		Expect(db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('orders') WHERE name = ?", column).Scan(&count)).To(Succeed())
+		return count == 1
+	}
+
+	It("applies pending migrations in order and records them", func() {
+		applied, err := migrator.Up(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied).To(HaveLen(2))
+		Expect(applied[0].Name).To(Equal("create_orders"))
+		Expect(hasColumn("customer")).To(BeTrue())
+
+		applied, err = migrator.Up(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(applied).To(BeEmpty())
+	})
+
+	It("reports the status of every migration", func() {
+		_, err := migrator.To(ctx, 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		status, err := migrator.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status).To(HaveLen(2))
+		Expect(status[0].Applied).To(BeTrue())
+		Expect(status[0].AppliedAt).NotTo(BeZero())
+		Expect(status[1].Applied).To(BeFalse())
+	})
+
+	It("lists the applied migrations that are no longer known in order", func() {
+		_, err := migrator.Up(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		m, err := migrate.New(db, migrate.SQLITE, []*migrate.Migration{
+			migrate.NewGoMigration(5, "seed_orders", func(tx *sql.Tx) error { return nil }, nil),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		status, err := m.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status).To(HaveLen(3))
+		for i, version := range []int64{1, 2, 5} {
+			Expect(status[i].Version).To(Equal(version))
+			Expect(status[i].Missing).To(Equal(version != 5))
+		}
+	})
+
+	It("rolls back with down and to", func() {
+		_, err := migrator.Up(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		reverted, err := migrator.Down(ctx, 1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reverted).To(HaveLen(1))
+		Expect(hasColumn("customer")).To(BeFalse())
+
+		_, err = migrator.To(ctx, 0)
+		Expect(err).NotTo(HaveOccurred())
+		status, err := migrator.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status[0].Applied).To(BeFalse())
+	})
+
+	It("runs Go migrations", func() {
+		seed := migrate.NewGoMigration(3, "seed_orders", func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO orders (id, customer) VALUES (1, 'acme')")
+			return err
+		}, nil)
+		_, err := load(seed).Up(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		var customer string
+		Expect(db.QueryRow("SELECT customer FROM orders WHERE id = 1").Scan(&customer)).To(Succeed())
+		Expect(customer).To(Equal("acme"))
+
+		_, err = load(seed).Down(ctx, 1)
+		Expect(err).To(MatchError(ContainSubstring(migrate.ErrIrreversible.Error())))
+	})
+
+	It("refuses to migrate when an applied migration was modified", func() {
+		_, err := migrator.To(ctx, 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		changed := fstest.MapFS{"0001_create_orders.up.sql": {Data: []byte("CREATE TABLE orders (id INTEGER PRIMARY KEY)")}}
+		loaded, err := migrate.FromFS(changed, ".")
+		Expect(err).NotTo(HaveOccurred())
+		m, err := migrate.New(db, migrate.SQLITE, loaded)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = m.Up(ctx)
+		Expect(err).To(MatchError(ContainSubstring(migrate.ErrChecksumMismatch.Error())))
+		status, err := m.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status[0].Modified).To(BeTrue())
+	})
+
+	It("waits for the lock held by another instance", func() {
+		_, err := db.Exec("CREATE TABLE schema_migrations_lock (id INTEGER PRIMARY KEY, locked_at TIMESTAMP NOT NULL)")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = db.Exec("INSERT INTO schema_migrations_lock (id, locked_at) VALUES (1, CURRENT_TIMESTAMP)")
+		Expect(err).NotTo(HaveOccurred())
+
+		migrator.LockTimeout = 300 * time.Millisecond
+		_, err = migrator.Up(ctx)
+		Expect(err).To(MatchError(ContainSubstring(migrate.ErrLocked.Error())))
+	})
+
+	It("returns errors other than a held lock right away", func() {
+		_, err := db.Exec("CREATE TABLE schema_migrations_lock (id INTEGER PRIMARY KEY)")
+		Expect(err).NotTo(HaveOccurred())
+
+		migrator.LockTimeout = time.Minute
+		_, err = migrator.Up(ctx)
+		Expect(err).To(MatchError(ContainSubstring("no column named locked_at")))
+		Expect(err).NotTo(MatchError(ContainSubstring(migrate.ErrLocked.Error())))
+	})
+})
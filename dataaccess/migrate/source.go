@@ -0,0 +1,208 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration is a single versioned schema change. SQL migrations are loaded from files,
+// Go migrations are created with NewGoMigration.
+type Migration struct {
+	Version  int64
+	Name     string
+	Checksum string
+
+	up   func(tx *sql.Tx) error
+	down func(tx *sql.Tx) error
+}
+
+// migration files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+var fileNamePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// FromDir loads the SQL migrations of a directory
+func FromDir(dir string) ([]*Migration, error) {
+	return FromFS(os.DirFS(dir), ".")
+}
+
+// FromFS loads the SQL migrations of a directory in a file system, e.g. an embed.FS
+func FromFS(fsys fs.FS, dir string) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations: %w", err)
+	}
+
+	byVersion := map[int64]*sqlMigration{}
+	for _, entry := range entries {
+		match := fileNamePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &sqlMigration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+		}
+		migrations = append(migrations, m.migration())
+	}
+	sortMigrations(migrations)
+	return migrations, nil
+}
+
+// NewGoMigration creates a migration implemented in Go. A nil down function makes the
+// migration irreversible.
+func NewGoMigration(version int64, name string, up, down func(tx *sql.Tx) error) *Migration {
+	return &Migration{Version: version, Name: name, Checksum: checksum("go:" + name), up: up, down: down}
+}
+
+type sqlMigration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+func (m *sqlMigration) migration() *Migration {
+	migration := &Migration{Version: m.version, Name: m.name, Checksum: checksum(m.up), up: execScript(m.up)}
+	if m.down != "" {
+		migration.down = execScript(m.down)
+	}
+	return migration
+}
+
+// execScript runs the statements of a SQL script one by one, since not every driver accepts
+// several statements in a single Exec
+func execScript(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range splitStatements(script) {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("%w in statement: %s", err, statement)
+			}
+		}
+		return nil
+	}
+}
+
+// splitStatements splits a script on semicolons outside of quotes, comments and
+// Postgres dollar quoted bodies
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(script) {
+				if script[end] == c {
+					// doubled quotes escape themselves
+					if end+1 < len(script) && script[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			current.WriteString(script[i:min(end+1, len(script))])
+			i = end
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+				current.WriteByte('\n')
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+		case c == '$':
+			if tag := dollarTag(script[i:]); tag != "" {
+				end := strings.Index(script[i+len(tag):], tag)
+				if end < 0 {
+					current.WriteString(script[i:])
+					i = len(script)
+				} else {
+					stop := i + len(tag) + end + len(tag)
+					current.WriteString(script[i:stop])
+					i = stop - 1
+				}
+			} else {
+				current.WriteByte(c)
+			}
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+var dollarTagPattern = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+func dollarTag(s string) string {
+	return dollarTagPattern.FindString(s)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func sortMigrations(migrations []*Migration) {
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
@@ -0,0 +1,279 @@
+package dataaccess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	CHANGE_INSERT = "INSERT"
+	CHANGE_UPDATE = "UPDATE"
+	CHANGE_DELETE = "DELETE"
+	// CHANGE_RESYNC is the operation of the change event delivered after the connection of a
+	// subscription was lost. Changes made meanwhile were missed, so subscribers reload what they track.
+	CHANGE_RESYNC = "RESYNC"
+
+	DEFAULT_LISTEN_MIN_RECONNECT = 100 * time.Millisecond
+	DEFAULT_LISTEN_MAX_RECONNECT = time.Minute
+	// DEFAULT_LISTEN_PING_INTERVAL is how often an idle subscription checks its connection
+	DEFAULT_LISTEN_PING_INTERVAL = 90 * time.Second
+	DEFAULT_NOTIFICATION_BUFFER  = 64
+
+	// changeTriggerFunction is the trigger function installed by InstallChangeTrigger
+	changeTriggerFunction = "dataaccess_notify_change"
+)
+
+// Notification is a notification received by a Subscription. A notification with an empty
+// Channel marks a reconnect, after which notifications sent while disconnected are lost.
+type Notification struct {
+	Channel string
+	Payload string
+	// PID of the server process of the session that sent the notification
+	PID int
+}
+
+// Reconnected reports whether the notification marks a reconnect of the subscription
+func (n Notification) Reconnected() bool {
+	return n.Channel == ""
+}
+
+// Decode decodes the JSON payload of the notification into v
+func (n Notification) Decode(v interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(n.Payload))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// ChangeEvent is the payload of the notifications sent by the triggers of InstallChangeTrigger
+type ChangeEvent struct {
+	Channel   string `json:"-"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Operation string `json:"operation"`
+	// Key holds the key columns of the changed row. Numbers are json.Number to keep large ids exact.
+	Key map[string]interface{} `json:"key"`
+}
+
+// Subscription receives the notifications of the channels it listens to on a dedicated connection,
+// which is reestablished when lost. It is closed by Close or when the context it was created with
+// is done.
+type Subscription struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	notifications chan Notification
+	done          chan struct{}
+	// close closes the connection once the subscription stopped
+	close    func() error
+	closeErr error
+}
+
+// Listen subscribes to notifications sent on the channels with NOTIFY or pg_notify. Only postgres
+// supports notifications.
+func (ds *DataSource) Listen(ctx context.Context, channels ...string) (*Subscription, error) {
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return nil, fmt.Errorf("notifications are not supported on %s", ds.Dialect())
+	}
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("a subscription needs at least one channel")
+	}
+	config := ds.current().config
+	config.Replicas = nil
+	dsn, err := buildDSN(config)
+	if err != nil {
+		return nil, err
+	}
+
+	log := logger.WithFields(logger.Fields{"datasource": ds.name, "channels": channels})
+	listener := pq.NewListener(dsn, DEFAULT_LISTEN_MIN_RECONNECT, DEFAULT_LISTEN_MAX_RECONNECT, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.WithField("error", config.redactError(err)).Warn("Notification connection lost")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.WithField("error", config.redactError(err)).Warn("Reconnecting notification connection failed")
+		case pq.ListenerEventReconnected:
+			log.Info("Notification connection reestablished")
+		}
+	})
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("listening to %s: %w", channel, config.redactError(err))
+		}
+	}
+	return newSubscription(ctx, listener.Notify, listener.Ping, listener.Close), nil
+}
+
+func newSubscription(ctx context.Context, notify <-chan *pq.Notification, ping func() error, close func() error) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		ctx:           ctx,
+		cancel:        cancel,
+		notifications: make(chan Notification, DEFAULT_NOTIFICATION_BUFFER),
+		done:          make(chan struct{}),
+		close:         close,
+	}
+	go s.run(notify, ping)
+	return s
+}
+
+func (s *Subscription) run(notify <-chan *pq.Notification, ping func() error) {
+	defer func() {
+		close(s.notifications)
+		if s.close != nil {
+			s.closeErr = s.close()
+		}
+		close(s.done)
+	}()
+
+	ticker := time.NewTicker(DEFAULT_LISTEN_PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			// a failing ping makes the listener reconnect
+			if ping != nil {
+				go ping()
+			}
+		case n, ok := <-notify:
+			if !ok {
+				return
+			}
+			// the listener sends nil after reconnecting
+			var notification Notification
+			if n != nil {
+				notification = Notification{Channel: n.Channel, Payload: n.Extra, PID: n.BePid}
+			}
+			select {
+			case s.notifications <- notification:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Notifications returns the channel the notifications are delivered on. It is closed when the
+// subscription stops.
+func (s *Subscription) Notifications() <-chan Notification {
+	return s.notifications
+}
+
+// Changes decodes the notifications of change triggers into change events. A reconnect is
+// delivered as a change event with operation CHANGE_RESYNC, payloads that are no change events
+// are logged and dropped. Use either Changes or Notifications.
+func (s *Subscription) Changes() <-chan ChangeEvent {
+	changes := make(chan ChangeEvent, DEFAULT_NOTIFICATION_BUFFER)
+	go func() {
+		defer close(changes)
+		for n := range s.notifications {
+			event := ChangeEvent{Operation: CHANGE_RESYNC}
+			if !n.Reconnected() {
+				event = ChangeEvent{}
+				if err := n.Decode(&event); err != nil || event.Operation == "" {
+					logger.WithFields(logger.Fields{"channel": n.Channel, "error": err}).Warn("Dropping notification that is no change event")
+					continue
+				}
+			}
+			event.Channel = n.Channel
+			select {
+			case changes <- event:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes
+}
+
+// Close stops the subscription and closes its connection
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return s.closeErr
+}
+
+// InstallChangeTrigger installs a trigger that sends a change event to channel for every row
+// inserted, updated or deleted in table. The event carries the key columns of the row, id unless
+// given, rather than the row itself, as notification payloads are limited to 8000 bytes.
+// Installing the trigger again replaces it.
+func (ds *DataSource) InstallChangeTrigger(ctx context.Context, table string, channel string, keyColumns ...string) error {
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return fmt.Errorf("change triggers are not supported on %s", ds.Dialect())
+	}
+	_, err := ds.SQL().Exec(ctx, ChangeTriggerSQL(table, channel, keyColumns...))
+	return err
+}
+
+// DropChangeTrigger removes the trigger installed by InstallChangeTrigger from table
+func (ds *DataSource) DropChangeTrigger(ctx context.Context, table string) error {
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return fmt.Errorf("change triggers are not supported on %s", ds.Dialect())
+	}
+	_, err := ds.SQL().Exec(ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", changeTriggerName(table), quoteQualified(table)))
+	return err
+}
+
+// ChangeTriggerSQL returns the statements InstallChangeTrigger runs, e.g. for a migration
+func ChangeTriggerSQL(table string, channel string, keyColumns ...string) string {
+	if len(keyColumns) == 0 {
+		keyColumns = []string{"id"}
+	}
+	args := make([]string, 0, len(keyColumns)+1)
+	for _, arg := range append([]string{channel}, keyColumns...) {
+		args = append(args, quoteLiteral(arg))
+	}
+
+	var statements bytes.Buffer
+	fmt.Fprintf(&statements, `CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+DECLARE
+	data jsonb;
+	key jsonb := '{}';
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		data := to_jsonb(OLD);
+	ELSE
+		data := to_jsonb(NEW);
+	END IF;
+	FOR i IN 1 .. TG_NARGS - 1 LOOP
+		key := key || jsonb_build_object(TG_ARGV[i], data -> TG_ARGV[i]);
+	END LOOP;
+	PERFORM pg_notify(TG_ARGV[0], jsonb_build_object(
+		'schema', TG_TABLE_SCHEMA, 'table', TG_TABLE_NAME, 'operation', TG_OP, 'key', key)::text);
+	RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+`, changeTriggerFunction)
+	name, quoted := changeTriggerName(table), quoteQualified(table)
+	fmt.Fprintf(&statements, "DROP TRIGGER IF EXISTS %s ON %s;\n", name, quoted)
+	fmt.Fprintf(&statements, "CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE %s(%s);\n",
+		name, quoted, changeTriggerFunction, strings.Join(args, ", "))
+	return statements.String()
+}
+
+// changeTriggerName returns the quoted name of the change trigger of a table
+func changeTriggerName(table string) string {
+	return pq.QuoteIdentifier(strings.ReplaceAll(table, ".", "_") + "_notify_change")
+}
+
+// quoteQualified quotes a table name optionally qualified with its schema
+func quoteQualified(table string) string {
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteLiteral quotes a string literal, with backslashes taken literally as in standard SQL
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,93 @@
+package dataaccess_test
+
+import (
+	"context"
+	"encoding/json"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("notifications", func() {
+	var (
+		notify chan *pq.Notification
+		closed int
+		sub    *dataaccess.Subscription
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		notify = make(chan *pq.Notification, 4)
+		closed = 0
+		ctx, cancel = context.WithCancel(context.Background())
+		sub = dataaccess.NewTestSubscription(ctx, notify, func() error {
+			closed++
+			return nil
+		})
+	})
+
+	AfterEach(func() {
+		cancel()
+		Expect(sub.Close()).To(Succeed())
+	})
+
+	It("should deliver the notifications and reconnects", func() {
+		notify <- &pq.Notification{Channel: "orders", Extra: `{"id": 1}`, BePid: 42}
+		notify <- nil
+
+		var n dataaccess.Notification
+		Eventually(sub.Notifications()).Should(Receive(&n))
+		Expect(n).To(Equal(dataaccess.Notification{Channel: "orders", Payload: `{"id": 1}`, PID: 42}))
+		var payload struct{ Id int }
+		Expect(n.Decode(&payload)).To(Succeed())
+		Expect(payload.Id).To(Equal(1))
+
+		Eventually(sub.Notifications()).Should(Receive(&n))
+		Expect(n.Reconnected()).To(BeTrue())
+	})
+
+	It("should decode change events", func() {
+		changes := sub.Changes()
+		notify <- &pq.Notification{Channel: "changes", Extra: "not json"}
+		notify <- &pq.Notification{Channel: "changes", Extra: `{"schema": "public", "table": "orders", "operation": "UPDATE", "key": {"id": 9007199254740993}}`}
+		notify <- nil
+
+		var event dataaccess.ChangeEvent
+		Eventually(changes).Should(Receive(&event))
+		Expect(event.Channel).To(Equal("changes"))
+		Expect(event.Table).To(Equal("orders"))
+		Expect(event.Operation).To(Equal(dataaccess.CHANGE_UPDATE))
+		Expect(event.Key).To(HaveKeyWithValue("id", json.Number("9007199254740993")))
+
+		Eventually(changes).Should(Receive(&event))
+		Expect(event.Operation).To(Equal(dataaccess.CHANGE_RESYNC))
+	})
+
+	It("should stop when the context is done", func() {
+		cancel()
+		Eventually(sub.Notifications()).Should(BeClosed())
+		Expect(sub.Close()).To(Succeed())
+		Expect(closed).To(Equal(1))
+	})
+
+	It("should need postgres", func() {
+		ds := newSQLiteDataSource()
+		defer dataaccess.Shutdown()
+		_, err := ds.Listen(context.Background(), "orders")
+		Expect(err).To(MatchError("notifications are not supported on sqlite3"))
+		Expect(ds.InstallChangeTrigger(context.Background(), "orders", "changes")).To(HaveOccurred())
+	})
+
+	It("should build the trigger statements", func() {
+		statements := dataaccess.ChangeTriggerSQL("sales.orders", "order's changes", "tenant", "id")
+		Expect(statements).To(ContainSubstring("CREATE OR REPLACE FUNCTION dataaccess_notify_change() RETURNS trigger"))
+		Expect(statements).To(ContainSubstring(`DROP TRIGGER IF EXISTS "sales_orders_notify_change" ON "sales"."orders";`))
+		Expect(statements).To(ContainSubstring(`AFTER INSERT OR UPDATE OR DELETE ON "sales"."orders" FOR EACH ROW ` +
+			`EXECUTE PROCEDURE dataaccess_notify_change('order''s changes', 'tenant', 'id');`))
+		Expect(dataaccess.ChangeTriggerSQL("orders", "changes")).To(ContainSubstring("dataaccess_notify_change('changes', 'id')"))
+	})
+})
@@ -0,0 +1,230 @@
+package dataaccess
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// OUTBOX_TABLE holds the events waiting to be published
+	OUTBOX_TABLE = "outbox_events"
+
+	DEFAULT_OUTBOX_BATCH_SIZE     = 100
+	DEFAULT_OUTBOX_POLL_INTERVAL  = time.Second
+	DEFAULT_OUTBOX_RETRY_INTERVAL = time.Second
+	DEFAULT_OUTBOX_RETRY_MAX      = 5 * time.Minute
+	// DEFAULT_OUTBOX_RETENTION is how long delivered events are kept before the relay deletes them
+	DEFAULT_OUTBOX_RETENTION        = 24 * time.Hour
+	DEFAULT_OUTBOX_CLEANUP_INTERVAL = time.Minute
+
+	outboxErrorSize = 1024
+)
+
+// OutboxEvent is an event written to the outbox in the transaction of the change it describes
+type OutboxEvent struct {
+	ID uint64 `gorm:"primary_key" json:"id"`
+	// Key is the aggregate the event belongs to. Events with the same key are published in order.
+	Key     string `gorm:"size:255;index" json:"key"`
+	Type    string `gorm:"size:255" json:"type"`
+	Payload string `gorm:"type:text" json:"payload"`
+	// Tenant the transaction writing the event was scoped to, see WithTenant
+	Tenant        string     `gorm:"size:64" json:"tenant,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `gorm:"size:1024" json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `gorm:"index" json:"delivered_at,omitempty"`
+}
+
+// TableName is the name of the outbox table
+func (OutboxEvent) TableName() string {
+	return OUTBOX_TABLE
+}
+
+// Publisher delivers the events of the outbox, e.g. to a message broker. Delivery is at least
+// once, so publishers or their consumers should drop duplicates by the event id.
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+// PublisherFunc adapts a function to a Publisher
+type PublisherFunc func(ctx context.Context, event OutboxEvent) error
+
+// Publish calls f
+func (f PublisherFunc) Publish(ctx context.Context, event OutboxEvent) error {
+	return f(ctx, event)
+}
+
+// CreateOutbox creates the outbox table of the data source unless it exists
+func (ds *DataSource) CreateOutbox() error {
+	return ds.DB().AutoMigrate(&OutboxEvent{}).Error
+}
+
+// EnqueueEvent writes an event to the outbox in the transaction carried by ctx, see Tx.EnqueueEvent
+func EnqueueEvent(ctx context.Context, key, eventType string, payload interface{}) error {
+	tx, ok := TransactionFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("enqueuing event %s needs a transaction", eventType)
+	}
+	return tx.EnqueueEvent(key, eventType, payload)
+}
+
+// EnqueueEvent writes an event with the JSON encoded payload to the outbox. The relay publishes it
+// once the transaction commits and never if it rolls back.
+func (tx *Tx) EnqueueEvent(key, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encoding payload of event %s: %w", eventType, err)
+	}
+	event := &OutboxEvent{Key: key, Type: eventType, Payload: string(data), Tenant: tx.tenant, NextAttemptAt: gorm.NowFunc()}
+	return tx.Create(event).Error
+}
+
+// OutboxRelay publishes the events of the outbox of a data source. Events are published in the
+// order of their keys, an event failing to publish holds back the later events of its key until it
+// is published by a retry. Delivered events are deleted once the retention passes.
+// On postgres relays of several instances take turns, other databases need a single relay.
+type OutboxRelay struct {
+	ds        *DataSource
+	publisher Publisher
+
+	// BatchSize is the number of events read per pass
+	BatchSize int
+	// PollInterval is the wait between passes finding no more events
+	PollInterval time.Duration
+	// RetryInterval and RetryMaxInterval bound the exponential backoff of failed events
+	RetryInterval    time.Duration
+	RetryMaxInterval time.Duration
+	// Retention is how long delivered events are kept, and CleanupInterval how often Run deletes
+	// the delivered events older than that
+	Retention       time.Duration
+	CleanupInterval time.Duration
+}
+
+// NewOutboxRelay creates a relay publishing the outbox of ds with the default settings
+func NewOutboxRelay(ds *DataSource, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		ds:               ds,
+		publisher:        publisher,
+		BatchSize:        DEFAULT_OUTBOX_BATCH_SIZE,
+		PollInterval:     DEFAULT_OUTBOX_POLL_INTERVAL,
+		RetryInterval:    DEFAULT_OUTBOX_RETRY_INTERVAL,
+		RetryMaxInterval: DEFAULT_OUTBOX_RETRY_MAX,
+		Retention:        DEFAULT_OUTBOX_RETENTION,
+		CleanupInterval:  DEFAULT_OUTBOX_CLEANUP_INTERVAL,
+	}
+}
+
+// Run relays events until ctx is done. Errors of a pass are logged and the pass is repeated.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	log := logger.WithField("datasource", r.ds.name)
+	var lastCleanup time.Time
+	for {
+		published, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithField("error", err).Error("Relaying outbox events failed")
+		}
+		if time.Since(lastCleanup) >= r.CleanupInterval {
+			if _, err := r.Cleanup(ctx); err != nil && ctx.Err() == nil {
+				log.WithField("error", err).Error("Deleting delivered outbox events failed")
+			}
+			lastCleanup = time.Now()
+		}
+
+		// a full batch suggests more events are waiting
+		wait := r.PollInterval
+		if err == nil && published >= r.BatchSize {
+			wait = 0
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// RelayOnce publishes the pending events of one batch that are due and returns how many it published
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	published := 0
+	err := r.ds.WithTransaction(ctx, func(tx *Tx) error {
+		published = 0
+		if claimed, err := r.claim(tx); err != nil || !claimed {
+			return err
+		}
+
+		// only due events of keys without an earlier event waiting for its retry, so that the events
+		// of a failing key cannot fill the batch and hold back the events of the other keys
+		due := gorm.NowFunc()
+		key := tx.Dialect().Quote("key")
+		waiting := fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM %[1]s waiting WHERE waiting.%[2]s = %[1]s.%[2]s
+			AND waiting.id < %[1]s.id AND waiting.delivered_at IS NULL AND waiting.next_attempt_at > ?)`, OUTBOX_TABLE, key)
+		var events []OutboxEvent
+		err := tx.Where("delivered_at IS NULL AND next_attempt_at <= ?", due).Where(waiting, due).
+			Order("id").Limit(r.BatchSize).Find(&events).Error
+		if err != nil {
+			return err
+		}
+		held := map[string]bool{}
+		for _, event := range events {
+			if held[event.Key] {
+				continue
+			}
+			now := gorm.NowFunc()
+			publishErr := r.publisher.Publish(ctx, event)
+			update := map[string]interface{}{"attempts": event.Attempts + 1}
+			if publishErr == nil {
+				update["delivered_at"] = now
+				published++
+			} else {
+				held[event.Key] = true
+				update["last_error"] = truncate(publishErr.Error(), outboxErrorSize)
+				update["next_attempt_at"] = now.Add(r.retryDelay(event.Attempts + 1))
+				logger.WithFields(logger.Fields{"datasource": r.ds.name, "event": event.ID, "type": event.Type, "key": event.Key, "attempt": event.Attempts + 1, "error": publishErr}).Warn("Publishing outbox event failed")
+			}
+			if err := tx.Model(&OutboxEvent{ID: event.ID}).UpdateColumns(update).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return published, err
+}
+
+// Cleanup deletes the events delivered longer than the retention ago and returns how many it deleted
+func (r *OutboxRelay) Cleanup(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := r.ds.WithTransaction(ctx, func(tx *Tx) error {
+		before := gorm.NowFunc().Add(-r.Retention)
+		result := tx.Where("delivered_at IS NOT NULL AND delivered_at < ?", before).Delete(&OutboxEvent{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	return deleted, err
+}
+
+// claim takes a transaction level advisory lock on postgres, so that only one relay delivers the
+// events of a database at a time and the order of the keys is kept
+func (r *OutboxRelay) claim(tx *Tx) (bool, error) {
+	if r.ds.Dialect() != DIALECT_POSTGRES {
+		return true, nil
+	}
+	return tx.TryLock("outbox:" + OUTBOX_TABLE)
+}
+
+// retryDelay returns the backoff before the next attempt to publish an event after attempts failures
+func (r *OutboxRelay) retryDelay(attempts int) time.Duration {
+	retry := newBackoff(r.RetryInterval, r.RetryMaxInterval)
+	retry.attempt = attempts - 1
+	return retry.next()
+}
+
+func truncate(s string, size int) string {
+	if len(s) > size {
+		return s[:size]
+	}
+	return s
+}
@@ -0,0 +1,200 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordingPublisher records the published events and fails the events of the keys in failing
+type recordingPublisher struct {
+	sync.Mutex
+	published []dataaccess.OutboxEvent
+	failing   map[string]bool
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, event dataaccess.OutboxEvent) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.failing[event.Key] {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, event)
+	return nil
+}
+
+func (p *recordingPublisher) types() []string {
+	p.Lock()
+	defer p.Unlock()
+	var types []string
+	for _, event := range p.published {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func (p *recordingPublisher) fail(key string, failing bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.failing[key] = failing
+}
+
+var _ = Describe("outbox", func() {
+	var (
+		ds        *dataaccess.DataSource
+		repo      *dataaccess.Repository
+		publisher *recordingPublisher
+		relay     *dataaccess.OutboxRelay
+		ctx       = context.Background()
+	)
+
+	enqueue := func(key string, types ...string) {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			for _, eventType := range types {
+				if err := tx.EnqueueEvent(key, eventType, map[string]string{"order": key}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	pending := func() []dataaccess.OutboxEvent {
+		var events []dataaccess.OutboxEvent
+		Expect(ds.DB().Where("delivered_at IS NULL").Order("id").Find(&events).Error).NotTo(HaveOccurred())
+		return events
+	}
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&order{})
+		Expect(ds.CreateOutbox()).To(Succeed())
+		repo = dataaccess.NewRepository(ds, &order{})
+		publisher = &recordingPublisher{failing: map[string]bool{}}
+		relay = dataaccess.NewOutboxRelay(ds, publisher)
+		relay.RetryInterval = 20 * time.Millisecond
+		relay.RetryMaxInterval = 20 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	It("should publish the events of committed transactions", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			if err := repo.Create(tx.Context(), &order{Customer: "acme", Status: "open"}); err != nil {
+				return err
+			}
+			return dataaccess.EnqueueEvent(tx.Context(), "order-1", "order.created", map[string]string{"customer": "acme"})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		published, err := relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(published).To(Equal(1))
+		Expect(publisher.published).To(HaveLen(1))
+		Expect(publisher.published[0].Key).To(Equal("order-1"))
+		Expect(publisher.published[0].Payload).To(MatchJSON(`{"customer": "acme"}`))
+		Expect(pending()).To(BeEmpty())
+
+		published, err = relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(published).To(BeZero())
+	})
+
+	It("should not publish the events of rolled back transactions", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			Expect(tx.EnqueueEvent("order-1", "order.created", nil)).To(Succeed())
+			return errors.New("out of stock")
+		})
+		Expect(err).To(MatchError("out of stock"))
+
+		Expect(relay.RelayOnce(ctx)).To(BeZero())
+		Expect(publisher.published).To(BeEmpty())
+	})
+
+	It("should need a transaction to enqueue events", func() {
+		Expect(dataaccess.EnqueueEvent(ctx, "order-1", "order.created", nil)).To(MatchError(ContainSubstring("needs a transaction")))
+	})
+
+	It("should publish the events of a key in order", func() {
+		enqueue("order-1", "order.created", "order.paid")
+		enqueue("order-2", "order.created")
+		enqueue("order-1", "order.shipped")
+
+		Expect(relay.RelayOnce(ctx)).To(Equal(4))
+		Expect(publisher.types()).To(Equal([]string{"order.created", "order.paid", "order.created", "order.shipped"}))
+	})
+
+	It("should hold back the later events of a key whose event failed", func() {
+		enqueue("order-1", "order.created", "order.paid")
+		enqueue("order-2", "order.created")
+		publisher.fail("order-1", true)
+
+		Expect(relay.RelayOnce(ctx)).To(Equal(1))
+		Expect(publisher.published[0].Key).To(Equal("order-2"))
+		events := pending()
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Attempts).To(Equal(1))
+		Expect(events[0].LastError).To(Equal("broker unavailable"))
+		Expect(events[0].NextAttemptAt).To(BeTemporally(">", time.Now()))
+		Expect(events[1].Attempts).To(BeZero())
+
+		// the failed event is not retried before its backoff passes
+		publisher.fail("order-1", false)
+		Expect(relay.RelayOnce(ctx)).To(BeZero())
+
+		time.Sleep(30 * time.Millisecond)
+		Expect(relay.RelayOnce(ctx)).To(Equal(2))
+		Expect(publisher.types()).To(Equal([]string{"order.created", "order.created", "order.paid"}))
+	})
+
+	It("should publish the events of other keys while a key with a full batch waits for its retry", func() {
+		relay.BatchSize = 2
+		relay.RetryInterval = time.Minute
+		relay.RetryMaxInterval = time.Minute
+		enqueue("order-1", "order.created", "order.paid", "order.shipped")
+		enqueue("order-2", "order.created")
+		enqueue("order-3", "order.created")
+		publisher.fail("order-1", true)
+
+		Expect(relay.RelayOnce(ctx)).To(BeZero())
+		Expect(relay.RelayOnce(ctx)).To(Equal(2))
+		Expect(publisher.types()).To(Equal([]string{"order.created", "order.created"}))
+		Expect(pending()).To(HaveLen(3))
+		Expect(pending()[1].Attempts).To(BeZero())
+	})
+
+	It("should delete delivered events after the retention", func() {
+		enqueue("order-1", "order.created")
+		enqueue("order-2", "order.created")
+		publisher.fail("order-2", true)
+		Expect(relay.RelayOnce(ctx)).To(Equal(1))
+
+		Expect(relay.Cleanup(ctx)).To(BeZero())
+		relay.Retention = 0
+		Expect(relay.Cleanup(ctx)).To(BeEquivalentTo(1))
+
+		var count int
+		Expect(ds.DB().Model(&dataaccess.OutboxEvent{}).Count(&count).Error).NotTo(HaveOccurred())
+		Expect(count).To(Equal(1))
+	})
+
+	It("should relay until stopped", func() {
+		relay.PollInterval = 10 * time.Millisecond
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() { done <- relay.Run(runCtx) }()
+
+		enqueue("order-1", "order.created")
+		Eventually(publisher.types).Should(Equal([]string{"order.created"}))
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	})
+})
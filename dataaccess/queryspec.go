@@ -0,0 +1,339 @@
+package dataaccess
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Operator of a query filter
+type Operator string
+
+const (
+	OP_EQ    Operator = "eq"
+	OP_IN    Operator = "in"
+	OP_RANGE Operator = "range"
+	OP_LIKE  Operator = "like"
+
+	DEFAULT_PAGE_LIMIT = 20
+	MAX_PAGE_LIMIT     = 500
+
+	// escape character of LIKE patterns, chosen because backslash handling differs between databases
+	likeEscape = "!"
+)
+
+type (
+	// QuerySpec describes which rows of a list query to return and in which order
+	QuerySpec struct {
+		Filters []Filter
+		Sort    []SortField
+		Paging  Paging
+	}
+
+	// Filter restricts a column. OP_EQ and OP_LIKE take one value, OP_IN any number and
+	// OP_RANGE a lower and an upper bound, either of which may be nil for an open range.
+	Filter struct {
+		Column string
+		Op     Operator
+		Values []interface{}
+	}
+
+	// SortField orders by one column
+	SortField struct {
+		Column string
+		Desc   bool
+	}
+
+	// Paging selects a page either by offset or by the cursor returned with the previous page
+	Paging struct {
+		Limit  int
+		Offset int
+		Cursor string
+	}
+
+	// Page describes the page returned by a list query
+	Page struct {
+		Limit      int    `json:"limit"`
+		Offset     int    `json:"offset,omitempty"`
+		Total      int64  `json:"total"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+
+	// QueryWhitelist declares which query parameters may filter and sort a resource, mapping the
+	// parameter name to its column. Nothing else from a request ends up in the query.
+	QueryWhitelist struct {
+		Filterable   map[string]string
+		Sortable     map[string]string
+		DefaultSort  []SortField
+		DefaultLimit int
+		MaxLimit     int
+	}
+)
+
+// Eq filters on column = value
+func Eq(column string, value interface{}) Filter {
+	return Filter{Column: column, Op: OP_EQ, Values: []interface{}{value}}
+}
+
+// In filters on column IN (values...)
+func In(column string, values ...interface{}) Filter {
+	return Filter{Column: column, Op: OP_IN, Values: values}
+}
+
+// Range filters on from <= column <= to, a nil bound is left open
+func Range(column string, from, to interface{}) Filter {
+	return Filter{Column: column, Op: OP_RANGE, Values: []interface{}{from, to}}
+}
+
+// Like filters on column LIKE pattern, where * in the pattern matches any text
+func Like(column string, pattern string) Filter {
+	return Filter{Column: column, Op: OP_LIKE, Values: []interface{}{pattern}}
+}
+
+// ParseQuerySpec turns the query parameters of a list request into a QuerySpec. It understands
+//	field=value           equality
+//	field[in]=a,b,c       one of the values
+//	field[from]=x         lower bound, inclusive
+//	field[to]=y           upper bound, inclusive
+//	field[like]=abc*      pattern, * matches any text
+//	sort=-created,name    sort fields, - for descending
+//	limit=20&offset=40    offset paging
+//	cursor=...            continue after the page that returned the cursor
+// Fields that are not whitelisted are rejected with a bad request error.
+func ParseQuerySpec(values url.Values, whitelist QueryWhitelist) (QuerySpec, error) {
+	spec := QuerySpec{Sort: whitelist.DefaultSort}
+	ranges := map[string]*Filter{}
+
+	for param, vals := range values {
+		value := vals[len(vals)-1]
+		switch param {
+		case "sort":
+			sort, err := parseSort(value, whitelist)
+			if err != nil {
+				return spec, err
+			}
+			spec.Sort = sort
+			continue
+		case "limit", "offset":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return spec, badQuery("%s must be a positive number", param)
+			}
+			if param == "limit" {
+				spec.Paging.Limit = n
+			} else {
+				spec.Paging.Offset = n
+			}
+			continue
+		case "cursor":
+			spec.Paging.Cursor = value
+			continue
+		}
+
+		field, op := param, "eq"
+		if i := strings.Index(param, "["); i > 0 && strings.HasSuffix(param, "]") {
+			field, op = param[:i], param[i+1:len(param)-1]
+		}
+		column, ok := whitelist.Filterable[field]
+		if !ok {
+			return spec, badQuery("filtering on %s is not supported", field)
+		}
+
+		switch op {
+		case "eq":
+			spec.Filters = append(spec.Filters, Eq(column, value))
+		case "in":
+			var in []interface{}
+			for _, v := range strings.Split(value, ",") {
+				in = append(in, v)
+			}
+			spec.Filters = append(spec.Filters, In(column, in...))
+		case "like":
+			spec.Filters = append(spec.Filters, Like(column, value))
+		case "from", "to":
+			r, ok := ranges[column]
+			if !ok {
+				f := Range(column, nil, nil)
+				r = &f
+				ranges[column] = r
+			}
+			if op == "from" {
+				r.Values[0] = value
+			} else {
+				r.Values[1] = value
+			}
+		default:
+			return spec, badQuery("unknown filter operator %s", op)
+		}
+	}
+	for _, r := range ranges {
+		spec.Filters = append(spec.Filters, *r)
+	}
+
+	limit := whitelist.DefaultLimit
+	if limit <= 0 {
+		limit = DEFAULT_PAGE_LIMIT
+	}
+	max := whitelist.MaxLimit
+	if max <= 0 {
+		max = MAX_PAGE_LIMIT
+	}
+	if spec.Paging.Limit == 0 {
+		spec.Paging.Limit = limit
+	}
+	if spec.Paging.Limit > max {
+		return spec, badQuery("limit must not exceed %d", max)
+	}
+	return spec, nil
+}
+
+func parseSort(value string, whitelist QueryWhitelist) ([]SortField, error) {
+	var sort []SortField
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "-"), "+")
+		column, ok := whitelist.Sortable[field]
+		if !ok {
+			return nil, badQuery("sorting on %s is not supported", field)
+		}
+		sort = append(sort, SortField{Column: column, Desc: desc})
+	}
+	return sort, nil
+}
+
+func badQuery(format string, args ...interface{}) error {
+	return kiterrors.NewStatusError(kiterrors.BAD_REQUEST, http.StatusBadRequest, fmt.Sprintf(format, args...))
+}
+
+// applyFilters adds the filters of the spec as WHERE conditions
+func applyFilters(db *gorm.DB, filters []Filter) *gorm.DB {
+	quote := db.Dialect().Quote
+	for _, f := range filters {
+		column := quote(f.Column)
+		switch f.Op {
+		case OP_EQ:
+			db = db.Where(column+" = ?", f.Values[0])
+		case OP_IN:
+			db = db.Where(column+" IN (?)", f.Values)
+		case OP_RANGE:
+			if len(f.Values) > 0 && f.Values[0] != nil {
+				db = db.Where(column+" >= ?", f.Values[0])
+			}
+			if len(f.Values) > 1 && f.Values[1] != nil {
+				db = db.Where(column+" <= ?", f.Values[1])
+			}
+		case OP_LIKE:
+			db = db.Where(column+" LIKE ? ESCAPE '"+likeEscape+"'", likePattern(fmt.Sprint(f.Values[0])))
+		}
+	}
+	return db
+}
+
+// likePattern escapes the LIKE wildcards of a user supplied pattern and turns * into %
+func likePattern(pattern string) string {
+	replacer := strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_", "*", "%")
+	return replacer.Replace(pattern)
+}
+
+// applySort orders by the sort fields of the spec
+func applySort(db *gorm.DB, sort []SortField) *gorm.DB {
+	quote := db.Dialect().Quote
+	for _, s := range sort {
+		direction := " ASC"
+		if s.Desc {
+			direction = " DESC"
+		}
+		db = db.Order(quote(s.Column) + direction)
+	}
+	return db
+}
+
+// applyCursor continues after the row the cursor was taken from. For sort fields a, b this is
+// (a > x) OR (a = x AND b > y), with the comparison flipped for descending fields.
+func applyCursor(db *gorm.DB, sort []SortField, cursor string) (*gorm.DB, error) {
+	values, err := decodeCursor(cursor)
+	if err != nil || len(values) != len(sort) {
+		return db, badQuery("invalid cursor")
+	}
+
+	quote := db.Dialect().Quote
+	var clauses []string
+	var args []interface{}
+	for i, s := range sort {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, quote(sort[j].Column)+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if s.Desc {
+			op = " < ?"
+		}
+		parts = append(parts, quote(s.Column)+op)
+		args = append(args, values[i])
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+	return db.Where(strings.Join(clauses, " OR "), args...), nil
+}
+
+// cursorValue keeps the type of time values, which would otherwise come back as strings
+type cursorValue struct {
+	Time  *time.Time  `json:"t,omitempty"`
+	Value interface{} `json:"v,omitempty"`
+}
+
+func encodeCursor(values []interface{}) string {
+	encoded := make([]cursorValue, len(values))
+	for i, v := range values {
+		if t, ok := v.(time.Time); ok {
+			encoded[i].Time = &t
+		} else {
+			encoded[i].Value = v
+		}
+	}
+	b, _ := json.Marshal(encoded)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var encoded []cursorValue
+	decoder := json.NewDecoder(strings.NewReader(string(b)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&encoded); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(encoded))
+	for i, e := range encoded {
+		switch {
+		case e.Time != nil:
+			values[i] = *e.Time
+		default:
+			if n, ok := e.Value.(json.Number); ok {
+				if v, err := n.Int64(); err == nil {
+					values[i] = v
+					continue
+				}
+				v, _ := n.Float64()
+				values[i] = v
+				continue
+			}
+			values[i] = e.Value
+		}
+	}
+	return values, nil
+}
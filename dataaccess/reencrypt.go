@@ -0,0 +1,247 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_REENCRYPT_BATCH_SIZE = 500
+	DEFAULT_REENCRYPT_INTERVAL   = time.Hour
+)
+
+// ReEncryptOptions name the encrypted columns ReEncrypt rewrites
+type ReEncryptOptions struct {
+	Table   string
+	Columns []string
+	// BlindIndexes maps an encrypted column to the column of its blind index, e.g.
+	// {"email": "email_index"}, which is set when a plaintext value of the column is encrypted
+	BlindIndexes map[string]string
+	// Key is the primary key column of the table, id unless set
+	Key string
+	// BatchSize is the number of rows read per transaction, DEFAULT_REENCRYPT_BATCH_SIZE unless set
+	BatchSize int
+}
+
+// ReEncrypt moves the values of encrypted columns to the primary key of the keyring set by
+// SetKeyring and returns the number of rows it rewrote. Values encrypted with another key of the
+// keyring get their data key encrypted with the primary key, values that are not encrypted yet,
+// e.g. of a column that was plaintext before, are encrypted and get their blind index set. It
+// walks the table in the order of the key in batches of a transaction each, so that it can run
+// next to the service, e.g. on the leader of a LeaderElection after a key rotation, or
+// periodically with ReEncryption. A row changed while its batch runs keeps its new value and is
+// rewritten by the next run.
+//
+// A row with a value that cannot be re-encrypted, e.g. one encrypted with a key that is no longer
+// in the keyring, is logged and left as it is, the rows after it are re-encrypted all the same.
+// The skipped rows are returned as a *ReEncryptError.
+func (s *SQL) ReEncrypt(ctx context.Context, options ReEncryptOptions) (int64, error) {
+	k, err := currentKeyring()
+	if err != nil {
+		return 0, err
+	}
+	if options.Table == "" || len(options.Columns) == 0 {
+		return 0, fmt.Errorf("re-encrypting needs a table and its encrypted columns")
+	}
+	if options.Key == "" {
+		options.Key = "id"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DEFAULT_REENCRYPT_BATCH_SIZE
+	}
+
+	var (
+		rewritten int64
+		last      interface{}
+		skipped   = &ReEncryptError{Table: options.Table}
+	)
+	for {
+		var read int
+		err := s.ds.transactionOnce(ctx, func(tx *Tx) error {
+			var err error
+			read, last, err = s.reEncryptBatch(tx, k, options, last, &rewritten, skipped)
+			return err
+		})
+		if err != nil {
+			return rewritten, fmt.Errorf("re-encrypting %s: %w", options.Table, err)
+		}
+		if read < options.BatchSize {
+			if len(skipped.Rows) > 0 {
+				return rewritten, skipped
+			}
+			return rewritten, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+	}
+}
+
+// reEncryptBatch rewrites the rows of the batch following the key last and returns the number of
+// rows it read and the key of the last one. Rows that cannot be re-encrypted are added to skipped.
+func (s *SQL) reEncryptBatch(tx *Tx, k *Keyring, options ReEncryptOptions, last interface{}, rewritten *int64, skipped *ReEncryptError) (int, interface{}, error) {
+	key := s.ds.DB().Dialect().Quote(options.Key)
+	query := tx.Table(options.Table).Select(key + ", " + s.quoteColumns(options.Columns)).Order(key).Limit(options.BatchSize)
+	if last != nil {
+		query = query.Where(key+" > ?", last)
+	}
+	rows, err := query.Rows()
+	if err != nil {
+		return 0, last, err
+	}
+	// the rows are read before they are updated on the connection of the transaction
+	type row struct {
+		key    interface{}
+		values []sql.NullString
+	}
+	var batch []row
+	for rows.Next() {
+		r := row{values: make([]sql.NullString, len(options.Columns))}
+		dest := []interface{}{&r.key}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, last, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, last, err
+	}
+
+	for _, r := range batch {
+		last = r.key
+		var (
+			set, unchanged []string
+			values, olds   []interface{}
+			rowErr         error
+		)
+		for i, value := range r.values {
+			if !value.Valid {
+				continue
+			}
+			var (
+				updated   string
+				changed   bool
+				plaintext = !strings.HasPrefix(value.String, ENCRYPTION_PREFIX)
+				err       error
+			)
+			if plaintext {
+				updated, err = k.Encrypt([]byte(value.String))
+				changed = true
+			} else {
+				updated, changed, err = k.Rewrap(value.String)
+			}
+			if err != nil {
+				rowErr = fmt.Errorf("column %s: %w", options.Columns[i], err)
+				break
+			}
+			if changed {
+				column := s.ds.DB().Dialect().Quote(options.Columns[i])
+				set = append(set, column+" = ?")
+				values = append(values, updated)
+				unchanged = append(unchanged, column+" = ?")
+				olds = append(olds, value.String)
+			}
+			// the index key cannot be rotated, only values that were plaintext need their index
+			if index := options.BlindIndexes[options.Columns[i]]; plaintext && index != "" {
+				set = append(set, s.ds.DB().Dialect().Quote(index)+" = ?")
+				values = append(values, k.BlindIndex(value.String))
+			}
+		}
+		if rowErr != nil {
+			logger.WithFields(logger.Fields{"datasource": s.ds.name, "table": options.Table, "row": r.key, "error": rowErr}).Warn("Skipping row that cannot be re-encrypted")
+			skipped.Rows = append(skipped.Rows, SkippedRow{Key: r.key, Err: rowErr})
+			continue
+		}
+		if len(set) == 0 {
+			continue
+		}
+		// setting the new values only where the old ones are still in place keeps concurrent changes
+		statement := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ? AND %s", s.quoteTable(options.Table),
+			strings.Join(set, ", "), key, strings.Join(unchanged, " AND "))
+		args := append(append(values, r.key), olds...)
+		result := tx.Exec(statement, args...)
+		if result.Error != nil {
+			return len(batch), last, result.Error
+		}
+		*rewritten += result.RowsAffected
+	}
+	return len(batch), last, nil
+}
+
+// ReEncryptError lists the rows ReEncrypt left as they were because a value of theirs could not be
+// re-encrypted
+type ReEncryptError struct {
+	Table string
+	Rows  []SkippedRow
+}
+
+// SkippedRow is a row ReEncrypt skipped, by its key and the reason
+type SkippedRow struct {
+	Key interface{}
+	Err error
+}
+
+// maxListedRows is the number of skipped rows the message of a ReEncryptError names
+const maxListedRows = 10
+
+func (e *ReEncryptError) Error() string {
+	listed := make([]string, 0, maxListedRows)
+	for i, row := range e.Rows {
+		if i == maxListedRows {
+			listed = append(listed, fmt.Sprintf("and %d more", len(e.Rows)-maxListedRows))
+			break
+		}
+		listed = append(listed, fmt.Sprintf("row %v: %v", row.Key, row.Err))
+	}
+	return fmt.Sprintf("re-encrypting %s skipped %d rows: %s", e.Table, len(e.Rows), strings.Join(listed, "; "))
+}
+
+// ReEncryption runs ReEncrypt on tables at an interval, so that their values follow the rotations
+// of the keyring without a manual run. Run it on a single instance, e.g. the leader of a
+// LeaderElection.
+type ReEncryption struct {
+	ds     *DataSource
+	tables []ReEncryptOptions
+
+	// Interval between the runs, DEFAULT_REENCRYPT_INTERVAL unless set
+	Interval time.Duration
+}
+
+// NewReEncryption creates a job re-encrypting the tables of ds with the default settings
+func NewReEncryption(ds *DataSource, tables ...ReEncryptOptions) *ReEncryption {
+	return &ReEncryption{ds: ds, tables: tables, Interval: DEFAULT_REENCRYPT_INTERVAL}
+}
+
+// Run re-encrypts the tables right away and then at every interval until ctx is done. Errors of a
+// table are logged and the table is retried by the next run.
+func (r *ReEncryption) Run(ctx context.Context) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = DEFAULT_REENCRYPT_INTERVAL
+	}
+	for {
+		for _, table := range r.tables {
+			log := logger.WithFields(logger.Fields{"datasource": r.ds.name, "table": table.Table})
+			rewritten, err := r.ds.SQL().ReEncrypt(ctx, table)
+			if err != nil && ctx.Err() == nil {
+				log.WithField("error", err).Error("Re-encrypting failed")
+			}
+			if rewritten > 0 {
+				log.WithField("rows", rewritten).Info("Re-encrypted rows")
+			}
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	REPLICA_ROUND_ROBIN       = "round_robin"
+	REPLICA_LEAST_CONNECTIONS = "least_connections"
+
+	DEFAULT_REPLICA_HEALTH_INTERVAL = 5 * time.Second
+)
+
+// replicaConfiguration is a read replica of a data source. Empty fields are taken from the primary.
+type replicaConfiguration struct {
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Schema   string `json:"schema"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// replica is the pool of one read replica. Replicas failing their health check are ejected
+// from routing until they pass it again.
+type replica struct {
+	address string
+	db      *gorm.DB
+	healthy int32
+}
+
+type primaryContextKey struct{}
+
+// WithPrimary returns a context that routes reads to the primary, e.g. to read a row right after
+// writing it without waiting for the replicas to catch up
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func readsPrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryContextKey{}).(bool)
+	return primary
+}
+
+// Reader returns the handle for reads made with ctx. Reads go to a healthy replica chosen by the
+// replica policy of the configuration, and to the primary when the data source has no healthy
+// replica, when ctx carries a transaction of the data source or when ctx was made by WithPrimary.
+func (ds *DataSource) Reader(ctx context.Context) *gorm.DB {
+	if tx, ok := TransactionFromContext(ctx); ok && tx.ds == ds {
+		return tx.DB
+	}
+	p := ds.current()
+	if len(p.replicas) == 0 || readsPrimary(ctx) {
+		return p.db
+	}
+	if r := ds.pickReplica(p); r != nil {
+		return r.db
+	}
+	return p.db
+}
+
+func (ds *DataSource) pickReplica(p *pool) *replica {
+	if p.config.ReplicaPolicy == REPLICA_LEAST_CONNECTIONS {
+		var best *replica
+		bestInUse := 0
+		for _, r := range p.replicas {
+			if atomic.LoadInt32(&r.healthy) == 0 {
+				continue
+			}
+			if inUse := r.db.DB().Stats().InUse; best == nil || inUse < bestInUse {
+				best, bestInUse = r, inUse
+			}
+		}
+		return best
+	}
+
+	start := atomic.AddUint32(&ds.next, 1)
+	for i := range p.replicas {
+		r := p.replicas[(int(start)+i)%len(p.replicas)]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r
+		}
+	}
+	return nil
+}
+
+// openReplicas opens the pools of the configured replicas. A replica that cannot be reached
+// does not fail the data source, it starts ejected and is admitted once its health check passes.
+func (ds *DataSource) openReplicas(p *pool) error {
+	for _, rc := range p.config.Replicas {
+		config := p.config.replicaConfig(rc)
+		uri, err := buildDBURI(config)
+		if err != nil {
+			return configError{config.redactError(err)}
+		}
+		sqlDB, err := sql.Open(config.Dialect(), uri)
+		if err != nil {
+			return configError{config.redactError(fmt.Errorf("opening replica of data source %q: %w", ds.name, err))}
+		}
+		r := &replica{address: net.JoinHostPort(config.Host, config.Port)}
+		if config.Dialect() == DIALECT_SQLITE {
+			r.address = config.Schema
+		}
+		if r.db, err = gorm.Open(config.Dialect(), sqlDB); err == nil {
+			r.healthy = 1
+		} else {
+			logger.WithFields(logger.Fields{"datasource": ds.name, "replica": r.address, "error": config.redactError(err)}).Warn("Replica is not reachable")
+		}
+		applyPoolSettings(sqlDB, config)
+		ds.registerInstrumentation(r.db)
+		p.replicas = append(p.replicas, r)
+	}
+	if len(p.replicas) > 0 {
+		p.stop = make(chan struct{})
+		go ds.checkReplicas(p)
+	}
+	return nil
+}
+
+// checkReplicas pings the replicas of a pool until it is closed
+func (ds *DataSource) checkReplicas(p *pool) {
+	interval := p.config.ReplicaHealthInterval.Duration
+	if interval <= 0 {
+		interval = DEFAULT_REPLICA_HEALTH_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		for i, r := range p.replicas {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := r.db.DB().PingContext(ctx)
+			cancel()
+
+			log := logger.WithFields(logger.Fields{"datasource": ds.name, "replica": r.address})
+			if err != nil && atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+				log.WithField("error", p.config.replicaConfig(p.config.Replicas[i]).redactError(err)).Warn("Ejecting replica")
+			} else if err == nil && atomic.CompareAndSwapInt32(&r.healthy, 0, 1) {
+				log.Info("Admitting replica")
+			}
+		}
+	}
+}
+
+// closeReplicas stops the health checks and closes the replica pools
+func (p *pool) closeReplicas() error {
+	if p.stop != nil {
+		close(p.stop)
+	}
+	var firstErr error
+	for _, r := range p.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// replicaConfig returns the configuration of the primary with the settings of the replica applied
+func (c dbConfiguration) replicaConfig(rc replicaConfiguration) dbConfiguration {
+	config := c
+	config.Replicas = nil
+	if rc.Host != "" {
+		config.Host = rc.Host
+	}
+	if rc.Port != "" {
+		config.Port = rc.Port
+	}
+	if rc.Schema != "" {
+		config.Schema = rc.Schema
+	}
+	if rc.Username != "" {
+		config.Username = rc.Username
+	}
+	if rc.Password != "" {
+		config.Password = rc.Password
+	}
+	return config
+}
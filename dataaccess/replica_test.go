@@ -0,0 +1,137 @@
+package dataaccess_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	"github.com/jinzhu/gorm"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var replicaCount int
+
+var _ = Describe("read replicas", func() {
+	var (
+		ds    *dataaccess.DataSource
+		repo  *dataaccess.Repository
+		seeds []*gorm.DB
+		ctx   = context.Background()
+	)
+
+	// seed opens an in-memory sqlite database holding a single order of the given customer
+	seed := func(schema string, customer string) {
+		db, err := gorm.Open(dataaccess.DIALECT_SQLITE, schema)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.AutoMigrate(&order{}).Error).NotTo(HaveOccurred())
+		Expect(db.Create(&order{Customer: customer}).Error).NotTo(HaveOccurred())
+		seeds = append(seeds, db)
+	}
+
+	// open registers a data source whose primary and replicas each hold one order named after them
+	open := func(settings string, replicas ...string) {
+		replicaCount++
+		schema := func(name string) string {
+			return fmt.Sprintf("file:replicas%d-%s?mode=memory&cache=shared", replicaCount, name)
+		}
+		seed(schema("primary"), "primary")
+
+		dataaccess.GetConfiguration()
+		config := dataaccess.Configuration.DBConfig
+		config.Database = dataaccess.DIALECT_SQLITE
+		config.Schema = schema("primary")
+		var list []string
+		for _, name := range replicas {
+			s := schema(name)
+			if name == "unreachable" {
+				s = "file:/nonexistent/replica.db?mode=ro"
+			} else {
+				seed(s, name)
+			}
+			list = append(list, fmt.Sprintf(`{"schema": %q}`, s))
+		}
+		Expect(json.Unmarshal([]byte(fmt.Sprintf(`{"replicas": [%s] %s}`, strings.Join(list, ", "), settings)), &config)).To(Succeed())
+
+		var err error
+		ds, err = dataaccess.RegisterDataSource(fmt.Sprintf("replicas%d", replicaCount), config)
+		Expect(err).NotTo(HaveOccurred())
+		repo = dataaccess.NewRepository(ds, &order{})
+	}
+
+	read := func(ctx context.Context) string {
+		var o order
+		Expect(repo.Get(ctx, &o, 1)).To(Succeed())
+		return o.Customer
+	}
+
+	AfterEach(func() {
+		for _, db := range seeds {
+			db.Close()
+		}
+		seeds = nil
+	})
+
+	It("spreads reads over the replicas round robin", func() {
+		open("", "replica1", "replica2")
+		first, second := read(ctx), read(ctx)
+		Expect([]string{first, second}).To(ConsistOf("replica1", "replica2"))
+		Expect(read(ctx)).To(Equal(first))
+	})
+
+	It("reads from a replica with the least connections", func() {
+		open(`, "replica_policy": "least_connections"`, "replica1")
+		Expect(read(ctx)).To(Equal("replica1"))
+	})
+
+	It("reads from the primary when asked to", func() {
+		open("", "replica1")
+		Expect(read(dataaccess.WithPrimary(ctx))).To(Equal("primary"))
+	})
+
+	It("reads from the primary inside a transaction", func() {
+		open("", "replica1")
+		Expect(ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			Expect(read(tx.Context())).To(Equal("primary"))
+			return nil
+		})).To(Succeed())
+	})
+
+	It("writes to the primary", func() {
+		open("", "replica1")
+		Expect(repo.Create(ctx, &order{Customer: "new"})).To(Succeed())
+		var orders []order
+		Expect(ds.DB().Find(&orders).Error).NotTo(HaveOccurred())
+		Expect(orders).To(HaveLen(2))
+	})
+
+	It("skips replicas that cannot be reached", func() {
+		open("", "unreachable", "replica1")
+		for i := 0; i < 4; i++ {
+			Expect(read(ctx)).To(Equal("replica1"))
+		}
+	})
+
+	It("ejects replicas failing their health check", func() {
+		open(`, "replica_health_interval": "20ms"`, "replica1", "replica2")
+		Expect(ds.CloseReplica(0)).To(Succeed())
+		Eventually(func() error {
+			for i := 0; i < 2; i++ {
+				var o order
+				if err := repo.Get(ctx, &o, 1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Should(Succeed())
+		Expect(read(ctx)).To(Equal("replica2"))
+	})
+
+	It("falls back to the primary without healthy replicas", func() {
+		open("", "unreachable")
+		Expect(read(ctx)).To(Equal("primary"))
+	})
+})
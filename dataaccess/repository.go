@@ -0,0 +1,259 @@
+package dataaccess
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Repository provides CRUD, bulk operations and spec based list queries for one gorm model.
+// Entities are passed as pointers to the model type, result sets as pointers to slices of it.
+type Repository struct {
+	ds    *DataSource
+	model interface{}
+	// table of the model, qualified with the tenant schema for tenant scoped calls
+	table string
+	// key is the column appended to every sort so that cursors are unambiguous
+	key string
+}
+
+// NewRepository creates a repository for model, e.g. NewRepository(ds, &Order{})
+func NewRepository(ds *DataSource, model interface{}) *Repository {
+	scope := ds.DB().NewScope(model)
+	key := "id"
+	if field := scope.PrimaryField(); field != nil {
+		key = field.DBName
+	}
+	return &Repository{ds: ds, model: model, table: scope.TableName(), key: key}
+}
+
+// db returns the handle the repository writes with for the request described by ctx, the
+// transaction carried by ctx if there is one of the repository's data source
+func (r *Repository) db(ctx context.Context) (*gorm.DB, error) {
+	return r.scoped(ctx, r.ds.DB())
+}
+
+// reader returns the handle the repository reads with for the request described by ctx,
+// including soft deleted rows when ctx is made by IncludeDeleted
+func (r *Repository) reader(ctx context.Context) (*gorm.DB, error) {
+	db, err := r.scoped(ctx, r.ds.Reader(ctx))
+	if err == nil && includesDeleted(ctx) {
+		db = db.Unscoped()
+	}
+	return db, err
+}
+
+// scoped joins the transaction carried by ctx, qualifies the table with the schema of the
+// tenant ctx is scoped to and passes ctx on to the audit and instrumentation callbacks
+func (r *Repository) scoped(ctx context.Context, db *gorm.DB) (*gorm.DB, error) {
+	tenant, isTenant := TenantFromContext(ctx)
+	if tx, ok := TransactionFromContext(ctx); ok && tx.ds == r.ds {
+		if tx.tenant != tenant {
+			return nil, crossTenant(tx.tenant, tenant)
+		}
+		db = tx.DB
+	} else if err := r.ds.checkRowLevelSecurity(); err != nil {
+		return nil, err
+	}
+	if isTenant {
+		db = db.Table(TenantSchema(tenant) + "." + r.table)
+	}
+	return withContext(withIdentity(db, ctx), ctx), nil
+}
+
+// Create inserts a new entity
+func (r *Repository) Create(ctx context.Context, entity interface{}) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Create(entity).Error
+}
+
+// Get loads the entity with the given primary key into out. A missing row is reported as
+// errors.ErrNotFound.
+func (r *Repository) Get(ctx context.Context, out interface{}, id interface{}) error {
+	db, err := r.reader(ctx)
+	if err != nil {
+		return err
+	}
+	err = db.Where(r.ds.DB().Dialect().Quote(r.key)+" = ?", id).First(out).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return kiterrors.ErrNotFound.WithCause(err)
+	}
+	return err
+}
+
+// Update saves all fields of an entity. The update of a Versioned entity changed since it was read
+// fails with errors.ErrConflict.
+func (r *Repository) Update(ctx context.Context, entity interface{}) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Save(entity).Error
+}
+
+// Patch updates the given columns of an entity. Like Update it fails with errors.ErrConflict if a
+// Versioned entity changed since it was read, or since the version given in fields.
+func (r *Repository) Patch(ctx context.Context, entity interface{}, fields map[string]interface{}) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Model(entity).Updates(fields).Error
+}
+
+// Delete removes an entity
+func (r *Repository) Delete(ctx context.Context, entity interface{}) error {
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Delete(entity).Error
+}
+
+// List loads the rows selected by the spec into out, a pointer to a slice of the model.
+// The returned page carries the total number of matching rows and, when more rows follow,
+// the cursor of the next page.
+func (r *Repository) List(ctx context.Context, spec QuerySpec, out interface{}) (*Page, error) {
+	limit := spec.Paging.Limit
+	if limit <= 0 {
+		limit = DEFAULT_PAGE_LIMIT
+	}
+	page := &Page{Limit: limit, Offset: spec.Paging.Offset}
+
+	reader, err := r.reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db := applyFilters(reader.Model(r.model), spec.Filters)
+	if err := db.Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+
+	sort := r.keyedSort(spec.Sort)
+	query := db
+	if spec.Paging.Cursor != "" {
+		if query, err = applyCursor(query, sort, spec.Paging.Cursor); err != nil {
+			return nil, err
+		}
+		page.Offset = 0
+	} else if spec.Paging.Offset > 0 {
+		query = query.Offset(spec.Paging.Offset)
+	}
+
+	// one row more than asked for tells whether another page follows
+	if err := applySort(query, sort).Limit(limit + 1).Find(out).Error; err != nil {
+		return nil, err
+	}
+	rows := reflect.ValueOf(out).Elem()
+	if rows.Len() > limit {
+		rows.Set(rows.Slice(0, limit))
+		cursor, err := r.cursorOf(rows.Index(limit-1), sort)
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+// Count returns the number of rows matching the filters of the spec
+func (r *Repository) Count(ctx context.Context, spec QuerySpec) (int64, error) {
+	db, err := r.reader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = applyFilters(db.Model(r.model), spec.Filters).Count(&count).Error
+	return count, err
+}
+
+// BulkCreate inserts all entities of a slice in one transaction, or in a savepoint when ctx
+// carries one. Loads too large for single inserts are better streamed with SQL.BulkInsert.
+func (r *Repository) BulkCreate(ctx context.Context, entities interface{}) error {
+	rows := reflect.ValueOf(entities)
+	if rows.Kind() == reflect.Ptr {
+		rows = rows.Elem()
+	}
+	if rows.Kind() != reflect.Slice {
+		return fmt.Errorf("BulkCreate expects a slice, got %T", entities)
+	}
+
+	return r.ds.WithTransaction(ctx, func(tx *Tx) error {
+		db, err := r.db(tx.Context())
+		if err != nil {
+			return err
+		}
+		for i := 0; i < rows.Len(); i++ {
+			entity := rows.Index(i)
+			if entity.Kind() != reflect.Ptr {
+				entity = entity.Addr()
+			}
+			if err := db.Create(entity.Interface()).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BulkUpdate sets the given columns on every row matching the filters and returns the
+// number of rows updated
+func (r *Repository) BulkUpdate(ctx context.Context, filters []Filter, fields map[string]interface{}) (int64, error) {
+	if len(filters) == 0 {
+		return 0, fmt.Errorf("BulkUpdate needs at least one filter")
+	}
+	db, err := r.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+	result := applyFilters(db.Model(r.model), filters).Updates(fields)
+	return result.RowsAffected, result.Error
+}
+
+// BulkDelete deletes every row matching the filters and returns the number of rows deleted
+func (r *Repository) BulkDelete(ctx context.Context, filters []Filter) (int64, error) {
+	if len(filters) == 0 {
+		return 0, fmt.Errorf("BulkDelete needs at least one filter")
+	}
+	db, err := r.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+	result := applyFilters(db, filters).Delete(r.model)
+	return result.RowsAffected, result.Error
+}
+
+// keyedSort appends the key column unless the sort already contains it, making the order total
+func (r *Repository) keyedSort(sort []SortField) []SortField {
+	for _, s := range sort {
+		if s.Column == r.key {
+			return sort
+		}
+	}
+	keyed := make([]SortField, len(sort), len(sort)+1)
+	copy(keyed, sort)
+	return append(keyed, SortField{Column: r.key})
+}
+
+func (r *Repository) cursorOf(row reflect.Value, sort []SortField) (string, error) {
+	if row.Kind() != reflect.Ptr {
+		row = row.Addr()
+	}
+	scope := r.ds.DB().NewScope(row.Interface())
+	values := make([]interface{}, len(sort))
+	for i, s := range sort {
+		field, ok := scope.FieldByName(s.Column)
+		if !ok {
+			return "", fmt.Errorf("sort column %s is not a field of %T", s.Column, r.model)
+		}
+		values[i] = field.Field.Interface()
+	}
+	return encodeCursor(values), nil
+}
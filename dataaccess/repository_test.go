@@ -0,0 +1,176 @@
+package dataaccess_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type order struct {
+	ID       uint `gorm:"primary_key"`
+	Customer string
+	Status   string
+	Total    int
+}
+
+var orderWhitelist = dataaccess.QueryWhitelist{
+	Filterable: map[string]string{"customer": "customer", "status": "status", "total": "total"},
+	Sortable:   map[string]string{"customer": "customer", "total": "total"},
+	MaxLimit:   50,
+}
+
+var repositoryCount int
+
+// newSQLiteDataSource registers a data source backed by its own in-memory sqlite database
+func newSQLiteDataSource(models ...interface{}) *dataaccess.DataSource {
+	repositoryCount++
+	dataaccess.GetConfiguration()
+	config := dataaccess.Configuration.DBConfig
+	config.Database = dataaccess.DIALECT_SQLITE
+	config.Schema = fmt.Sprintf("file:repository%d?mode=memory&cache=shared", repositoryCount)
+	ds, err := dataaccess.RegisterDataSource(fmt.Sprintf("repository%d", repositoryCount), config)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(ds.DB().AutoMigrate(models...).Error).NotTo(HaveOccurred())
+	return ds
+}
+
+var _ = Describe("repository", func() {
+	var (
+		repo *dataaccess.Repository
+		ctx  = context.Background()
+	)
+
+	BeforeEach(func() {
+		repo = dataaccess.NewRepository(newSQLiteDataSource(&order{}), &order{})
+		orders := []order{
+			{Customer: "acme", Status: "open", Total: 10},
+			{Customer: "acme", Status: "shipped", Total: 20},
+			{Customer: "globex", Status: "open", Total: 30},
+			{Customer: "initech", Status: "cancelled", Total: 40},
+			{Customer: "100%_real", Status: "open", Total: 50},
+		}
+		Expect(repo.BulkCreate(ctx, orders)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	It("creates, reads, updates and deletes entities", func() {
+		o := &order{Customer: "umbrella", Status: "open", Total: 5}
+		Expect(repo.Create(ctx, o)).To(Succeed())
+
+		var loaded order
+		Expect(repo.Get(ctx, &loaded, o.ID)).To(Succeed())
+		Expect(loaded.Customer).To(Equal("umbrella"))
+
+		loaded.Total = 6
+		Expect(repo.Update(ctx, &loaded)).To(Succeed())
+		Expect(repo.Patch(ctx, &loaded, map[string]interface{}{"status": "shipped"})).To(Succeed())
+		Expect(repo.Get(ctx, &loaded, o.ID)).To(Succeed())
+		Expect(loaded.Total).To(Equal(6))
+		Expect(loaded.Status).To(Equal("shipped"))
+
+		Expect(repo.Delete(ctx, &loaded)).To(Succeed())
+		err := repo.Get(ctx, &loaded, o.ID)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*kiterrors.Error).Status).To(Equal(http.StatusNotFound))
+	})
+
+	It("filters with eq, in, range and like", func() {
+		var orders []order
+		spec := dataaccess.QuerySpec{Filters: []dataaccess.Filter{
+			dataaccess.In("status", "open", "shipped"),
+			dataaccess.Range("total", 15, nil),
+		}}
+		page, err := repo.List(ctx, spec, &orders)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Total).To(Equal(int64(3)))
+
+		spec = dataaccess.QuerySpec{Filters: []dataaccess.Filter{dataaccess.Like("customer", "100%_*")}}
+		_, err = repo.List(ctx, spec, &orders)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orders).To(HaveLen(1))
+		Expect(orders[0].Customer).To(Equal("100%_real"))
+	})
+
+	It("pages by offset and by cursor with a multi-field sort", func() {
+		sort := []dataaccess.SortField{{Column: "customer"}, {Column: "total", Desc: true}}
+		var first, second, third []order
+
+		page, err := repo.List(ctx, dataaccess.QuerySpec{Sort: sort, Paging: dataaccess.Paging{Limit: 2}}, &first)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page.Total).To(Equal(int64(5)))
+		Expect(first[0].Customer).To(Equal("100%_real"))
+		Expect(first[1].Total).To(Equal(20))
+		Expect(page.NextCursor).NotTo(BeEmpty())
+
+		page, err = repo.List(ctx, dataaccess.QuerySpec{Sort: sort, Paging: dataaccess.Paging{Limit: 2, Cursor: page.NextCursor}}, &second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second[0].Total).To(Equal(10))
+		Expect(second[1].Customer).To(Equal("globex"))
+
+		page, err = repo.List(ctx, dataaccess.QuerySpec{Sort: sort, Paging: dataaccess.Paging{Limit: 2, Cursor: page.NextCursor}}, &third)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(third).To(HaveLen(1))
+		Expect(page.NextCursor).To(BeEmpty())
+
+		_, err = repo.List(ctx, dataaccess.QuerySpec{Sort: sort, Paging: dataaccess.Paging{Limit: 2, Offset: 4}}, &third)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(third[0].Customer).To(Equal("initech"))
+	})
+
+	It("updates and deletes in bulk", func() {
+		updated, err := repo.BulkUpdate(ctx, []dataaccess.Filter{dataaccess.Eq("customer", "acme")}, map[string]interface{}{"status": "archived"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated).To(Equal(int64(2)))
+
+		deleted, err := repo.BulkDelete(ctx, []dataaccess.Filter{dataaccess.Eq("status", "archived")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(deleted).To(Equal(int64(2)))
+
+		_, err = repo.BulkDelete(ctx, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("query spec parser", func() {
+	parse := func(query string) (dataaccess.QuerySpec, error) {
+		values, err := url.ParseQuery(query)
+		Expect(err).NotTo(HaveOccurred())
+		return dataaccess.ParseQuerySpec(values, orderWhitelist)
+	}
+
+	It("parses filters, sort and paging", func() {
+		spec, err := parse("customer=acme&status[in]=open,shipped&total[from]=10&total[to]=30&sort=-total,customer&limit=5&offset=10")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Filters).To(ConsistOf(
+			dataaccess.Eq("customer", "acme"),
+			dataaccess.In("status", "open", "shipped"),
+			dataaccess.Range("total", "10", "30"),
+		))
+		Expect(spec.Sort).To(Equal([]dataaccess.SortField{{Column: "total", Desc: true}, {Column: "customer"}}))
+		Expect(spec.Paging).To(Equal(dataaccess.Paging{Limit: 5, Offset: 10}))
+	})
+
+	It("applies the default limit", func() {
+		spec, err := parse("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.Paging.Limit).To(Equal(dataaccess.DEFAULT_PAGE_LIMIT))
+	})
+
+	It("rejects fields and operators outside the whitelist", func() {
+		for _, query := range []string{"password=x", "status[regex]=.*", "sort=status", "limit=51", "limit=-1", "id=1%3BDROP+TABLE+orders"} {
+			_, err := parse(query)
+			Expect(err).To(HaveOccurred(), query)
+			Expect(err.(*kiterrors.Error).Status).To(Equal(http.StatusBadRequest))
+		}
+	})
+})
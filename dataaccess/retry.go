@@ -0,0 +1,48 @@
+package dataaccess
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing retry delays with jitter, capped at max
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	if initial <= 0 {
+		initial = DEFAULT_RETRY_INITIAL_INTERVAL
+	}
+	if max < initial {
+		max = initial
+	}
+	return &backoff{initial: initial, max: max}
+}
+
+// next returns the delay before the next attempt
+func (b *backoff) next() time.Duration {
+	delay := b.initial << uint(b.attempt)
+	if delay <= 0 || delay > b.max {
+		delay = b.max
+	} else {
+		b.attempt++
+	}
+	// up to 20% jitter so that instances started together do not retry in lockstep
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package dataaccess
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"shakilakhtar/go-microservices-platform/security/uaa"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// settings carrying the caller of a transaction when row-level security is configured, read
+	// by policies with current_setting('platform.tenant', true)
+	RLS_USER_ID_SETTING   = "platform.user_id"
+	RLS_CLIENT_ID_SETTING = "platform.client_id"
+	RLS_TENANT_SETTING    = "platform.tenant"
+	// RLS_SCOPES_SETTING holds the scopes of the token separated by commas, e.g. checked with
+	// 'orders.write' = ANY (string_to_array(current_setting('platform.scopes', true), ','))
+	RLS_SCOPES_SETTING = "platform.scopes"
+)
+
+// rlsSettings returns the settings passing the caller of a transaction on to the policies, the
+// empty string for what the caller does not have
+func rlsSettings(ctx context.Context, tenant string) [][2]string {
+	var user, client, scopes string
+	if claims, ok := uaa.ClaimsFromContext(ctx); ok {
+		user = uaa.StringClaim(claims, uaa.UserIdClaim)
+		client = uaa.StringClaim(claims, uaa.ClientIdClaim)
+		scopes = strings.Join(uaa.ScopesOf(claims), ",")
+	}
+	return [][2]string{
+		{RLS_USER_ID_SETTING, user},
+		{RLS_CLIENT_ID_SETTING, client},
+		{RLS_TENANT_SETTING, tenant},
+		{RLS_SCOPES_SETTING, scopes},
+	}
+}
+
+// setRLSSettings sets the settings of the caller local to a postgres transaction, so that they
+// cannot leak to the next user of the pooled connection
+func setRLSSettings(tx *Tx) error {
+	settings := rlsSettings(tx.ctx, tx.tenant)
+	calls := make([]string, len(settings))
+	args := make([]interface{}, 0, 2*len(settings))
+	for i, setting := range settings {
+		calls[i] = "set_config(?, ?, true)"
+		args = append(args, setting[0], setting[1])
+	}
+	return tx.Exec("SELECT "+strings.Join(calls, ", "), args...).Error
+}
+
+// checkRowLevelSecurity refuses statements outside of a transaction on a data source configured
+// with row-level security. Only transactions carry the settings read by the policies, without them
+// the policies would silently hide every row.
+func (ds *DataSource) checkRowLevelSecurity() error {
+	if ds.current().config.RowLevelSecurity {
+		return fmt.Errorf("statements of data source %q with row-level security must run in a transaction", ds.name)
+	}
+	return nil
+}
+
+// EnableRowLevelSecurity restricts the rows of a tenant-scoped table to the tenant of the
+// transaction, see RowLevelSecurityPolicySQL. Installing the policy again replaces it.
+func (ds *DataSource) EnableRowLevelSecurity(ctx context.Context, table string, tenantColumn string) error {
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return fmt.Errorf("row-level security is not supported on %s", ds.Dialect())
+	}
+	return ds.WithTransaction(ctx, func(tx *Tx) error {
+		_, err := ds.SQL().Exec(tx.Context(), RowLevelSecurityPolicySQL(table, tenantColumn))
+		return err
+	})
+}
+
+// RowLevelSecurityPolicySQL returns the statements enabling row-level security on a tenant-scoped
+// table, e.g. for a migration. The policy lets a transaction read and write only the rows whose
+// tenant column is the tenant of the transaction, as set when the data source is configured with
+// row_level_security.
+//
+// The policy fails closed: statements outside of a transaction, or in one without tenant, see no
+// rows and cannot write any. Repositories and SQL of the data source therefore refuse to run
+// outside of a transaction. It is forced on the owner of the table too, so that a service
+// connecting as the owner is restricted; superusers and roles with BYPASSRLS, e.g. for migrations,
+// are not.
+func RowLevelSecurityPolicySQL(table string, tenantColumn string) string {
+	quoted := quoteQualified(table)
+	name := pq.QuoteIdentifier(strings.ReplaceAll(table, ".", "_") + "_tenant_isolation")
+	check := fmt.Sprintf("%s = current_setting(%s, true)", pq.QuoteIdentifier(tenantColumn), quoteLiteral(RLS_TENANT_SETTING))
+
+	var statements bytes.Buffer
+	fmt.Fprintf(&statements, "ALTER TABLE %s ENABLE ROW LEVEL SECURITY;\n", quoted)
+	fmt.Fprintf(&statements, "ALTER TABLE %s FORCE ROW LEVEL SECURITY;\n", quoted)
+	fmt.Fprintf(&statements, "DROP POLICY IF EXISTS %s ON %s;\n", name, quoted)
+	fmt.Fprintf(&statements, "CREATE POLICY %s ON %s USING (%s) WITH CHECK (%s);\n", name, quoted, check, check)
+	return statements.String()
+}
@@ -0,0 +1,83 @@
+package dataaccess_test
+
+import (
+	"context"
+	"fmt"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	"shakilakhtar/go-microservices-platform/security/uaa"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("row-level security", func() {
+	It("should pass the caller on", func() {
+		ctx := uaa.WithClaims(context.Background(), jwt.MapClaims{
+			"user_id":   "4f1c",
+			"client_id": "orders-ui",
+			"scope":     []interface{}{"orders.read", "orders.write"},
+		})
+		Expect(dataaccess.RLSSettings(ctx, "acme")).To(Equal([][2]string{
+			{dataaccess.RLS_USER_ID_SETTING, "4f1c"},
+			{dataaccess.RLS_CLIENT_ID_SETTING, "orders-ui"},
+			{dataaccess.RLS_TENANT_SETTING, "acme"},
+			{dataaccess.RLS_SCOPES_SETTING, "orders.read,orders.write"},
+		}))
+	})
+
+	It("should clear the settings without a token", func() {
+		for _, setting := range dataaccess.RLSSettings(context.Background(), "") {
+			Expect(setting[1]).To(BeEmpty())
+		}
+	})
+
+	It("should build the policy statements", func() {
+		statements := dataaccess.RowLevelSecurityPolicySQL("sales.orders", "tenant_id")
+		Expect(statements).To(Equal(`ALTER TABLE "sales"."orders" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "sales"."orders" FORCE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS "sales_orders_tenant_isolation" ON "sales"."orders";
+CREATE POLICY "sales_orders_tenant_isolation" ON "sales"."orders" USING ("tenant_id" = current_setting('platform.tenant', true)) WITH CHECK ("tenant_id" = current_setting('platform.tenant', true));
+`))
+	})
+
+	It("should refuse statements outside of a transaction", func() {
+		newSQLiteDataSource(&order{})
+		config := dataaccess.Configuration.DBConfig
+		config.Database = dataaccess.DIALECT_SQLITE
+		config.Schema = fmt.Sprintf("file:repository%d?mode=memory&cache=shared", repositoryCount)
+		config.RowLevelSecurity = true
+		ds, err := dataaccess.RegisterDataSource("rls", config)
+		Expect(err).NotTo(HaveOccurred())
+		defer dataaccess.Shutdown()
+		repo := dataaccess.NewRepository(ds, &order{})
+		ctx := context.Background()
+
+		refused := MatchError(`statements of data source "rls" with row-level security must run in a transaction`)
+		Expect(repo.Get(ctx, &order{}, 1)).To(refused)
+		var orders []order
+		_, err = repo.List(ctx, dataaccess.QuerySpec{}, &orders)
+		Expect(err).To(refused)
+		_, err = repo.Count(ctx, dataaccess.QuerySpec{})
+		Expect(err).To(refused)
+		var count int
+		Expect(ds.SQL().Get(ctx, &count, "SELECT count(*) FROM orders")).To(refused)
+
+		err = ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			if err := repo.Create(tx.Context(), &order{Customer: "acme"}); err != nil {
+				return err
+			}
+			_, err := repo.List(tx.Context(), dataaccess.QuerySpec{}, &orders)
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orders).To(HaveLen(1))
+	})
+
+	It("should need postgres", func() {
+		ds := newSQLiteDataSource()
+		defer dataaccess.Shutdown()
+		Expect(ds.EnableRowLevelSecurity(context.Background(), "orders", "tenant")).To(MatchError("row-level security is not supported on sqlite3"))
+	})
+})
@@ -0,0 +1,212 @@
+package dataaccess
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_CREDENTIAL_CHECK_INTERVAL = 30 * time.Second
+	// DEFAULT_POOL_DRAIN_TIMEOUT is how long a replaced pool may finish the work in flight
+	DEFAULT_POOL_DRAIN_TIMEOUT = 30 * time.Second
+
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// errClosed is returned by rotations of a closed data source
+var errClosed = errors.New("the data source is closed")
+
+// CredentialSource returns the configuration a data source running with config should use now,
+// e.g. with the password of a rotated secret, or config itself while nothing changed
+type CredentialSource func(config dbConfiguration) (dbConfiguration, error)
+
+// RotationOptions set how WatchCredentials checks for and switches to new credentials
+type RotationOptions struct {
+	// Interval between the checks of the source, DEFAULT_CREDENTIAL_CHECK_INTERVAL unless set
+	Interval time.Duration
+	// DrainTimeout is how long the replaced pool may finish the work in flight before it is
+	// closed, DEFAULT_POOL_DRAIN_TIMEOUT unless set
+	DrainTimeout time.Duration
+}
+
+// EnvCredentials reads the environment overrides of the named data source again, see
+// applyEnvOverrides. Variables do not change in a running process, but the files named by the
+// _FILE variables do, e.g. DB_PASSWORD_FILE pointing at a mounted secret that is rotated in place.
+func EnvCredentials(name string) CredentialSource {
+	return func(config dbConfiguration) (dbConfiguration, error) {
+		_, err := applyEnvOverrides(&config, envPrefix(name))
+		return config, err
+	}
+}
+
+// FileCredentials reads the credentials from a JSON file holding them in the form of the
+// credentials of a bound service, e.g. {"username": "app", "password": "..."} or {"uri": "..."},
+// see LoadDBConfigurationFromVCAP. Settings the file leaves out are kept.
+func FileCredentials(path string) CredentialSource {
+	return func(config dbConfiguration) (dbConfiguration, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		var credentials map[string]interface{}
+		if err := json.Unmarshal(content, &credentials); err != nil {
+			// json errors name an offending character at most, never the secret
+			return config, fmt.Errorf("reading credentials from %s: %w", path, err)
+		}
+		return configurationFromCredentials(config, credentials)
+	}
+}
+
+// VCAPCredentials reads the credentials of the bound service selected like
+// LoadDBConfigurationFromVCAP again, so that a rebinding is picked up from the file named by
+// VCAP_SERVICES_FILE
+func VCAPCredentials(selector string) CredentialSource {
+	return func(config dbConfiguration) (dbConfiguration, error) {
+		service, err := boundService(selector)
+		if err != nil {
+			return config, err
+		}
+		config, err = configurationFromCredentials(config, service.Credentials)
+		if err != nil {
+			return config, fmt.Errorf("service %s: %w", service.Name, err)
+		}
+		return config, nil
+	}
+}
+
+// WatchCredentials checks the source at the interval of the options and rotates the credentials of
+// the data source when they changed, see RotateCredentials. It runs until ctx is done or the data
+// source is closed. Failed checks are logged and retried at the next interval, the data source
+// keeps running with its current pool meanwhile.
+func (ds *DataSource) WatchCredentials(ctx context.Context, source CredentialSource, options RotationOptions) {
+	interval := options.Interval
+	if interval <= 0 {
+		interval = DEFAULT_CREDENTIAL_CHECK_INTERVAL
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, err := ds.RotateCredentials(ctx, source, options.DrainTimeout)
+			if err == errClosed {
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				logger.WithFields(logger.Fields{"datasource": ds.name, "error": err}).Warn("Rotating database credentials failed")
+			}
+		}
+	}()
+}
+
+// RotateCredentials reads the configuration from the source and, when it changed, opens a new pool
+// with it and switches the data source over to the new pool at once. Transactions and queries
+// running on the replaced pool finish on it; the replaced pool is closed once they did, or when the
+// drain timeout passes, DEFAULT_POOL_DRAIN_TIMEOUT unless set. When the new pool cannot connect the
+// data source keeps the current one. Session locks stay on their connection of the replaced pool
+// until they are released, see Lock. The configuration of the default data source and
+// of those in Configuration.DataSources is updated too, so that opening them again keeps the
+// rotated credentials. It reports whether the credentials were rotated.
+func (ds *DataSource) RotateCredentials(ctx context.Context, source CredentialSource, drainTimeout time.Duration) (bool, error) {
+	ds.rotate.Lock()
+	defer ds.rotate.Unlock()
+	if ds.closed {
+		return false, errClosed
+	}
+
+	old := ds.current()
+	config, err := source(old.config)
+	if err != nil {
+		return false, fmt.Errorf("reading the credentials of data source %q: %w", ds.name, old.config.redactError(err))
+	}
+	if reflect.DeepEqual(config, old.config) {
+		return false, nil
+	}
+	p, err := ds.openPool(ctx, config)
+	if err != nil {
+		return false, err
+	}
+	ds.setDraining(old, true)
+	ds.pools.Store(p)
+	storeConfiguration(ds.name, config)
+
+	log := logger.WithFields(logger.Fields{"datasource": ds.name, "host": config.Host, "username": config.Username})
+	log.Info("Database credentials rotated")
+	if drainTimeout <= 0 {
+		drainTimeout = DEFAULT_POOL_DRAIN_TIMEOUT
+	}
+	go func() {
+		defer ds.setDraining(old, false)
+		if err := old.drain(drainTimeout); err != nil {
+			log.WithField("error", err).Warn("Closing the replaced pool failed")
+		}
+	}()
+	return true, nil
+}
+
+// setDraining records whether a replaced pool is still draining, so that CloseConnection leaves
+// the handles of the pool to the drain
+func (ds *DataSource) setDraining(p *pool, draining bool) {
+	ds.draining.Lock()
+	defer ds.draining.Unlock()
+	if !draining {
+		delete(ds.draining.pools, p)
+		return
+	}
+	if ds.draining.pools == nil {
+		ds.draining.pools = map[*pool]bool{}
+	}
+	ds.draining.pools[p] = true
+}
+
+// isDraining reports whether db belongs to a replaced pool that is still draining
+func (ds *DataSource) isDraining(db *gorm.DB) bool {
+	ds.draining.Lock()
+	defer ds.draining.Unlock()
+	for p := range ds.draining.pools {
+		if p.owns(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// drain closes the pools once no connection is in use or the timeout passed. It waits for one poll
+// interval at least, so that callers that got the pool right before it was replaced can start.
+func (p *pool) drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(drainPollInterval)
+		inUse := p.inUse()
+		if inUse == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.WithField("in_use", inUse).Warn("Closing the replaced pool with connections in use")
+			break
+		}
+	}
+	return p.close()
+}
+
+// inUse returns the number of connections of the pools in use, leaving out those of session locks
+func (p *pool) inUse() int {
+	inUse := p.db.DB().Stats().InUse - int(atomic.LoadInt32(&p.sessions))
+	for _, r := range p.replicas {
+		inUse += r.db.DB().Stats().InUse
+	}
+	return inUse
+}
@@ -1 +1,488 @@
 package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Querier is what the SQL helpers run on, implemented by *sql.DB, *sql.Tx and *sql.Conn
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// SQL runs hand written SQL on the connection pools of a data source without gorm. Writes go to
+// the primary and reads are routed like DataSource.Reader; both join the transaction carried by ctx.
+//
+// Queries take either positional arguments in the placeholder style of the driver, or a single
+// map or struct binding the named parameters of the query, e.g. :customer. A parameter bound to a
+// slice expands to a list, for use in IN (:ids). Rows are scanned into structs by the db tags of
+// their fields, falling back to the gorm column name, into map[string]interface{} or, for a single
+// column, into scalars.
+type SQL struct {
+	ds *DataSource
+}
+
+// SQL returns the database/sql helpers of the data source
+func (ds *DataSource) SQL() *SQL {
+	return &SQL{ds: ds}
+}
+
+// Exec runs a statement and returns its result
+func (s *SQL) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	q, err := s.querier(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	query, args, err = s.bind(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := startQueryTimer(ctx)
+	result, err := q.ExecContext(ctx, query, args...)
+	var rows int64
+	if err == nil {
+		rows, _ = result.RowsAffected()
+	}
+	s.ds.finishQuery(timer, sqlEvent(query, rows, err))
+	return result, err
+}
+
+// Get scans the first row of a query into dest, a pointer to a struct, map or scalar. A query
+// without rows is reported as errors.ErrNotFound.
+func (s *SQL) Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("Get expects a pointer, got %T", dest)
+	}
+	it, err := s.Iterate(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	if !it.Next() {
+		if err := it.Err(); err != nil {
+			return err
+		}
+		return kiterrors.ErrNotFound.WithCause(sql.ErrNoRows)
+	}
+	if err := it.Scan(dest); err != nil {
+		return err
+	}
+	return it.Close()
+}
+
+// Select scans all rows of a query into dest, a pointer to a slice of structs, struct pointers,
+// maps or scalars
+func (s *SQL) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Ptr || target.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("Select expects a pointer to a slice, got %T", dest)
+	}
+	slice := target.Elem()
+	elemType := slice.Type().Elem()
+
+	it, err := s.Iterate(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	slice.Set(slice.Slice(0, 0))
+	for it.Next() {
+		elem := reflect.New(elemType)
+		if elemType.Kind() == reflect.Ptr {
+			elem.Elem().Set(reflect.New(elemType.Elem()))
+			if err := it.Scan(elem.Elem().Interface()); err != nil {
+				return err
+			}
+		} else if err := it.Scan(elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return it.Close()
+}
+
+// Iterate runs a query and returns an iterator over its rows, for result sets too large to hold
+// in memory. The iterator has to be closed.
+func (s *SQL) Iterate(ctx context.Context, query string, args ...interface{}) (*Iterator, error) {
+	q, err := s.querier(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	query, args, err = s.bind(query, args)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := startQueryTimer(ctx)
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.ds.finishQuery(timer, sqlEvent(query, 0, err))
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		s.ds.finishQuery(timer, sqlEvent(query, 0, err))
+		return nil, err
+	}
+	return &Iterator{rows: rows, columns: columns, ds: s.ds, timer: timer, query: query}, nil
+}
+
+// querier returns the transaction of the data source carried by ctx, or else the primary for
+// writes and a reader for reads. SQL of a tenant has to run in a transaction, whose search path
+// is the schema of the tenant.
+func (s *SQL) querier(ctx context.Context, write bool) (Querier, error) {
+	tenant, isTenant := TenantFromContext(ctx)
+	if tx, ok := TransactionFromContext(ctx); ok && tx.ds == s.ds {
+		if tenant != tx.tenant {
+			return nil, crossTenant(tx.tenant, tenant)
+		}
+		q, ok := tx.CommonDB().(Querier)
+		if !ok {
+			return nil, fmt.Errorf("transaction of data source %q does not support contexts", s.ds.name)
+		}
+		return q, nil
+	}
+	if isTenant {
+		return nil, kiterrors.ErrForbidden.WithCause(fmt.Errorf("SQL of tenant %s must run in a transaction", tenant))
+	}
+	if err := s.ds.checkRowLevelSecurity(); err != nil {
+		return nil, err
+	}
+	if write {
+		return s.ds.DB().DB(), nil
+	}
+	return s.ds.Reader(ctx).DB(), nil
+}
+
+// bind binds the named parameters of a query to a single map or struct argument, and passes
+// positional arguments on untouched
+func (s *SQL) bind(query string, args []interface{}) (string, []interface{}, error) {
+	if len(args) != 1 || !isNamedArg(args[0]) {
+		return query, args, nil
+	}
+	return BindNamed(s.ds.Dialect(), query, args[0])
+}
+
+// BindNamed replaces the named parameters of a query, e.g. :customer, by the placeholders of the
+// dialect and returns the values of arg, a map or struct, in their order. Slices expand to a list
+// of placeholders. Quoted text and postgres casts such as ::text are left alone.
+func BindNamed(dialect string, query string, arg interface{}) (string, []interface{}, error) {
+	lookup, err := namedValues(arg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var (
+		bound strings.Builder
+		args  []interface{}
+		quote rune
+	)
+	placeholder := func(value interface{}) {
+		args = append(args, value)
+		bound.WriteString(bindVar(dialect, len(args)))
+	}
+
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ':' && i+1 < len(runes) && runes[i+1] == ':':
+			// a postgres cast
+			bound.WriteString("::")
+			i++
+			continue
+		case r == ':' && i+1 < len(runes) && isNameStart(runes[i+1]):
+			end := i + 1
+			for end < len(runes) && isNamePart(runes[end]) {
+				end++
+			}
+			name := string(runes[i+1 : end])
+			value, ok := lookup(name)
+			if !ok {
+				return "", nil, fmt.Errorf("no value for parameter :%s", name)
+			}
+			if list, ok := expandable(value); ok {
+				if list.Len() == 0 {
+					return "", nil, fmt.Errorf("parameter :%s is an empty list", name)
+				}
+				for j := 0; j < list.Len(); j++ {
+					if j > 0 {
+						bound.WriteString(", ")
+					}
+					placeholder(list.Index(j).Interface())
+				}
+			} else {
+				placeholder(value)
+			}
+			i = end - 1
+			continue
+		}
+		bound.WriteRune(r)
+	}
+	return bound.String(), args, nil
+}
+
+// bindVar returns the placeholder of the nth argument of a statement in the style of the dialect
+func bindVar(dialect string, n int) string {
+	switch dialect {
+	case DIALECT_POSTGRES:
+		return fmt.Sprintf("$%d", n)
+	case DIALECT_MSSQL:
+		return fmt.Sprintf("@p%d", n)
+	default:
+		return "?"
+	}
+}
+
+// Iterator streams the rows of a query, see SQL.Iterate
+type Iterator struct {
+	rows    *sql.Rows
+	columns []string
+	count   int64
+	closed  bool
+
+	ds    *DataSource
+	timer *queryTimer
+	query string
+}
+
+// Next advances to the next row, returning false after the last row or on error, see Err
+func (it *Iterator) Next() bool {
+	if it.rows.Next() {
+		it.count++
+		return true
+	}
+	return false
+}
+
+// Columns returns the column names of the rows
+func (it *Iterator) Columns() []string {
+	return it.columns
+}
+
+// Scan copies the current row into dest, a pointer to a struct, map or scalar
+func (it *Iterator) Scan(dest interface{}) error {
+	return scanRow(it.rows, it.columns, reflect.ValueOf(dest))
+}
+
+// Err returns the error that ended the iteration
+func (it *Iterator) Err() error {
+	return it.rows.Err()
+}
+
+// Close releases the connection of the iterator. It can be called more than once.
+func (it *Iterator) Close() error {
+	if it.closed {
+		return it.rows.Err()
+	}
+	it.closed = true
+	err := it.rows.Close()
+	if err == nil {
+		err = it.rows.Err()
+	}
+	it.ds.finishQuery(it.timer, sqlEvent(it.query, it.count, err))
+	return err
+}
+
+func sqlEvent(query string, rows int64, err error) QueryEvent {
+	return QueryEvent{Table: sqlTable(query), Operation: sqlOperation(query), SQL: query, Rows: rows, ErrorClass: ErrorClass(err)}
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	valuerType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+	// columns of the struct types scanned so far, by type
+	structColumns sync.Map
+)
+
+// scanRow copies the current row into dest
+func scanRow(rows *sql.Rows, columns []string, dest reflect.Value) error {
+	if dest.Kind() != reflect.Ptr || dest.IsNil() {
+		return fmt.Errorf("scan expects a pointer, got %s", dest.Type())
+	}
+	target := dest.Elem()
+
+	switch {
+	case target.Kind() == reflect.Map:
+		if target.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot scan into %s", target.Type())
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		if target.IsNil() {
+			target.Set(reflect.MakeMapWithSize(target.Type(), len(columns)))
+		}
+		for i, column := range columns {
+			value := values[i]
+			// text columns of some drivers come as bytes
+			if b, ok := value.([]byte); ok {
+				value = string(b)
+			}
+			v := reflect.ValueOf(&value).Elem()
+			if value != nil && target.Type().Elem().Kind() != reflect.Interface {
+				v = reflect.ValueOf(value)
+				if !v.Type().ConvertibleTo(target.Type().Elem()) {
+					return fmt.Errorf("cannot scan column %s of type %s into %s", column, v.Type(), target.Type())
+				}
+				v = v.Convert(target.Type().Elem())
+			}
+			if value == nil {
+				v = reflect.Zero(target.Type().Elem())
+			}
+			target.SetMapIndex(reflect.ValueOf(column), v)
+		}
+		return nil
+
+	case isScannableStruct(target.Type()):
+		fields := columnsOf(target.Type())
+		pointers := make([]interface{}, len(columns))
+		for i, column := range columns {
+			index, ok := fields[strings.ToLower(column)]
+			if !ok {
+				return fmt.Errorf("no field of %s for column %s", target.Type(), column)
+			}
+			pointers[i] = target.FieldByIndex(index).Addr().Interface()
+		}
+		return rows.Scan(pointers...)
+
+	default:
+		if len(columns) != 1 {
+			return fmt.Errorf("cannot scan %d columns into %s", len(columns), target.Type())
+		}
+		return rows.Scan(dest.Interface())
+	}
+}
+
+// columnsOf returns the index of the field of every column of a struct type. Columns are named by
+// the db tag of the field, "-" to skip it, or else like gorm names them. Fields of embedded
+// structs are included.
+func columnsOf(t reflect.Type) map[string][]int {
+	if cached, ok := structColumns.Load(t); ok {
+		return cached.(map[string][]int)
+	}
+	columns := map[string][]int{}
+	var collect func(t reflect.Type, index []int)
+	collect = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := strings.Split(field.Tag.Get("db"), ",")[0]
+			if tag == "-" || field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			fieldIndex := append(append([]int{}, index...), i)
+			if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+				collect(field.Type, fieldIndex)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			if tag == "" {
+				tag = gorm.ToColumnName(field.Name)
+			}
+			column := strings.ToLower(tag)
+			// fields of the outer struct take precedence over embedded ones
+			if existing, ok := columns[column]; !ok || len(existing) > len(fieldIndex) {
+				columns[column] = fieldIndex
+			}
+		}
+	}
+	collect(t, nil)
+	structColumns.Store(t, columns)
+	return columns
+}
+
+// namedValues returns the lookup of the named parameters in a map or struct
+func namedValues(arg interface{}) (func(name string) (interface{}, bool), error) {
+	v := reflect.ValueOf(arg)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		return func(name string) (interface{}, bool) {
+			value := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+			if !value.IsValid() {
+				return nil, false
+			}
+			return value.Interface(), true
+		}, nil
+	case v.Kind() == reflect.Struct:
+		fields := columnsOf(v.Type())
+		return func(name string) (interface{}, bool) {
+			index, ok := fields[strings.ToLower(name)]
+			if !ok {
+				return nil, false
+			}
+			return v.FieldByIndex(index).Interface(), true
+		}, nil
+	}
+	return nil, fmt.Errorf("named parameters need a map or struct, got %T", arg)
+}
+
+// isNamedArg reports whether arg binds named parameters rather than being a positional value
+func isNamedArg(arg interface{}) bool {
+	if arg == nil {
+		return false
+	}
+	t := reflect.TypeOf(arg)
+	if t.Implements(valuerType) {
+		return false
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Map && t.Key().Kind() == reflect.String || t.Kind() == reflect.Struct && t != timeType
+}
+
+func isScannableStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && !reflect.PtrTo(t).Implements(scannerType)
+}
+
+// expandable returns the elements of a slice bound to a parameter, other than bytes and values
+// the driver converts itself
+func expandable(value interface{}) (reflect.Value, bool) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 || v.Type().Implements(valuerType) {
+		return v, false
+	}
+	return v, true
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isNamePart(r rune) bool {
+	return isNameStart(r) || r >= '0' && r <= '9'
+}
@@ -0,0 +1,187 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type orderRow struct {
+	Id       int64
+	Customer string
+	Amount   int    `db:"total"`
+	Ignored  string `db:"-"`
+}
+
+type orderWithStatus struct {
+	orderRow
+	Status string `db:"status"`
+}
+
+var _ = Describe("SQL", func() {
+	var (
+		ds  *dataaccess.DataSource
+		db  *dataaccess.SQL
+		ctx = context.Background()
+	)
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&order{})
+		db = ds.SQL()
+		for _, o := range []order{
+			{Customer: "acme", Status: "open", Total: 10},
+			{Customer: "acme", Status: "shipped", Total: 20},
+			{Customer: "globex", Status: "open", Total: 30},
+		} {
+			_, err := db.Exec(ctx, "INSERT INTO orders (customer, status, total) VALUES (:customer, :status, :total)", o)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	Context("named parameters", func() {
+		It("should bind the placeholders of the dialect", func() {
+			query, args, err := dataaccess.BindNamed(dataaccess.DIALECT_POSTGRES,
+				"SELECT * FROM orders WHERE customer = :customer AND status = :status OR note = ':customer' AND total::text = :customer",
+				map[string]interface{}{"customer": "acme", "status": "open"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query).To(Equal("SELECT * FROM orders WHERE customer = $1 AND status = $2 OR note = ':customer' AND total::text = $3"))
+			Expect(args).To(Equal([]interface{}{"acme", "open", "acme"}))
+
+			query, _, err = dataaccess.BindNamed(dataaccess.DIALECT_MSSQL, "SELECT * FROM orders WHERE id = :id", map[string]interface{}{"id": 1})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query).To(Equal("SELECT * FROM orders WHERE id = @p1"))
+		})
+
+		It("should expand slices to lists", func() {
+			query, args, err := dataaccess.BindNamed(dataaccess.DIALECT_MYSQL, "SELECT * FROM orders WHERE id IN (:ids) AND note = :note",
+				map[string]interface{}{"ids": []int{1, 2, 3}, "note": []byte("x")})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(query).To(Equal("SELECT * FROM orders WHERE id IN (?, ?, ?) AND note = ?"))
+			Expect(args).To(Equal([]interface{}{1, 2, 3, []byte("x")}))
+		})
+
+		It("should refuse missing values and empty lists", func() {
+			_, _, err := dataaccess.BindNamed(dataaccess.DIALECT_POSTGRES, "SELECT :missing", map[string]interface{}{})
+			Expect(err).To(MatchError("no value for parameter :missing"))
+			_, _, err = dataaccess.BindNamed(dataaccess.DIALECT_POSTGRES, "SELECT :ids", map[string]interface{}{"ids": []int{}})
+			Expect(err).To(MatchError("parameter :ids is an empty list"))
+		})
+
+		It("should pass positional arguments on", func() {
+			var count int
+			Expect(db.Get(ctx, &count, "SELECT count(*) FROM orders WHERE customer = ?", "acme")).To(Succeed())
+			Expect(count).To(Equal(2))
+		})
+	})
+
+	Context("scanning", func() {
+		It("should scan rows into structs by db tag", func() {
+			var rows []orderRow
+			Expect(db.Select(ctx, &rows, "SELECT id, customer, total FROM orders WHERE customer = :customer ORDER BY id",
+				map[string]interface{}{"customer": "acme"})).To(Succeed())
+			Expect(rows).To(Equal([]orderRow{{Id: 1, Customer: "acme", Amount: 10}, {Id: 2, Customer: "acme", Amount: 20}}))
+		})
+
+		It("should scan into embedded structs and struct pointers", func() {
+			var rows []*orderWithStatus
+			Expect(db.Select(ctx, &rows, "SELECT id, customer, total, status FROM orders WHERE id IN (:ids) ORDER BY id",
+				map[string]interface{}{"ids": []int{2, 3}})).To(Succeed())
+			Expect(rows).To(HaveLen(2))
+			Expect(rows[1].Customer).To(Equal("globex"))
+			Expect(rows[1].Status).To(Equal("open"))
+		})
+
+		It("should refuse columns without field", func() {
+			var rows []orderRow
+			err := db.Select(ctx, &rows, "SELECT id, status FROM orders")
+			Expect(err).To(MatchError(ContainSubstring("no field")))
+		})
+
+		It("should scan into maps and scalars", func() {
+			var rows []map[string]interface{}
+			Expect(db.Select(ctx, &rows, "SELECT customer, total FROM orders ORDER BY id")).To(Succeed())
+			Expect(rows).To(HaveLen(3))
+			Expect(rows[0]).To(HaveKeyWithValue("customer", "acme"))
+			Expect(rows[0]).To(HaveKeyWithValue("total", BeEquivalentTo(10)))
+
+			var customers []string
+			Expect(db.Select(ctx, &customers, "SELECT DISTINCT customer FROM orders ORDER BY customer")).To(Succeed())
+			Expect(customers).To(Equal([]string{"acme", "globex"}))
+
+			var row map[string]interface{}
+			Expect(db.Get(ctx, &row, "SELECT status FROM orders WHERE id = ?", 2)).To(Succeed())
+			Expect(row).To(Equal(map[string]interface{}{"status": "shipped"}))
+		})
+
+		It("should report a missing row as not found", func() {
+			var row orderRow
+			err := db.Get(ctx, &row, "SELECT id, customer, total FROM orders WHERE id = :id", map[string]interface{}{"id": 99})
+			Expect(statusOf(err)).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	It("should stream rows through an iterator", func() {
+		it, err := db.Iterate(ctx, "SELECT id, customer, total FROM orders ORDER BY id")
+		Expect(err).NotTo(HaveOccurred())
+		defer it.Close()
+
+		var totals []int
+		for it.Next() {
+			var row orderRow
+			Expect(it.Scan(&row)).To(Succeed())
+			totals = append(totals, row.Amount)
+		}
+		Expect(it.Err()).NotTo(HaveOccurred())
+		Expect(it.Close()).To(Succeed())
+		Expect(totals).To(Equal([]int{10, 20, 30}))
+	})
+
+	It("should join the transaction carried by the context", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			if _, err := db.Exec(tx.Context(), "DELETE FROM orders WHERE customer = :customer", map[string]interface{}{"customer": "acme"}); err != nil {
+				return err
+			}
+			var count int
+			Expect(db.Get(tx.Context(), &count, "SELECT count(*) FROM orders")).To(Succeed())
+			Expect(count).To(Equal(1))
+			return errors.New("undo")
+		})
+		Expect(err).To(MatchError("undo"))
+
+		var count int
+		Expect(db.Get(ctx, &count, "SELECT count(*) FROM orders")).To(Succeed())
+		Expect(count).To(Equal(3))
+	})
+
+	It("should refuse tenant SQL outside of a transaction", func() {
+		tenantCtx, err := dataaccess.WithTenant(ctx, "acme")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = db.Exec(tenantCtx, "DELETE FROM orders")
+		Expect(statusOf(err)).To(Equal(http.StatusForbidden))
+	})
+
+	It("should instrument the queries", func() {
+		var events []dataaccess.QueryEvent
+		dataaccess.SetQueryObserver(func(ctx context.Context, event dataaccess.QueryEvent) {
+			events = append(events, event)
+		})
+		defer dataaccess.SetQueryObserver(nil)
+
+		var rows []orderRow
+		Expect(db.Select(ctx, &rows, "SELECT id, customer, total FROM orders WHERE customer = 'acme'")).To(Succeed())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Table).To(Equal("orders"))
+		Expect(events[0].Operation).To(Equal("SELECT"))
+		Expect(events[0].Rows).To(BeEquivalentTo(2))
+		Expect(events[0].SQL).To(Equal("SELECT id, customer, total FROM orders WHERE customer = ?"))
+	})
+})
@@ -0,0 +1,190 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"shakilakhtar/go-microservices-platform/dataaccess/migrate"
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+	"shakilakhtar/go-microservices-platform/security/uaa"
+)
+
+const (
+	// TENANT_HEADER carries the tenant of requests made without a token, e.g. between services
+	TENANT_HEADER = "X-Tenant-Id"
+	// TENANT_SCHEMA_PREFIX prefixes the schema of every tenant
+	TENANT_SCHEMA_PREFIX = "tenant_"
+)
+
+// tenantPattern only accepts canonical tenant ids, lowercase with hyphens as the one separator, so
+// that every tenant id maps to a schema of its own
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,47}$`)
+
+type tenantContextKey struct{}
+
+// TenantResolver finds the tenant of a request. The tenant comes from a claim of the token
+// validated by uaa.Protected, and only for requests without a token from the header.
+// A header naming another tenant than the token is refused.
+type TenantResolver struct {
+	// Claim carrying the tenant, the UAA zone id unless set
+	Claim string
+	// Header read when the request carries no token, empty to require a token
+	Header string
+}
+
+// Resolve returns the tenant of the request
+func (t TenantResolver) Resolve(r *http.Request) (string, error) {
+	claim := t.Claim
+	if claim == "" {
+		claim = uaa.ZoneIdClaim
+	}
+	var header string
+	if t.Header != "" {
+		header = r.Header.Get(t.Header)
+	}
+
+	tenant := header
+	if claims, ok := uaa.ClaimsFromContext(r.Context()); ok {
+		tenant = uaa.StringClaim(claims, claim)
+		if tenant == "" {
+			return "", kiterrors.ErrForbidden.WithCause(fmt.Errorf("token carries no %s claim", claim))
+		}
+		if header != "" && header != tenant {
+			return "", crossTenant(tenant, header)
+		}
+	}
+	if tenant == "" {
+		return "", kiterrors.NewStatusError(kiterrors.BAD_REQUEST, http.StatusBadRequest, "The request does not name a tenant.")
+	}
+	if err := validateTenant(tenant); err != nil {
+		return "", err
+	}
+	return tenant, nil
+}
+
+// TenantHandler scopes the data access of every request to the tenant found by the resolver.
+// It has to run inside of uaa.Protected for the token claims to be available.
+func TenantHandler(resolver TenantResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := resolver.Resolve(r)
+		ctx := r.Context()
+		if err == nil {
+			ctx, err = WithTenant(ctx, tenant)
+		}
+		if err != nil {
+			var e *kiterrors.Error
+			if !errors.As(err, &e) {
+				e = kiterrors.ErrBadRequest.WithCause(err)
+			}
+			kiterrors.WriteErrorContext(r.Context(), w, e)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// WithTenant returns a context scoping the repositories and transactions using it to the schema
+// of the tenant. A context that is already scoped to another tenant cannot be rescoped.
+func WithTenant(ctx context.Context, tenant string) (context.Context, error) {
+	if err := validateTenant(tenant); err != nil {
+		return ctx, err
+	}
+	if current, ok := TenantFromContext(ctx); ok && current != tenant {
+		return ctx, crossTenant(current, tenant)
+	}
+	return context.WithValue(ctx, tenantContextKey{}, tenant), nil
+}
+
+// TenantFromContext returns the tenant the context is scoped to
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenant, ok
+}
+
+// TenantSchema returns the schema holding the data of the tenant. The hyphens of the tenant id
+// become underscores, which valid tenant ids do not contain.
+func TenantSchema(tenant string) string {
+	return TENANT_SCHEMA_PREFIX + strings.Replace(tenant, "-", "_", -1)
+}
+
+// ProvisionTenant creates the schema of a tenant and applies the migrations to it, recording them
+// in a ledger inside of the schema. It can be called again to migrate an existing tenant.
+// Schema per tenant needs postgres.
+func (ds *DataSource) ProvisionTenant(ctx context.Context, tenant string, migrations []*migrate.Migration) error {
+	if err := validateTenant(tenant); err != nil {
+		return err
+	}
+	if ds.Dialect() != DIALECT_POSTGRES {
+		return fmt.Errorf("schema per tenant is not supported for %s", ds.Dialect())
+	}
+	schema := TenantSchema(tenant)
+	create := "CREATE SCHEMA IF NOT EXISTS " + ds.DB().Dialect().Quote(schema)
+	err := ds.instrument(ctx, create, func() (int64, error) {
+		result := ds.DB().Exec(create)
+		return result.RowsAffected, result.Error
+	})
+	if err != nil {
+		return fmt.Errorf("creating schema of tenant %s: %w", tenant, err)
+	}
+
+	// a pool of its own, so that unqualified names in the migrations resolve to the tenant schema
+	config := ds.current().config
+	config.SearchPath = schema
+	config.Replicas = nil
+	dsn, err := buildDSN(config)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(config.Dialect(), dsn)
+	if err != nil {
+		return config.redactError(err)
+	}
+	defer db.Close()
+
+	migrator, err := migrate.New(db, migrate.POSTGRES, migrations)
+	if err != nil {
+		return err
+	}
+	migrator.Table = schema + "." + migrate.DEFAULT_TABLE
+	if _, err := migrator.Up(ctx); err != nil {
+		return fmt.Errorf("migrating tenant %s: %w", tenant, config.redactError(err))
+	}
+	return nil
+}
+
+// scopeTransaction points the search path of a postgres transaction at the schema of the tenant
+// and, with row-level security configured, sets the settings of the caller read by the policies
+func scopeTransaction(tx *Tx) error {
+	if tx.ds.Dialect() != DIALECT_POSTGRES {
+		return nil
+	}
+	if tx.tenant != "" {
+		searchPath := tx.Dialect().Quote(TenantSchema(tx.tenant)) + ", public"
+		if err := tx.Exec("SELECT set_config('search_path', ?, true)", searchPath).Error; err != nil {
+			return err
+		}
+	}
+	if tx.ds.current().config.RowLevelSecurity {
+		return setRLSSettings(tx)
+	}
+	return nil
+}
+
+func validateTenant(tenant string) error {
+	if !tenantPattern.MatchString(tenant) {
+		return kiterrors.NewStatusError(kiterrors.BAD_REQUEST, http.StatusBadRequest, "The tenant id is invalid.")
+	}
+	return nil
+}
+
+func crossTenant(tenant, other string) error {
+	if tenant == "" {
+		return kiterrors.ErrForbidden.WithCause(fmt.Errorf("a transaction without tenant cannot access the data of tenant %s", other))
+	}
+	return kiterrors.ErrForbidden.WithCause(fmt.Errorf("tenant %s cannot access the data of tenant %s", tenant, other))
+}
@@ -0,0 +1,198 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+	"shakilakhtar/go-microservices-platform/security/uaa"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var tenantCount int
+
+// statusOf returns the HTTP status of a platform error
+func statusOf(err error) int {
+	var e *kiterrors.Error
+	if errors.As(err, &e) {
+		return e.Status
+	}
+	return 0
+}
+
+var _ = Describe("tenants", func() {
+	var resolver = dataaccess.TenantResolver{Header: dataaccess.TENANT_HEADER}
+
+	request := func(claims jwt.MapClaims, header string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if claims != nil {
+			r = r.WithContext(uaa.WithClaims(r.Context(), claims))
+		}
+		if header != "" {
+			r.Header.Set(dataaccess.TENANT_HEADER, header)
+		}
+		return r
+	}
+
+	Describe("resolving the tenant of a request", func() {
+		It("takes the zone id of the token", func() {
+			tenant, err := resolver.Resolve(request(jwt.MapClaims{"zid": "acme"}, ""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tenant).To(Equal("acme"))
+		})
+
+		It("takes a custom claim", func() {
+			custom := dataaccess.TenantResolver{Claim: "tenant"}
+			tenant, err := custom.Resolve(request(jwt.MapClaims{"zid": "uaa", "tenant": "acme"}, ""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tenant).To(Equal("acme"))
+		})
+
+		It("takes the header of requests without a token", func() {
+			tenant, err := resolver.Resolve(request(nil, "globex"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tenant).To(Equal("globex"))
+		})
+
+		It("refuses a header naming another tenant than the token", func() {
+			_, err := resolver.Resolve(request(jwt.MapClaims{"zid": "acme"}, "globex"))
+			Expect(statusOf(err)).To(Equal(http.StatusForbidden))
+		})
+
+		It("refuses tokens without the claim", func() {
+			_, err := resolver.Resolve(request(jwt.MapClaims{"user_name": "jon"}, "acme"))
+			Expect(statusOf(err)).To(Equal(http.StatusForbidden))
+		})
+
+		It("refuses requests without tenant and invalid tenant ids", func() {
+			_, err := resolver.Resolve(request(nil, ""))
+			Expect(statusOf(err)).To(Equal(http.StatusBadRequest))
+			_, err = resolver.Resolve(request(nil, "acme; drop schema"))
+			Expect(statusOf(err)).To(Equal(http.StatusBadRequest))
+		})
+
+		It("refuses tenant ids that are not canonical", func() {
+			// Acme-1 and acme_1 would share the schema of acme-1
+			for _, tenant := range []string{"Acme-1", "acme_1"} {
+				_, err := resolver.Resolve(request(nil, tenant))
+				Expect(statusOf(err)).To(Equal(http.StatusBadRequest))
+				_, err = dataaccess.WithTenant(context.Background(), tenant)
+				Expect(statusOf(err)).To(Equal(http.StatusBadRequest))
+			}
+			_, err := dataaccess.WithTenant(context.Background(), "acme-1")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("scopes the request context in the handler", func() {
+			var tenant string
+			handler := dataaccess.TenantHandler(resolver, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tenant, _ = dataaccess.TenantFromContext(r.Context())
+			}))
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request(jwt.MapClaims{"zid": "acme"}, ""))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(tenant).To(Equal("acme"))
+
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request(jwt.MapClaims{"zid": "acme"}, "globex"))
+			Expect(recorder.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	It("names the schema of a tenant", func() {
+		Expect(dataaccess.TenantSchema("acme-eu")).To(Equal("tenant_acme_eu"))
+	})
+
+	It("does not rescope a context to another tenant", func() {
+		ctx, err := dataaccess.WithTenant(context.Background(), "acme")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = dataaccess.WithTenant(ctx, "acme")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = dataaccess.WithTenant(ctx, "globex")
+		Expect(statusOf(err)).To(Equal(http.StatusForbidden))
+	})
+
+	Describe("repositories", func() {
+		var (
+			ds         *dataaccess.DataSource
+			repo       *dataaccess.Repository
+			acme, glob context.Context
+		)
+
+		BeforeEach(func() {
+			tenantCount++
+			dataaccess.GetConfiguration()
+			config := dataaccess.Configuration.DBConfig
+			config.Database = dataaccess.DIALECT_SQLITE
+			config.Schema = fmt.Sprintf("file:tenants%d?mode=memory&cache=shared", tenantCount)
+			// attached databases stand in for schemas and are attached per connection
+			config.MaxOpenConns = 1
+			var err error
+			ds, err = dataaccess.RegisterDataSource(fmt.Sprintf("tenants%d", tenantCount), config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.DB().AutoMigrate(&order{}).Error).NotTo(HaveOccurred())
+			for _, tenant := range []string{"acme", "globex"} {
+				schema := dataaccess.TenantSchema(tenant)
+				attach := fmt.Sprintf("ATTACH DATABASE 'file:tenants%d_%s?mode=memory&cache=shared' AS %s", tenantCount, tenant, schema)
+				Expect(ds.DB().Exec(attach).Error).NotTo(HaveOccurred())
+				Expect(ds.DB().Table(schema + ".orders").AutoMigrate(&order{}).Error).NotTo(HaveOccurred())
+			}
+			repo = dataaccess.NewRepository(ds, &order{})
+
+			acme, err = dataaccess.WithTenant(context.Background(), "acme")
+			Expect(err).NotTo(HaveOccurred())
+			glob, err = dataaccess.WithTenant(context.Background(), "globex")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("keep the data of tenants apart", func() {
+			Expect(repo.Create(acme, &order{Customer: "road runner"})).To(Succeed())
+			Expect(repo.BulkCreate(glob, []order{{Customer: "hank"}, {Customer: "homer"}})).To(Succeed())
+
+			var orders []order
+			_, err := repo.List(acme, dataaccess.QuerySpec{}, &orders)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(orders).To(HaveLen(1))
+			Expect(orders[0].Customer).To(Equal("road runner"))
+
+			Expect(repo.Count(glob, dataaccess.QuerySpec{})).To(BeEquivalentTo(2))
+			Expect(repo.Count(context.Background(), dataaccess.QuerySpec{})).To(BeZero())
+
+			var o order
+			// globex has a second order, acme does not
+			Expect(repo.Get(glob, &o, 2)).To(Succeed())
+			Expect(statusOf(repo.Get(acme, &o, 2))).To(Equal(http.StatusNotFound))
+		})
+
+		It("scope transactions to the tenant", func() {
+			err := ds.WithTransaction(acme, func(tx *dataaccess.Tx) error {
+				return repo.Create(tx.Context(), &order{Customer: "road runner"})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(repo.Count(acme, dataaccess.QuerySpec{})).To(BeEquivalentTo(1))
+		})
+
+		It("refuse to use a transaction for another tenant", func() {
+			err := ds.WithTransaction(context.Background(), func(tx *dataaccess.Tx) error {
+				ctx, err := dataaccess.WithTenant(tx.Context(), "acme")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(statusOf(ds.WithTransaction(ctx, func(*dataaccess.Tx) error { return nil }))).To(Equal(http.StatusForbidden))
+				return repo.Create(ctx, &order{Customer: "road runner"})
+			})
+			Expect(statusOf(err)).To(Equal(http.StatusForbidden))
+			Expect(repo.Count(acme, dataaccess.QuerySpec{})).To(BeZero())
+		})
+
+		It("provision tenants on postgres only", func() {
+			Expect(ds.ProvisionTenant(context.Background(), "acme", nil)).To(MatchError(ContainSubstring("not supported")))
+		})
+	})
+})
@@ -0,0 +1,224 @@
+package dataaccess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// DEFAULT_TX_RETRIES is how often a transaction failing with a serialization error or deadlock is retried
+	DEFAULT_TX_RETRIES = 3
+
+	txRetryInitialInterval = 20 * time.Millisecond
+	txRetryMaxInterval     = time.Second
+)
+
+// Tx is an open transaction. It embeds the gorm handle of the transaction, which audits changes
+// as made by the identity of the context the transaction was started with. Its Context carries
+// the transaction so that repository calls made with it join the transaction.
+type Tx struct {
+	*gorm.DB
+	ds  *DataSource
+	ctx context.Context
+	// tenant the transaction is scoped to, see WithTenant
+	tenant string
+	depth  int
+}
+
+type txContextKey struct{}
+
+// Context returns a context carrying the transaction
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+// TransactionFromContext returns the transaction carried by ctx
+func TransactionFromContext(ctx context.Context) (*Tx, bool) {
+	tx, ok := ctx.Value(txContextKey{}).(*Tx)
+	return tx, ok
+}
+
+// WithTransaction runs fn in a transaction of the default data source, see DataSource.WithTransaction
+func WithTransaction(ctx context.Context, fn func(tx *Tx) error) error {
+	ds, err := Connect(ctx, DEFAULT_DATASOURCE)
+	if err != nil {
+		return err
+	}
+	return ds.WithTransaction(ctx, fn)
+}
+
+// WithTransaction runs fn in a transaction that is committed when fn returns nil and rolled back
+// when it returns an error or panics. When ctx already carries a transaction of the data source,
+// fn runs in a savepoint of it instead. Transactions failing with a serialization error or a
+// deadlock are retried with backoff, so fn must be safe to run more than once. When ctx is scoped
+// to a tenant the search path of the transaction is the schema of the tenant. Data sources configured
+// with row_level_security pass the caller of ctx on to the policies, see RowLevelSecurityPolicySQL.
+func (ds *DataSource) WithTransaction(ctx context.Context, fn func(tx *Tx) error) error {
+	if outer, ok, err := ds.outerTransaction(ctx); ok {
+		if err != nil {
+			return err
+		}
+		return outer.savepoint(fn)
+	}
+
+	retries := ds.current().config.TxMaxRetries
+	if retries <= 0 {
+		retries = DEFAULT_TX_RETRIES
+	}
+	retry := newBackoff(txRetryInitialInterval, txRetryMaxInterval)
+	for attempt := 0; ; attempt++ {
+		err := ds.transaction(ctx, fn)
+		if err == nil || attempt >= retries || !IsRetryable(err) {
+			return err
+		}
+		delay := retry.next()
+		logger.WithFields(logger.Fields{"datasource": ds.name, "attempt": attempt + 1, "retry_in": delay, "error": err}).Warn("Retrying transaction")
+		if waitErr := sleepContext(ctx, delay); waitErr != nil {
+			return fmt.Errorf("%v: %w", err, waitErr)
+		}
+	}
+}
+
+// transactionOnce runs fn like WithTransaction but never retries it, for work consuming input
+// that cannot be read a second time
+func (ds *DataSource) transactionOnce(ctx context.Context, fn func(tx *Tx) error) error {
+	if outer, ok, err := ds.outerTransaction(ctx); ok {
+		if err != nil {
+			return err
+		}
+		return outer.savepoint(fn)
+	}
+	return ds.transaction(ctx, fn)
+}
+
+// outerTransaction returns the transaction of the data source carried by ctx, refusing to join it
+// for another tenant
+func (ds *DataSource) outerTransaction(ctx context.Context) (*Tx, bool, error) {
+	outer, ok := TransactionFromContext(ctx)
+	if !ok || outer.ds != ds {
+		return nil, false, nil
+	}
+	if tenant, _ := TenantFromContext(ctx); tenant != outer.tenant {
+		return nil, true, crossTenant(outer.tenant, tenant)
+	}
+	return outer, true, nil
+}
+
+// Begin starts a transaction for code that cannot run in WithTransaction, e.g. a test rolling
+// back its changes. The transaction has to be ended by Commit or Rollback; its Context makes
+// repositories join it and WithTransaction use savepoints of it.
+func (ds *DataSource) Begin(ctx context.Context) (*Tx, error) {
+	tx, err := ds.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := scopeTransaction(tx); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (ds *DataSource) begin(ctx context.Context) (*Tx, error) {
+	db := ds.DB().BeginTx(ctx, nil)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	tx := &Tx{DB: withContext(withIdentity(db, ctx), ctx), ds: ds}
+	tx.tenant, _ = TenantFromContext(ctx)
+	tx.ctx = context.WithValue(ctx, txContextKey{}, tx)
+	return tx, nil
+}
+
+func (ds *DataSource) transaction(ctx context.Context, fn func(tx *Tx) error) (err error) {
+	tx, err := ds.begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = scopeTransaction(tx); err == nil {
+		err = fn(tx)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback().Error; rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			logger.Error("Rolling back transaction failed: ", rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Exec runs a raw statement in the transaction. Unlike gorm's Exec, which runs no callbacks, it
+// is instrumented like every other query.
+func (tx *Tx) Exec(sql string, values ...interface{}) *gorm.DB {
+	var result *gorm.DB
+	tx.ds.instrument(tx.ctx, sql, func() (int64, error) {
+		result = tx.DB.Exec(sql, values...)
+		return result.RowsAffected, result.Error
+	})
+	return result
+}
+
+// savepoint runs fn in a nested transaction, rolling back to the savepoint on error or panic
+func (tx *Tx) savepoint(fn func(tx *Tx) error) (err error) {
+	nested := &Tx{DB: tx.DB, ds: tx.ds, tenant: tx.tenant, depth: tx.depth + 1}
+	nested.ctx = context.WithValue(tx.ctx, txContextKey{}, nested)
+	name := fmt.Sprintf("sp_%d", nested.depth)
+
+	create, rollback, release := "SAVEPOINT "+name, "ROLLBACK TO SAVEPOINT "+name, "RELEASE SAVEPOINT "+name
+	if tx.ds.Dialect() == DIALECT_MSSQL {
+		create, rollback, release = "SAVE TRANSACTION "+name, "ROLLBACK TRANSACTION "+name, ""
+	}
+
+	if err := tx.Exec(create).Error; err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Exec(rollback)
+			panic(p)
+		}
+	}()
+
+	if err = fn(nested); err != nil {
+		if rollbackErr := tx.Exec(rollback).Error; rollbackErr != nil {
+			logger.Error("Rolling back to savepoint failed: ", rollbackErr)
+		}
+		return err
+	}
+	if release != "" {
+		return tx.Exec(release).Error
+	}
+	return nil
+}
+
+// IsRetryable reports whether err is a serialization failure or deadlock, after which the
+// whole transaction can be retried
+func IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure, deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_LOCK_DEADLOCK
+		return mysqlErr.Number == 1213
+	}
+	return false
+}
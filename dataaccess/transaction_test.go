@@ -0,0 +1,125 @@
+package dataaccess_test
+
+import (
+	"context"
+	"errors"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	"github.com/lib/pq"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transactions", func() {
+	var (
+		ds   *dataaccess.DataSource
+		repo *dataaccess.Repository
+		ctx  = context.Background()
+		boom = errors.New("boom")
+	)
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&order{})
+		repo = dataaccess.NewRepository(ds, &order{})
+	})
+
+	count := func() int64 {
+		n, err := repo.Count(ctx, dataaccess.QuerySpec{})
+		Expect(err).NotTo(HaveOccurred())
+		return n
+	}
+
+	It("commits when the function succeeds", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			return tx.Create(&order{Customer: "acme"}).Error
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count()).To(BeEquivalentTo(1))
+	})
+
+	It("rolls back when the function fails", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			Expect(tx.Create(&order{Customer: "acme"}).Error).NotTo(HaveOccurred())
+			return boom
+		})
+		Expect(err).To(Equal(boom))
+		Expect(count()).To(BeZero())
+	})
+
+	It("rolls back and panics again when the function panics", func() {
+		Expect(func() {
+			ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+				Expect(tx.Create(&order{Customer: "acme"}).Error).NotTo(HaveOccurred())
+				panic("boom")
+			})
+		}).To(Panic())
+		Expect(count()).To(BeZero())
+	})
+
+	It("lets repository calls join the transaction carried by the context", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			Expect(repo.Create(tx.Context(), &order{Customer: "acme"})).To(Succeed())
+			n, err := repo.Count(tx.Context(), dataaccess.QuerySpec{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeEquivalentTo(1))
+			return boom
+		})
+		Expect(err).To(Equal(boom))
+		Expect(count()).To(BeZero())
+	})
+
+	It("rolls back a failed nested call to its savepoint only", func() {
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			Expect(repo.Create(tx.Context(), &order{Customer: "outer"})).To(Succeed())
+			nested := ds.WithTransaction(tx.Context(), func(inner *dataaccess.Tx) error {
+				Expect(repo.Create(inner.Context(), &order{Customer: "inner"})).To(Succeed())
+				return boom
+			})
+			Expect(nested).To(Equal(boom))
+			return repo.Create(tx.Context(), &order{Customer: "after"})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var orders []order
+		_, err = repo.List(ctx, dataaccess.QuerySpec{}, &orders)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(orders).To(HaveLen(2))
+		Expect(orders[0].Customer).To(Equal("outer"))
+		Expect(orders[1].Customer).To(Equal("after"))
+	})
+
+	It("retries serialization failures", func() {
+		attempts := 0
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			attempts++
+			if attempts < 3 {
+				return &pq.Error{Code: "40001"}
+			}
+			return tx.Create(&order{Customer: "acme"}).Error
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attempts).To(Equal(3))
+		Expect(count()).To(BeEquivalentTo(1))
+	})
+
+	It("does not retry other errors", func() {
+		attempts := 0
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			attempts++
+			return boom
+		})
+		Expect(err).To(Equal(boom))
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("gives up after the configured number of retries", func() {
+		attempts := 0
+		err := ds.WithTransaction(ctx, func(tx *dataaccess.Tx) error {
+			attempts++
+			return &pq.Error{Code: "40P01"}
+		})
+		Expect(dataaccess.IsRetryable(err)).To(BeTrue())
+		Expect(attempts).To(Equal(dataaccess.DEFAULT_TX_RETRIES + 1))
+	})
+})
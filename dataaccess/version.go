@@ -0,0 +1,97 @@
+package dataaccess
+
+import (
+	"fmt"
+	"reflect"
+
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// versionCheckKey is the gorm instance setting carrying the version an update expects
+	versionCheckKey = "dataaccess:version_check"
+)
+
+// Versioned adds optimistic locking to a model that embeds it. Creating an entity sets its version
+// to 1, and every update of an entity only succeeds if the row still has the version of the entity
+// and increments it. An update of a row changed since the entity was read fails with
+// errors.ErrConflict, leaving the version of the entity as it was.
+//
+// UpdateColumn and UpdateColumns skip the version like they skip the timestamps. Updates of every
+// row matching a query, such as Repository.BulkUpdate, increment the version without checking it.
+type Versioned struct {
+	Version int64 `gorm:"not null" json:"version"`
+}
+
+// registerVersionCallbacks installs the optimistic locking callbacks on the handle of a data source
+func registerVersionCallbacks(db *gorm.DB) {
+	callbacks := db.Callback()
+	callbacks.Create().After("gorm:update_time_stamp").Register("dataaccess:version_create", versionCreateCallback)
+	callbacks.Update().After("gorm:update_time_stamp").Register("dataaccess:version_update", versionUpdateCallback)
+	callbacks.Update().After("gorm:update").Register("dataaccess:version_check", versionCheckCallback)
+}
+
+// VersionOf returns the version of an entity whose model embeds Versioned
+func VersionOf(entity interface{}) (int64, bool) {
+	v := reflect.Indirect(reflect.ValueOf(entity))
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	field := v.FieldByName("Version")
+	if !field.IsValid() || field.Kind() != reflect.Int64 {
+		return 0, false
+	}
+	return field.Int(), true
+}
+
+func versionCreateCallback(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	if field, ok := scope.FieldByName("Version"); ok && field.IsBlank {
+		field.Set(int64(1))
+	}
+}
+
+// versionUpdateCallback makes the update of an entity conditional on its version and increments it
+func versionUpdateCallback(scope *gorm.Scope) {
+	if scope.HasError() {
+		return
+	}
+	if _, ok := scope.Get("gorm:update_column"); ok {
+		return
+	}
+	field, ok := scope.FieldByName("Version")
+	if !ok {
+		return
+	}
+	column := scope.Quote(field.DBName)
+
+	if scope.PrimaryKeyZero() {
+		// an update of the rows matching a query has no version to check
+		if attrs, ok := scope.InstanceGet("gorm:update_attrs"); ok {
+			attrs.(map[string]interface{})[field.DBName] = gorm.Expr(column + " + 1")
+		}
+		return
+	}
+
+	version, _ := field.Field.Interface().(int64)
+	scope.Search.Where(fmt.Sprintf("%v = ?", column), version)
+	scope.InstanceSet(versionCheckKey, version)
+	scope.SetColumn(field, version+1)
+}
+
+// versionCheckCallback reports a conditional update that found no row of its version as a conflict
+func versionCheckCallback(scope *gorm.Scope) {
+	version, ok := scope.InstanceGet(versionCheckKey)
+	if !ok || scope.HasError() || scope.DB().RowsAffected > 0 {
+		return
+	}
+	if field, ok := scope.FieldByName("Version"); ok {
+		field.Set(version)
+	}
+	scope.Err(kiterrors.ErrConflict.WithCause(fmt.Errorf("%s %v is no longer at version %d",
+		scope.TableName(), scope.PrimaryKeyValue(), version)))
+}
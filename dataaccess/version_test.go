@@ -0,0 +1,110 @@
+package dataaccess_test
+
+import (
+	"context"
+	"net/http"
+
+	"shakilakhtar/go-microservices-platform/dataaccess"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type document struct {
+	ID    uint `gorm:"primary_key"`
+	Title string
+	dataaccess.Versioned
+}
+
+var _ = Describe("optimistic locking", func() {
+	var (
+		ds   *dataaccess.DataSource
+		repo *dataaccess.Repository
+		ctx  = context.Background()
+		doc  *document
+	)
+
+	BeforeEach(func() {
+		ds = newSQLiteDataSource(&document{})
+		repo = dataaccess.NewRepository(ds, &document{})
+		doc = &document{Title: "draft"}
+		Expect(repo.Create(ctx, doc)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(dataaccess.Shutdown()).To(Succeed())
+	})
+
+	It("should start at version 1", func() {
+		Expect(doc.Version).To(BeEquivalentTo(1))
+		version, ok := dataaccess.VersionOf(doc)
+		Expect(ok).To(BeTrue())
+		Expect(version).To(BeEquivalentTo(1))
+		_, ok = dataaccess.VersionOf(&order{})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should increment the version on update", func() {
+		doc.Title = "final"
+		Expect(repo.Update(ctx, doc)).To(Succeed())
+		Expect(doc.Version).To(BeEquivalentTo(2))
+		Expect(repo.Patch(ctx, doc, map[string]interface{}{"title": "published"})).To(Succeed())
+		Expect(doc.Version).To(BeEquivalentTo(3))
+
+		var loaded document
+		Expect(repo.Get(ctx, &loaded, doc.ID)).To(Succeed())
+		Expect(loaded.Title).To(Equal("published"))
+		Expect(loaded.Version).To(BeEquivalentTo(3))
+	})
+
+	It("should refuse to overwrite a concurrent update", func() {
+		var first, second document
+		Expect(repo.Get(ctx, &first, doc.ID)).To(Succeed())
+		Expect(repo.Get(ctx, &second, doc.ID)).To(Succeed())
+
+		first.Title = "first"
+		Expect(repo.Update(ctx, &first)).To(Succeed())
+
+		second.Title = "second"
+		err := repo.Update(ctx, &second)
+		Expect(statusOf(err)).To(Equal(http.StatusConflict))
+		Expect(second.Version).To(BeEquivalentTo(1))
+
+		err = repo.Patch(ctx, &second, map[string]interface{}{"title": "second"})
+		Expect(statusOf(err)).To(Equal(http.StatusConflict))
+
+		var loaded document
+		Expect(repo.Get(ctx, &loaded, doc.ID)).To(Succeed())
+		Expect(loaded.Title).To(Equal("first"))
+		Expect(loaded.Version).To(BeEquivalentTo(2))
+	})
+
+	It("should check the version given with the patched fields", func() {
+		err := repo.Patch(ctx, &document{ID: doc.ID}, map[string]interface{}{"title": "stale", "version": 7})
+		Expect(statusOf(err)).To(Equal(http.StatusConflict))
+		Expect(repo.Patch(ctx, &document{ID: doc.ID}, map[string]interface{}{"title": "current", "version": 1})).To(Succeed())
+	})
+
+	It("should increment the version of every row of a bulk update", func() {
+		Expect(repo.Create(ctx, &document{Title: "draft"})).To(Succeed())
+		count, err := repo.BulkUpdate(ctx, []dataaccess.Filter{{Column: "title", Op: dataaccess.OP_EQ, Values: []interface{}{"draft"}}},
+			map[string]interface{}{"title": "archived"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(BeEquivalentTo(2))
+
+		var docs []document
+		_, err = repo.List(ctx, dataaccess.QuerySpec{}, &docs)
+		Expect(err).NotTo(HaveOccurred())
+		for _, d := range docs {
+			Expect(d.Version).To(BeEquivalentTo(2))
+		}
+	})
+
+	It("should leave the version to UpdateColumns", func() {
+		Expect(ds.DB().Model(doc).UpdateColumns(map[string]interface{}{"title": "fixed"}).Error).NotTo(HaveOccurred())
+		var loaded document
+		Expect(repo.Get(ctx, &loaded, doc.ID)).To(Succeed())
+		Expect(loaded.Title).To(Equal("fixed"))
+		Expect(loaded.Version).To(BeEquivalentTo(1))
+	})
+})
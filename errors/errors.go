@@ -2,9 +2,12 @@ package errors
 
 import (
 	logger "github.com/sirupsen/logrus"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
 )
 
 type Errors struct {
@@ -17,14 +20,43 @@ type Error struct {
 	Id          string `json:"id"`
 	Status      int    `json:"status"`
 	Description string `json:"error_description"`
+	RequestId   string `json:"request_id,omitempty"`
+	// Debug is only filled in on responses written in debug mode
+	Debug *DebugInfo `json:"debug,omitempty"`
+
+	cause error
+	stack []uintptr
+}
+
+// DebugInfo carries the cause chain and creation stack of an error
+type DebugInfo struct {
+	Causes []string `json:"causes,omitempty"`
+	Stack  []string `json:"stack,omitempty"`
+}
+
+type debugContextKey struct{}
+
+// WithDebug marks the context of a request running in debug mode, with the logger of the request.
+// WriteErrorContext only exposes causes and stacks for such a context.
+func WithDebug(ctx context.Context, log *logger.Entry) context.Context {
+	return context.WithValue(ctx, debugContextKey{}, log)
+}
+
+// DebugLogger returns the logger of a request running in debug mode, and false for other requests
+func DebugLogger(ctx context.Context) (*logger.Entry, bool) {
+	log, ok := ctx.Value(debugContextKey{}).(*logger.Entry)
+	return log, ok
 }
 
 const (
 	BAD_REQUEST              = "bad_request"
+	NOT_FOUND                = "not_found"
 	UNAUTHORIZED             = "unauthorized"
+	FORBIDDEN                = "forbidden"
 	MSG_UNAUTHORIZED         = "The authorization token does not seem to get you access at the moment. Please contact admin"
 	NO_ACCESS_TOKEN_PROVIDED = "no_authorization_token_provided"
 	INTERNAL_SERVER_ERROR    = "internal_server_error"
+	CONFLICT                 = "conflict"
 )
 
 var (
@@ -36,6 +68,10 @@ var (
 	ErrBadRequest      = &Error{Id: BAD_REQUEST, Status: http.StatusBadRequest, Description: NO_ACCESS_TOKEN_PROVIDED}
 	ErrInternalServer  = &Error{Id: INTERNAL_SERVER_ERROR, Status: 500, Description: "Internal Server Error.Something went wrong."}
 	ErrUnauthorized    = &Error{Id: UNAUTHORIZED, Status: http.StatusUnauthorized, Description: MSG_UNAUTHORIZED}
+	ErrNotFound        = &Error{Id: NOT_FOUND, Status: http.StatusNotFound, Description: "The requested resource could not be found."}
+	ErrForbidden       = &Error{Id: FORBIDDEN, Status: http.StatusForbidden, Description: "Access to the requested resource is not allowed."}
+	// ErrConflict is returned when a resource was changed since the version the request is based on
+	ErrConflict = &Error{Id: CONFLICT, Status: http.StatusConflict, Description: "The resource was modified by another request. Reload it and try again."}
 )
 
 // HandleError creates an errors.error type with a given string, logs the error and returns it
@@ -50,9 +86,94 @@ func NewError(msg string) error {
 	return errors.New(msg)
 }
 
+// NewStatusError creates a platform error and records the stack at the call site
+func NewStatusError(id string, status int, description string) *Error {
+	return &Error{Id: id, Status: status, Description: description, stack: callers()}
+}
+
+// Wrap creates a platform error caused by err and records the stack at the call site
+func Wrap(err error, id string, status int, description string) *Error {
+	return &Error{Id: id, Status: status, Description: description, cause: err, stack: callers()}
+}
+
+// WithCause returns a copy of the error caused by err, recording the stack at the call site.
+// Use it to attach the underlying failure to one of the predefined errors:
+//	return kiterrors.ErrInternalServer.WithCause(err)
+func (e *Error) WithCause(err error) *Error {
+	c := *e
+	c.Debug = nil
+	c.cause = err
+	c.stack = callers()
+	return &c
+}
+
+// Error implements the error interface so that platform errors can travel as plain errors
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return e.Description
+	}
+	return e.Id
+}
+
+// Unwrap returns the direct cause of the error
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Causes returns the messages of the cause chain, starting with the direct cause
+func (e *Error) Causes() []string {
+	var causes []string
+	for c := e.cause; c != nil; c = errors.Unwrap(c) {
+		causes = append(causes, c.Error())
+	}
+	return causes
+}
+
+// StackTrace returns the stack recorded when the error was created, one frame per entry
+func (e *Error) StackTrace() []string {
+	if len(e.stack) == 0 {
+		return nil
+	}
+	var trace []string
+	frames := runtime.CallersFrames(e.stack)
+	for {
+		frame, more := frames.Next()
+		trace = append(trace, fmt.Sprintf("%s (%s:%d)", frame.Function, frame.File, frame.Line))
+		if !more {
+			break
+		}
+	}
+	return trace
+}
+
+func callers() []uintptr {
+	pcs := make([]uintptr, 32)
+	// skip runtime.Callers, callers and the constructor itself
+	n := runtime.Callers(3, pcs)
+	return pcs[:n]
+}
+
 //Write errors to HTTP response
 func WriteError(w http.ResponseWriter, err *Error) {
+	WriteErrorContext(context.Background(), w, err)
+}
+
+// WriteErrorContext writes the error to the response of the request of ctx, including its causes
+// and stack when the request runs in debug mode
+func WriteErrorContext(ctx context.Context, w http.ResponseWriter, err *Error) {
+	out := *err
+	out.Debug = nil
+	if log, ok := DebugLogger(ctx); ok {
+		out.Debug = &DebugInfo{Causes: err.Causes(), Stack: err.StackTrace()}
+		log.WithFields(logger.Fields{
+			"id":     err.Id,
+			"status": err.Status,
+			"causes": out.Debug.Causes,
+			"stack":  out.Debug.Stack,
+		}).Error(err.Error())
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(err.Status)
-	json.NewEncoder(w).Encode(Errors{[]*Error{err}})
+	json.NewEncoder(w).Encode(Errors{[]*Error{&out}})
 }
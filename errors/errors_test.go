@@ -1,7 +1,11 @@
 package errors_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"time"
 
@@ -56,4 +60,43 @@ var _ = Describe("Errors", func() {
 			})
 		})
 	})
+
+	Describe("When wrapping an underlying error", func() {
+		rootCause := fmt.Errorf("connection refused")
+		wrapped := kiterrors.ErrInternalServer.WithCause(fmt.Errorf("loading user: %w", rootCause))
+
+		It("should record the cause chain", func() {
+			Expect(wrapped.Causes()).To(Equal([]string{"loading user: connection refused", "connection refused"}))
+			Expect(wrapped.Unwrap()).NotTo(BeNil())
+		})
+
+		It("should record the stack at creation", func() {
+			Expect(wrapped.StackTrace()).NotTo(BeEmpty())
+			Expect(wrapped.StackTrace()[0]).To(ContainSubstring("errors_test"))
+		})
+
+		It("should leave the predefined error untouched", func() {
+			Expect(kiterrors.ErrInternalServer.Causes()).To(BeEmpty())
+		})
+
+		It("should not expose causes or stack in a regular response", func() {
+			recorder := httptest.NewRecorder()
+			kiterrors.WriteError(recorder, wrapped)
+			Expect(recorder.Code).To(Equal(500))
+			Expect(recorder.Body.String()).NotTo(ContainSubstring("connection refused"))
+			Expect(recorder.Body.String()).NotTo(ContainSubstring("stack"))
+		})
+
+		It("should expose causes and stack for a debug context", func() {
+			recorder := httptest.NewRecorder()
+			ctx := kiterrors.WithDebug(context.Background(), logger.NewEntry(logger.StandardLogger()))
+			kiterrors.WriteErrorContext(ctx, recorder, wrapped)
+
+			var written kiterrors.Errors
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &written)).To(Succeed())
+			Expect(written.Errors[0].Debug).NotTo(BeNil())
+			Expect(written.Errors[0].Debug.Causes).To(ContainElement("connection refused"))
+			Expect(written.Errors[0].Debug.Stack).NotTo(BeEmpty())
+		})
+	})
 })
@@ -4,19 +4,23 @@ require (
 	github.com/cloudfoundry-community/go-cfenv v1.15.0
 	github.com/cloudfoundry-incubator/cf-test-helpers v1.0.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/gorilla/mux v1.7.4 // indirect
 	github.com/inconshreveable/log15 v0.0.0-20200109203555-b30bc20e4fd1
 	github.com/jinzhu/gorm v1.9.10
 	github.com/kr/pretty v0.2.0 // indirect
+	github.com/lib/pq v1.1.1
 	github.com/mattn/go-colorable v0.1.6 // indirect
+	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/mitchellh/mapstructure v1.3.0 // indirect
 	github.com/newrelic/go-agent v1.9.0
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.9.0
 	github.com/sirupsen/logrus v1.4.0
+	gopkg.in/yaml.v2 v2.2.4
 //github.com/smartystreets/goconvey v1.6.4 // indirect
 //	github.com/inconshreveable/log15 v2.11.0
 )
 
-go 1.14
+go 1.16
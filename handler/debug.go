@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dterrors "shakilakhtar/go-microservices-platform/errors"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const (
+	// DebugHeader carries a signed debug token that switches a single request into debug mode
+	DebugHeader = "X-Platform-Debug"
+
+	// DEBUG_ENV enables debug mode for every request when set to "true". Never set it in production.
+	DEBUG_ENV = "PLATFORM_DEBUG"
+
+	// DEBUG_SECRET_ENV holds the secret debug tokens are signed with. Without it the debug header is ignored.
+	DEBUG_SECRET_ENV = "PLATFORM_DEBUG_SECRET"
+)
+
+// DebugHandler switches a request into debug mode when the environment enables it or when the
+// request carries a valid signed debug token. Error responses written with the context of such a
+// request, see EncodeErrorContext, include the cause chain and stack of platform errors, and the
+// request gets its own debug level logger.
+// Requests outside debug mode are passed on untouched, so nothing is exposed in production.
+func DebugHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !debugEnabled(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		std := logger.StandardLogger()
+		verbose := logger.New()
+		verbose.Out = std.Out
+		verbose.Formatter = std.Formatter
+		verbose.Hooks = std.Hooks
+		verbose.SetLevel(logger.DebugLevel)
+		log := verbose.WithFields(logger.Fields{
+			"debug":      true,
+			"method":     r.Method,
+			"url":        r.URL.String(),
+			"request_id": r.Header.Get(RequestIdHeader),
+		})
+		log.Debug("debug mode enabled for request")
+
+		// the mode travels with the request rather than the writer, which later middleware may wrap
+		next.ServeHTTP(w, r.WithContext(dterrors.WithDebug(r.Context(), log)))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// RequestLogger returns the debug logger of a request running in debug mode and the
+// standard logger otherwise
+func RequestLogger(r *http.Request) *logger.Entry {
+	if log, ok := dterrors.DebugLogger(r.Context()); ok {
+		return log
+	}
+	return logger.NewEntry(logger.StandardLogger())
+}
+
+// SignDebugToken creates a debug header value valid until the given time
+func SignDebugToken(secret string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + ":" + debugSignature(secret, exp)
+}
+
+func debugEnabled(r *http.Request) bool {
+	if os.Getenv(DEBUG_ENV) == "true" {
+		return true
+	}
+	secret := os.Getenv(DEBUG_SECRET_ENV)
+	token := r.Header.Get(DebugHeader)
+	if secret == "" || token == "" {
+		return false
+	}
+	return validDebugToken(secret, token, time.Now())
+}
+
+func validDebugToken(secret string, token string, now time.Time) bool {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(debugSignature(secret, parts[0])))
+}
+
+func debugSignature(secret string, exp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	dterrors "shakilakhtar/go-microservices-platform/errors"
+	"shakilakhtar/go-microservices-platform/handler"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const debugSecret = "debug-secret"
+
+var _ = Describe("debug mode", func() {
+	var failing http.Handler
+	encode := func(w http.ResponseWriter, r *http.Request) {
+		handler.EncodeErrorContext(r.Context(), dterrors.ErrInternalServer.WithCause(dterrors.NewError("disk full")), w)
+	}
+
+	BeforeEach(func() {
+		recorder = httptest.NewRecorder()
+		os.Setenv(handler.DEBUG_SECRET_ENV, debugSecret)
+		failing = handler.DebugHandler(http.HandlerFunc(encode))
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(handler.DEBUG_SECRET_ENV)
+		os.Unsetenv(handler.DEBUG_ENV)
+	})
+
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/orders", nil)
+		if token != "" {
+			r.Header.Set(handler.DebugHeader, token)
+		}
+		return r
+	}
+
+	It("keeps causes out of the response without a debug token", func() {
+		failing.ServeHTTP(recorder, request(""))
+		Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("disk full"))
+	})
+
+	It("includes causes and stack with a valid signed token", func() {
+		failing.ServeHTTP(recorder, request(handler.SignDebugToken(debugSecret, time.Now().Add(time.Minute))))
+		Expect(recorder.Body.String()).To(ContainSubstring("disk full"))
+		Expect(recorder.Body.String()).To(ContainSubstring("stack"))
+	})
+
+	It("ignores tokens signed with another secret", func() {
+		failing.ServeHTTP(recorder, request(handler.SignDebugToken("guess", time.Now().Add(time.Minute))))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("disk full"))
+	})
+
+	It("ignores expired tokens", func() {
+		failing.ServeHTTP(recorder, request(handler.SignDebugToken(debugSecret, time.Now().Add(-time.Minute))))
+		Expect(recorder.Body.String()).NotTo(ContainSubstring("disk full"))
+	})
+
+	It("keeps debug mode when later middleware wraps the response writer", func() {
+		wrapped := handler.DebugHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encode(statusRecorder{ResponseWriter: w}, r)
+		}))
+		os.Setenv(handler.DEBUG_ENV, "true")
+		wrapped.ServeHTTP(recorder, request(""))
+		Expect(recorder.Body.String()).To(ContainSubstring("disk full"))
+	})
+
+	It("enables debug mode for every request through the environment", func() {
+		os.Setenv(handler.DEBUG_ENV, "true")
+		failing.ServeHTTP(recorder, request(""))
+		Expect(recorder.Body.String()).To(ContainSubstring("disk full"))
+	})
+})
+
+// statusRecorder wraps the response writer like status recording middleware does
+type statusRecorder struct {
+	http.ResponseWriter
+}
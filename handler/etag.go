@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	dterrors "shakilakhtar/go-microservices-platform/errors"
+)
+
+const (
+	ETagHeader        = "ETag"
+	IfMatchHeader     = "If-Match"
+	IfNoneMatchHeader = "If-None-Match"
+)
+
+// ETag returns the entity tag of a version of a resource, e.g. the version of a
+// dataaccess.Versioned entity
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// SetETag sets the ETag header of a response to the version of the resource it carries
+func SetETag(w http.ResponseWriter, version int64) {
+	w.Header().Set(ETagHeader, ETag(version))
+}
+
+// IfMatch returns the version a conditional update is based on, taken from the If-Match header.
+// ok is false without header or for "*", which any version matches. A header naming anything
+// but a single version of the resource is a bad request.
+//
+// Updating the entity at that version makes the repository refuse the update with
+// errors.ErrConflict if the resource changed since the client read it:
+//
+//	if version, ok, err := handler.IfMatch(r); err != nil {
+//		return err
+//	} else if ok {
+//		order.Version = version
+//	}
+func IfMatch(r *http.Request) (version int64, ok bool, err error) {
+	header := strings.TrimSpace(r.Header.Get(IfMatchHeader))
+	if header == "" || header == "*" {
+		return 0, false, nil
+	}
+	// If-Match compares strongly, so weak tags never match
+	version, err = parseETag(header)
+	if err != nil {
+		return 0, false, dterrors.NewStatusError(dterrors.BAD_REQUEST, http.StatusBadRequest, "The If-Match header does not name a version of the resource.")
+	}
+	return version, true, nil
+}
+
+// NotModified answers a conditional GET with 304 Not Modified if the If-None-Match header names
+// the version of the resource, and reports whether it did
+func NotModified(w http.ResponseWriter, r *http.Request, version int64) bool {
+	header := r.Header.Get(IfNoneMatchHeader)
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		// If-None-Match compares weakly
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if v, err := parseETag(tag); tag == "*" || err == nil && v == version {
+			SetETag(w, version)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+func parseETag(tag string) (int64, error) {
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil || !strings.HasPrefix(tag, `"`) {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseInt(unquoted, 10, 64)
+}
@@ -0,0 +1,77 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	dterrors "shakilakhtar/go-microservices-platform/errors"
+	"shakilakhtar/go-microservices-platform/handler"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("etag", func() {
+	request := func(header string, value string) *http.Request {
+		r := httptest.NewRequest(http.MethodPut, "/orders/1", nil)
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+
+	It("sets the version as entity tag", func() {
+		w := httptest.NewRecorder()
+		handler.SetETag(w, 3)
+		Expect(w.Header().Get(handler.ETagHeader)).To(Equal(`"3"`))
+	})
+
+	Context("If-Match", func() {
+		It("returns the version of the header", func() {
+			version, ok, err := handler.IfMatch(request(handler.IfMatchHeader, `"7"`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(version).To(BeEquivalentTo(7))
+		})
+
+		It("matches any version without header or for *", func() {
+			_, ok, err := handler.IfMatch(request(handler.IfMatchHeader, ""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			_, ok, err = handler.IfMatch(request(handler.IfMatchHeader, "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+
+		It("refuses weak, unquoted and multiple tags", func() {
+			for _, value := range []string{`W/"7"`, "7", `"7", "8"`, `"seven"`} {
+				_, _, err := handler.IfMatch(request(handler.IfMatchHeader, value))
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*dterrors.Error).Status).To(Equal(http.StatusBadRequest))
+			}
+		})
+	})
+
+	Context("If-None-Match", func() {
+		It("answers 304 for the current version", func() {
+			w := httptest.NewRecorder()
+			Expect(handler.NotModified(w, request(handler.IfNoneMatchHeader, `"2", W/"3"`), 3)).To(BeTrue())
+			Expect(w.Code).To(Equal(http.StatusNotModified))
+			Expect(w.Header().Get(handler.ETagHeader)).To(Equal(`"3"`))
+		})
+
+		It("leaves other versions to the handler", func() {
+			w := httptest.NewRecorder()
+			Expect(handler.NotModified(w, request(handler.IfNoneMatchHeader, `"2"`), 3)).To(BeFalse())
+			Expect(handler.NotModified(w, request(handler.IfNoneMatchHeader, ""), 3)).To(BeFalse())
+			Expect(w.Header().Get(handler.ETagHeader)).To(BeEmpty())
+		})
+	})
+
+	It("encodes a conflict as 409", func() {
+		w := httptest.NewRecorder()
+		handler.EncodeError(dterrors.ErrConflict.WithCause(http.ErrBodyNotAllowed), w)
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		Expect(w.Body.String()).To(ContainSubstring(`"id":"conflict"`))
+	})
+})
@@ -5,6 +5,7 @@ import (
 	"shakilakhtar/go-microservices-platform/security/uaa"
 	logger "github.com/sirupsen/logrus"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
 	"reflect"
@@ -56,7 +57,7 @@ func LoggingHandler(next http.Handler) http.Handler {
 		t1 := time.Now()
 		next.ServeHTTP(w, r)
 		t2 := time.Now()
-		logger.Debug("[%s] %q %v\n", r.Method, r.URL.String(), t2.Sub(t1))
+		logger.Debugf("[%s] %q %v\n", r.Method, r.URL.String(), t2.Sub(t1))
 	}
 
 	return http.HandlerFunc(fn)
@@ -67,8 +68,8 @@ func RecoverHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				logger.Debug("panic: %+v", err)
-				http.Error(w, http.StatusText(500), 500)
+				logger.Debugf("panic: %+v", err)
+				dterrors.WriteErrorContext(r.Context(), w, dterrors.ErrInternalServer.WithCause(fmt.Errorf("panic: %v", err)))
 			}
 		}()
 
@@ -115,7 +116,7 @@ func BodyParserHandler(v interface{}) func(http.Handler) http.Handler {
 			err := json.NewDecoder(r.Body).Decode(val)
 
 			if err != nil {
-				dterrors.WriteError(w, dterrors.ErrBadRequest)
+				dterrors.WriteErrorContext(r.Context(), w, dterrors.ErrBadRequest)
 				return
 			}
 
@@ -2,8 +2,10 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	dterrors "shakilakhtar/go-microservices-platform/errors"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"mime"
 	"net/http"
@@ -15,8 +17,11 @@ type errorer interface {
 }
 
 const (
-	ContentTypeHeader = "Content-Type"
-	JsonMediaType     = "application/json; charset=utf-8"
+	ContentTypeHeader   = "Content-Type"
+	RequestIdHeader     = "X-Request-Id"
+	VcapRequestIdHeader = "X-Vcap-Request-Id"
+	JsonMediaType       = "application/json; charset=utf-8"
+	ProblemMediaType    = "application/problem+json"
 )
 
 type ErrorResponse struct {
@@ -36,6 +41,17 @@ func EncodeResponse(w http.ResponseWriter, response interface{}) error {
 
 // encode errors from business-logic
 func EncodeError(err error, w http.ResponseWriter) {
+	EncodeErrorContext(context.Background(), err, w)
+}
+
+// EncodeErrorContext encodes errors like EncodeError, with the causes and stack of platform errors
+// when ctx is the context of a request running in debug mode
+func EncodeErrorContext(ctx context.Context, err error, w http.ResponseWriter) {
+	var platformErr *dterrors.Error
+	if errors.As(err, &platformErr) {
+		dterrors.WriteErrorContext(ctx, w, platformErr)
+		return
+	}
 	switch err {
 	case dterrors.ErrUnknown:
 		w.WriteHeader(http.StatusNotFound)
@@ -91,6 +107,12 @@ type errorWrapper struct {
 
 //Encode error and add any error message to show
 func ErrorEncoder(err error, w http.ResponseWriter) {
+	var platformErr *dterrors.Error
+	if errors.As(err, &platformErr) {
+		dterrors.WriteError(w, platformErr)
+		return
+	}
+
 	code := http.StatusInternalServerError
 	msg := err.Error()
 
@@ -105,13 +127,109 @@ func ErrorEncoder(err error, w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(errorWrapper{Error: msg})
 }
 
-//Decodes error and make a  new error from wrapper
-func errorDecoder(r *http.Response) error {
-	var w errorWrapper
-	if err := json.NewDecoder(r.Body).Decode(&w); err != nil {
+// problemDetails is the RFC 7807 problem+json representation of an error
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Instance  string `json:"instance"`
+	Id        string `json:"id"`
+	RequestId string `json:"request_id"`
+}
+
+// ErrorDecoder decodes the error response of another platform service back into a *errors.Error.
+// It understands the errors.Errors envelope, the {"error": ...} wrapper, problem+json and the
+// OAuth error JSON returned by UAA. The id, status, description and request id are preserved,
+// falling back to the HTTP status and the request id header when the body does not carry them.
+func ErrorDecoder(r *http.Response) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
 		return err
 	}
-	return dterrors.NewError(w.Error)
+
+	e := decodeErrorBody(r.Header.Get(ContentTypeHeader), body)
+	if e.Status == 0 {
+		e.Status = r.StatusCode
+	}
+	if e.Id == "" {
+		e.Id = statusId(e.Status)
+	}
+	if e.Description == "" {
+		e.Description = http.StatusText(e.Status)
+	}
+	if e.RequestId == "" {
+		e.RequestId = r.Header.Get(RequestIdHeader)
+	}
+	if e.RequestId == "" {
+		e.RequestId = r.Header.Get(VcapRequestIdHeader)
+	}
+	return e
+}
+
+func decodeErrorBody(contentType string, body []byte) *dterrors.Error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		// not a JSON object, keep whatever text the service sent
+		return &dterrors.Error{Description: strings.TrimSpace(string(body))}
+	}
+
+	if raw, ok := fields["errors"]; ok {
+		var envelope []*dterrors.Error
+		if err := json.Unmarshal(raw, &envelope); err == nil && len(envelope) > 0 && envelope[0] != nil {
+			return envelope[0]
+		}
+	}
+
+	if isProblem(contentType, fields) {
+		var p problemDetails
+		json.Unmarshal(body, &p)
+		e := &dterrors.Error{Type: p.Type, Id: p.Id, Status: p.Status, Description: p.Detail, RequestId: p.RequestId}
+		if e.Description == "" {
+			e.Description = p.Title
+		}
+		return e
+	}
+
+	// a flat errors.Error and the UAA OAuth error share the same shape
+	e := &dterrors.Error{}
+	raw, ok := fields["error"]
+	if !ok {
+		json.Unmarshal(body, e)
+		return e
+	}
+
+	var msg string
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		// {"error": {...}} nests the actual error one level down
+		return decodeErrorBody(contentType, raw)
+	}
+
+	json.Unmarshal(body, e)
+	if _, described := fields["error_description"]; !described {
+		// the errorWrapper only carries a message
+		e.Type = ""
+		e.Description = msg
+		return e
+	}
+	if e.Id == "" {
+		e.Id = msg
+	}
+	return e
+}
+
+func isProblem(contentType string, fields map[string]json.RawMessage) bool {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil && t == ProblemMediaType {
+		return true
+	}
+	_, hasTitle := fields["title"]
+	_, hasDetail := fields["detail"]
+	return hasTitle || hasDetail
+}
+
+// statusId derives an error id such as "not_found" from an HTTP status code
+func statusId(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
 }
 
 func IsHeaderPresent(r *http.Request, header string) bool {
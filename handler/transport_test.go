@@ -1,25 +1,87 @@
 package handler_test
 
 import (
-
-	."github.com/onsi/ginkgo"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"strings"
+
+	dterrors "shakilakhtar/go-microservices-platform/errors"
+	"shakilakhtar/go-microservices-platform/handler"
 
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
+
 var (
 	recorder *httptest.ResponseRecorder
 )
 
-var _=Describe("tranport",func(){
+func errorResponse(status int, contentType string, body string) *http.Response {
+	header := http.Header{}
+	header.Set(handler.ContentTypeHeader, contentType)
+	header.Set(handler.RequestIdHeader, "req-from-header")
+	return &http.Response{StatusCode: status, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+}
+
+func decodeError(status int, contentType string, body string) *dterrors.Error {
+	err := handler.ErrorDecoder(errorResponse(status, contentType, body))
+	e, ok := err.(*dterrors.Error)
+	Expect(ok).To(BeTrue())
+	return e
+}
 
-	BeforeEach(func(){
-		recorder=httptest.NewRecorder()
+var _ = Describe("tranport", func() {
+
+	BeforeEach(func() {
+		recorder = httptest.NewRecorder()
 	})
 
-	Context("Handler", func(){
-		It("",func(){
+	Context("Decoding platform error responses", func() {
+		It("decodes the errors envelope written by WriteError", func() {
+			dterrors.WriteError(recorder, &dterrors.Error{Id: "bad_request", Status: http.StatusBadRequest, Description: "name is required", RequestId: "req-1"})
+			e := decodeError(recorder.Code, handler.JsonMediaType, recorder.Body.String())
+			Expect(e.Id).To(Equal("bad_request"))
+			Expect(e.Status).To(Equal(http.StatusBadRequest))
+			Expect(e.Description).To(Equal("name is required"))
+			Expect(e.RequestId).To(Equal("req-1"))
+		})
 
+		It("decodes the error wrapper written by ErrorEncoder", func() {
+			handler.ErrorEncoder(dterrors.ErrUnknown, recorder)
+			e := decodeError(recorder.Code, handler.JsonMediaType, recorder.Body.String())
+			Expect(e.Id).To(Equal("not_found"))
+			Expect(e.Status).To(Equal(http.StatusNotFound))
+			Expect(e.Description).To(Equal("unknown resource"))
+			Expect(e.RequestId).To(Equal("req-from-header"))
 		})
 
+		It("decodes a nested error object", func() {
+			e := decodeError(http.StatusConflict, handler.JsonMediaType, `{"error": {"id": "conflict", "status": 409, "error_description": "already exists"}}`)
+			Expect(e.Id).To(Equal("conflict"))
+			Expect(e.Description).To(Equal("already exists"))
+		})
+
+		It("decodes problem+json", func() {
+			e := decodeError(http.StatusForbidden, handler.ProblemMediaType, `{"type": "https://example.com/probs/scope", "title": "Forbidden", "status": 403, "detail": "missing scope", "request_id": "req-2"}`)
+			Expect(e.Status).To(Equal(http.StatusForbidden))
+			Expect(e.Type).To(Equal("https://example.com/probs/scope"))
+			Expect(e.Id).To(Equal("forbidden"))
+			Expect(e.Description).To(Equal("missing scope"))
+			Expect(e.RequestId).To(Equal("req-2"))
+		})
+
+		It("decodes the UAA OAuth error", func() {
+			e := decodeError(http.StatusUnauthorized, handler.JsonMediaType, `{"error": "invalid_token", "error_description": "Invalid access token"}`)
+			Expect(e.Id).To(Equal("invalid_token"))
+			Expect(e.Status).To(Equal(http.StatusUnauthorized))
+			Expect(e.Description).To(Equal("Invalid access token"))
+		})
+
+		It("keeps a plain text body as the description", func() {
+			e := decodeError(http.StatusBadGateway, "text/plain", "upstream unavailable\n")
+			Expect(e.Id).To(Equal("bad_gateway"))
+			Expect(e.Description).To(Equal("upstream unavailable"))
+		})
 	})
-})
\ No newline at end of file
+})
@@ -133,7 +133,10 @@ func (auth *authInternal) Protected(requiredScopes RequiredScopes, protectedFunc
 							logger.Debug("The token did not have all the required scopes")
 						} else {
 							logger.Debug("The token was valid having all required scopes")
-							// everything is OK -> calling the protected function
+							// everything is OK -> calling the protected function with the claims in the request context
+							if claims, ok := token.Claims.(jwt.MapClaims); ok {
+								r = r.WithContext(WithClaims(r.Context(), claims))
+							}
 							protectedFunc(w, r)
 							return
 						}
@@ -151,7 +154,7 @@ type claimSet map[string]bool
 
 func extractClaimSet(claims jwt.MapClaims) claimSet {
 	claimSet := claimSet{}
-	if scopes, found := claims["scope"]; found {
+	if scopes, found := claims[ScopeClaim]; found {
 		switch castedScopes := scopes.(type) {
 		case []interface{}:
 			for _, scope := range castedScopes {
@@ -165,6 +165,21 @@ var _ = Describe("Auth", func() {
 			})
 		})
 
+		Context("having a valid request", func() {
+			It("should pass the token claims to the protected handler", func() {
+				var claims map[string]interface{}
+				protectedHandler := authCtx.Protected(RequiredScopes{"user"}, func(w http.ResponseWriter, r *http.Request) {
+					claims, _ = ClaimsFromContext(r.Context())
+				})
+				status := 0
+				w := writerMock{statusHeader: &status}
+				protectedHandler(w, &http.Request{Header: http.Header{"Authorization": []string{"Bearer " + createTokenWithClaims(RequiredScopes{"user"})}}})
+				Expect(claims).To(HaveKeyWithValue("name", "Jon Snow"))
+				Expect(StringClaim(claims, "name")).To(Equal("Jon Snow"))
+				Expect(StringClaim(claims, ZoneIdClaim)).To(BeEmpty())
+			})
+		})
+
 		Context("having a valid request with one missing required scope", func() {
 			It("should fail", func() {
 				requiredScopes := RequiredScopes{"admin", "user"}
@@ -0,0 +1,56 @@
+package uaa
+
+import (
+	"context"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// ZoneIdClaim is the claim carrying the UAA identity zone the token was issued in
+	ZoneIdClaim = "zid"
+	// UserNameClaim is the claim carrying the user name of user tokens
+	UserNameClaim = "user_name"
+	// ClientIdClaim is the claim carrying the OAuth client of the token
+	ClientIdClaim = "client_id"
+	// UserIdClaim is the claim carrying the id of the user of user tokens
+	UserIdClaim = "user_id"
+	// ScopeClaim is the claim carrying the scopes granted to the token
+	ScopeClaim = "scope"
+)
+
+type claimsContextKey struct{}
+
+// WithClaims returns a context carrying the claims of a validated token
+func WithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the token validated by Protected for the request
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(jwt.MapClaims)
+	return claims, ok
+}
+
+// StringClaim returns a claim as a string, or "" when the claims do not carry it
+func StringClaim(claims jwt.MapClaims, name string) string {
+	switch value := claims[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// ScopesOf returns the scopes granted by the claims
+func ScopesOf(claims jwt.MapClaims) []string {
+	values, _ := claims[ScopeClaim].([]interface{})
+	scopes := make([]string, 0, len(values))
+	for _, value := range values {
+		scopes = append(scopes, fmt.Sprint(value))
+	}
+	return scopes
+}
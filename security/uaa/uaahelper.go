@@ -9,7 +9,7 @@ import (
 	"net/http"
 	"strings"
 	dtlogger "github.com/sirupsen/logrus"
-	kiterrors "go-microservices-platform/errors"
+	kiterrors "shakilakhtar/go-microservices-platform/errors"
 )
 
 // UaaHelper represents a UAA utility for retrieving tokens and updating users.
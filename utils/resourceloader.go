@@ -1,18 +1,20 @@
 package utils
 
 import (
-	logger "github.com/sirupsen/logrus"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 )
 
-func LoadConfig(fileName string, conf interface{}) {
+// LoadConfig decodes the JSON file into conf. A missing, unreadable or invalid file is returned as
+// an error naming the file.
+func LoadConfig(fileName string, conf interface{}) error {
 	file, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		logger.Error("[loadConfig]: %s\n", err)
+		return fmt.Errorf("[loadConfig]: %w", err)
 	}
-	err = json.Unmarshal(file, &conf)
-	if err != nil {
-		logger.Error("[loadConfig]: %s\n", err)
+	if err := json.Unmarshal(file, conf); err != nil {
+		return fmt.Errorf("[loadConfig]: %s: %w", fileName, err)
 	}
+	return nil
 }
@@ -0,0 +1,49 @@
+package utils_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"shakilakhtar/go-microservices-platform/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LoadConfig", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "utils")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("decodes the file", func() {
+		file := filepath.Join(dir, "config.json")
+		Expect(ioutil.WriteFile(file, []byte(`{"name": "orders"}`), 0600)).To(Succeed())
+		var conf struct{ Name string }
+		Expect(utils.LoadConfig(file, &conf)).To(Succeed())
+		Expect(conf.Name).To(Equal("orders"))
+	})
+
+	It("reports a missing file", func() {
+		var conf struct{}
+		err := utils.LoadConfig(filepath.Join(dir, "missing.json"), &conf)
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(err).To(MatchError(ContainSubstring("missing.json")))
+	})
+
+	It("reports an invalid file", func() {
+		file := filepath.Join(dir, "config.json")
+		Expect(ioutil.WriteFile(file, []byte(`{"name": `), 0600)).To(Succeed())
+		var conf struct{}
+		Expect(utils.LoadConfig(file, &conf)).To(MatchError(ContainSubstring("config.json")))
+	})
+})